@@ -12,6 +12,7 @@ import (
 
 var (
 	whipURL   = ""
+	whipToken = ""
 	whipState *WhipState
 )
 
@@ -19,10 +20,12 @@ func showHelp() {
 	fmt.Printf("Usage:%s {params}\n", os.Args[0])
 	fmt.Printf("Params:\n")
 	fmt.Println("      -url {whip url, e.g http://localhost:8080/whip/publish/live/stream1}")
+	fmt.Println("      -token {bearer token, if the whip server requires auth}")
 }
 
 func main() {
 	flag.StringVar(&whipURL, "url", "", "whip url")
+	flag.StringVar(&whipToken, "token", "", "whip bearer token")
 	flag.Parse()
 
 	if whipURL == "" {
@@ -30,7 +33,7 @@ func main() {
 		return
 	}
 
-	whipState = &WhipState{}
+	whipState = &WhipState{Token: whipToken}
 	log.Warnf("start whip publish %v", whipURL)
 	whipState.Connect(whipURL)
 
@@ -3,12 +3,17 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudwebrtc/livekit-whip-go/pkg/client"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
 
 	log "github.com/pion/ion-log"
 	"github.com/pion/mediadevices"
@@ -32,14 +37,26 @@ import (
 	_ "github.com/pion/mediadevices/pkg/driver/microphone" // This is required to register microphone adapter
 )
 
+const (
+	maxICERestartBackoff = 30 * time.Second
+)
+
 type WhipState struct {
+	// Token is sent as "Authorization: Bearer" when the server requires auth
+	Token       string
 	httpClient  *http.Client
 	resourceUrl string
 	whipCon     *client.WHIPConn
+	lock        sync.Mutex
+	restarting  bool
+	closed      bool
 }
 
 func (w *WhipState) Close() {
-	req, err := http.NewRequest(http.MethodDelete, w.resourceUrl, nil)
+	w.lock.Lock()
+	w.closed = true
+	w.lock.Unlock()
+	req, err := w.newRequest(http.MethodDelete, w.resourceUrl, nil)
 	if err != nil {
 		log.Errorf("http.NewRequest DELETE failed %v", err)
 		return
@@ -122,7 +139,14 @@ func (w *WhipState) Connect(whipServer string) error {
 
 	log.Infof("offer: %v", offer.SDP)
 
-	resp, err := client.Post(whipServer, "application/sdp", bytes.NewBuffer([]byte(offer.SDP)))
+	req, err := w.newRequest(http.MethodPost, whipServer, bytes.NewBuffer([]byte(offer.SDP)))
+	if err != nil {
+		log.Errorf("http.NewRequest POST failed %v", err)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Errorf("whipCon POST offer/sdp failed %v", err)
 		return err
@@ -151,5 +175,92 @@ func (w *WhipState) Connect(whipServer string) error {
 	log.Infof("answer: %v", bodyString)
 	whipCon.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(bodyString)})
 
+	whipCon.OnConnectionStateChange = func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateFailed {
+			w.restartICE()
+		}
+	}
+
 	return nil
 }
+
+func (w *WhipState) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.Token)
+	}
+	return req, nil
+}
+
+// restartICE keeps restarting ICE on the WHIP resource, with backoff, until
+// one restart round trip succeeds, e.g. after switching from Wi-Fi to LTE
+func (w *WhipState) restartICE() {
+	w.lock.Lock()
+	if w.restarting || w.closed {
+		w.lock.Unlock()
+		return
+	}
+	w.restarting = true
+	w.lock.Unlock()
+
+	defer func() {
+		w.lock.Lock()
+		w.restarting = false
+		w.lock.Unlock()
+	}()
+
+	backoff := time.Second
+	for {
+		err := w.patchICERestart()
+		if err == nil {
+			log.Infof("ice restarted on %v", w.resourceUrl)
+			return
+		}
+		log.Errorf("ice restart failed %v, retry in %v", err, backoff)
+		time.Sleep(backoff)
+
+		w.lock.Lock()
+		closed := w.closed
+		w.lock.Unlock()
+		if closed {
+			return
+		}
+		if backoff *= 2; backoff > maxICERestartBackoff {
+			backoff = maxICERestartBackoff
+		}
+	}
+}
+
+func (w *WhipState) patchICERestart() error {
+	frag, err := w.whipCon.RestartICE()
+	if err != nil {
+		return err
+	}
+
+	req, err := w.newRequest(http.MethodPatch, w.resourceUrl, strings.NewReader(frag.Marshal()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", whip.MimeTypeSDPFragment)
+	req.Header.Set("If-Match", "*")
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v: %v", resp.Status, string(body))
+	}
+
+	answer, err := whip.ParseSDPFragment(string(body))
+	if err != nil {
+		return err
+	}
+	return w.whipCon.CompleteICERestart(answer)
+}
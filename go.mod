@@ -4,13 +4,18 @@ go 1.19
 
 require (
 	github.com/gorilla/mux v1.8.0
+	github.com/livekit/protocol v1.4.2
 	github.com/livekit/server-sdk-go v1.0.8
 	github.com/pion/interceptor v0.1.12
 	github.com/pion/ion-log v1.2.2
 	github.com/pion/mediadevices v0.4.0
 	github.com/pion/rtcp v1.2.10
+	github.com/pion/rtp v1.7.13
+	github.com/pion/sdp/v3 v3.0.6
 	github.com/pion/webrtc/v3 v3.1.58
+	github.com/prometheus/client_golang v1.14.0
 	github.com/spf13/viper v1.15.0
+	gopkg.in/square/go-jose.v2 v2.6.0
 )
 
 require (
@@ -33,7 +38,6 @@ require (
 	github.com/jxskiss/base62 v1.1.0 // indirect
 	github.com/lithammer/shortuuid/v4 v4.0.0 // indirect
 	github.com/livekit/mediatransportutil v0.0.0-20230130133657-96cfb115473a // indirect
-	github.com/livekit/protocol v1.4.2 // indirect
 	github.com/mackerelio/go-osstat v0.2.3 // indirect
 	github.com/magefile/mage v1.14.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
@@ -49,15 +53,12 @@ require (
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtp v1.7.13 // indirect
 	github.com/pion/sctp v1.8.6 // indirect
-	github.com/pion/sdp/v3 v3.0.6 // indirect
 	github.com/pion/srtp/v2 v2.0.12 // indirect
 	github.com/pion/stun v0.4.0 // indirect
 	github.com/pion/transport/v2 v2.0.2 // indirect
 	github.com/pion/turn/v2 v2.1.0 // indirect
 	github.com/pion/udp/v2 v2.0.1 // indirect
-	github.com/prometheus/client_golang v1.14.0 // indirect
 	github.com/prometheus/client_model v0.3.0 // indirect
 	github.com/prometheus/common v0.37.0 // indirect
 	github.com/prometheus/procfs v0.8.0 // indirect
@@ -83,6 +84,5 @@ require (
 	google.golang.org/grpc v1.53.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
-	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
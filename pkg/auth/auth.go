@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	lkauth "github.com/livekit/protocol/auth"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	// ErrUnauthorized is returned for a missing or invalid bearer token
+	ErrUnauthorized = errors.New("missing or invalid bearer token")
+	// ErrForbidden is returned when the token does not grant the request
+	ErrForbidden = errors.New("token does not grant access to this stream")
+)
+
+// StreamGrant narrows a LiveKit token down to a single WHIP/WHEP stream, or
+// widens it to every room with AnyRoom
+type StreamGrant struct {
+	Stream  string `json:"stream,omitempty"`
+	AnyRoom bool   `json:"anyRoom,omitempty"`
+}
+
+// Claims are the grants of a verified bearer token
+type Claims struct {
+	lkauth.ClaimGrants
+	WHIP *StreamGrant `json:"whip,omitempty"`
+}
+
+// Verify checks the "Authorization: Bearer" header value against the LiveKit
+// api key and secret. Tokens are regular LiveKit access tokens, optionally
+// carrying a "whip" claim that limits them to one stream.
+func Verify(header, apiKey, apiSecret string) (*Claims, error) {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, ErrUnauthorized
+	}
+	raw := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+	verifier, err := lkauth.ParseAPIToken(raw)
+	if err != nil || verifier.APIKey() != apiKey {
+		return nil, ErrUnauthorized
+	}
+
+	grants, err := verifier.Verify(apiSecret)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	claims := &Claims{ClaimGrants: *grants}
+
+	// the signature was checked above, only the whip claim is left to read
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	if err = tok.UnsafeClaimsWithoutVerification(claims); err != nil {
+		return nil, ErrUnauthorized
+	}
+	claims.Identity = grants.Identity
+	return claims, nil
+}
+
+// Allows reports whether the claims grant publishing (or subscribing to)
+// stream in room. Like LiveKit it needs roomJoin and the room of the grant,
+// any room only with the whip anyRoom claim. An empty stream grant matches any.
+func (c *Claims) Allows(room, stream string, publish bool) bool {
+	video := c.Video
+	if video == nil || !video.RoomJoin {
+		return false
+	}
+	anyRoom := c.WHIP != nil && c.WHIP.AnyRoom
+	if video.Room != room && !anyRoom {
+		return false
+	}
+	if c.WHIP != nil && c.WHIP.Stream != "" && c.WHIP.Stream != stream {
+		return false
+	}
+	if publish {
+		return video.CanPublish == nil || *video.CanPublish
+	}
+	return video.CanSubscribe == nil || *video.CanSubscribe
+}
+
+// AllowsAdmin reports whether the claims grant administering room, which
+// needs the roomAdmin grant. An empty room grant matches any room, an empty
+// room asks for all of them.
+func (c *Claims) AllowsAdmin(room string) bool {
+	video := c.Video
+	if video == nil || !video.RoomAdmin {
+		return false
+	}
+	return video.Room == "" || video.Room == room
+}
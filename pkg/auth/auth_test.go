@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	lkauth "github.com/livekit/protocol/auth"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testKey    = "APIkey"
+	testSecret = "secret-of-at-least-32-characters!"
+)
+
+// token signs a LiveKit access token with the video grant and, when stream is
+// set, the whip stream claim
+func token(t *testing.T, key, secret string, video *lkauth.VideoGrant, stream string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte(secret)}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{"video": video}
+	if stream != "" {
+		claims["whip"] = StreamGrant{Stream: stream}
+	}
+	raw, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:    key,
+		Subject:   "publisher",
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		Expiry:    jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestVerify(t *testing.T) {
+	video := &lkauth.VideoGrant{Room: "live"}
+
+	tests := []struct {
+		name   string
+		header string
+		err    error
+		stream string
+	}{
+		{name: "valid", header: "Bearer " + token(t, testKey, testSecret, video, "")},
+		{name: "stream claim", header: "Bearer " + token(t, testKey, testSecret, video, "cam1"), stream: "cam1"},
+		{name: "missing", header: "", err: ErrUnauthorized},
+		{name: "not bearer", header: "Basic " + token(t, testKey, testSecret, video, ""), err: ErrUnauthorized},
+		{name: "malformed", header: "Bearer abc", err: ErrUnauthorized},
+		{name: "other key", header: "Bearer " + token(t, "other", testSecret, video, ""), err: ErrUnauthorized},
+		{name: "other secret", header: "Bearer " + token(t, testKey, "another-secret-of-32-characters!!", video, ""), err: ErrUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := Verify(test.header, testKey, testSecret)
+			if err != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if claims.Identity != "publisher" || claims.Video == nil || claims.Video.Room != "live" {
+				t.Fatalf("claims %+v", claims)
+			}
+			stream := ""
+			if claims.WHIP != nil {
+				stream = claims.WHIP.Stream
+			}
+			if stream != test.stream {
+				t.Fatalf("stream %q, want %q", stream, test.stream)
+			}
+		})
+	}
+}
+
+// grant makes the claims of a token with the video grant and whip claim
+func grant(video *lkauth.VideoGrant, whip *StreamGrant) Claims {
+	return Claims{ClaimGrants: lkauth.ClaimGrants{Video: video}, WHIP: whip}
+}
+
+func TestClaimsAllows(t *testing.T) {
+	no := false
+
+	tests := []struct {
+		name    string
+		claims  Claims
+		room    string
+		stream  string
+		publish bool
+		want    bool
+	}{
+		{name: "no video grant", room: "live", want: false},
+		{name: "same room", claims: grant(&lkauth.VideoGrant{RoomJoin: true, Room: "live"}, nil), room: "live", want: true},
+		{name: "other room", claims: grant(&lkauth.VideoGrant{RoomJoin: true, Room: "live"}, nil), room: "other", want: false},
+		{name: "no room join", claims: grant(&lkauth.VideoGrant{Room: "live"}, nil), room: "live", want: false},
+		{name: "empty room grant", claims: grant(&lkauth.VideoGrant{RoomJoin: true}, nil), room: "live", publish: true, want: false},
+		{name: "any room claim", claims: grant(&lkauth.VideoGrant{RoomJoin: true}, &StreamGrant{AnyRoom: true}), room: "live", publish: true, want: true},
+		{name: "any room claim without room join", claims: grant(&lkauth.VideoGrant{}, &StreamGrant{AnyRoom: true}), room: "live", want: false},
+		{name: "same stream", claims: grant(&lkauth.VideoGrant{RoomJoin: true, Room: "live"}, &StreamGrant{Stream: "cam1"}), room: "live", stream: "cam1", want: true},
+		{name: "other stream", claims: grant(&lkauth.VideoGrant{RoomJoin: true, Room: "live"}, &StreamGrant{Stream: "cam1"}), room: "live", stream: "cam2", want: false},
+		{name: "publish denied", claims: grant(&lkauth.VideoGrant{RoomJoin: true, Room: "live", CanPublish: &no}, nil), room: "live", publish: true, want: false},
+		{name: "subscribe without publish", claims: grant(&lkauth.VideoGrant{RoomJoin: true, Room: "live", CanPublish: &no}, nil), room: "live", want: true},
+		{name: "subscribe denied", claims: grant(&lkauth.VideoGrant{RoomJoin: true, Room: "live", CanSubscribe: &no}, nil), room: "live", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.claims.Allows(test.room, test.stream, test.publish); got != test.want {
+				t.Fatalf("Allows(%q, %q, %v) = %v, want %v", test.room, test.stream, test.publish, got, test.want)
+			}
+		})
+	}
+}
+
+func TestClaimsAllowsAdmin(t *testing.T) {
+	tests := []struct {
+		name  string
+		video *lkauth.VideoGrant
+		room  string
+		want  bool
+	}{
+		{name: "no video grant", room: "live", want: false},
+		{name: "no room admin", video: &lkauth.VideoGrant{}, room: "live", want: false},
+		{name: "any room", video: &lkauth.VideoGrant{RoomAdmin: true}, room: "live", want: true},
+		{name: "all rooms", video: &lkauth.VideoGrant{RoomAdmin: true}, want: true},
+		{name: "same room", video: &lkauth.VideoGrant{RoomAdmin: true, Room: "live"}, room: "live", want: true},
+		{name: "other room", video: &lkauth.VideoGrant{RoomAdmin: true, Room: "live"}, room: "other", want: false},
+		{name: "all rooms with a room grant", video: &lkauth.VideoGrant{RoomAdmin: true, Room: "live"}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := &Claims{ClaimGrants: lkauth.ClaimGrants{Video: test.video}}
+			if got := claims.AllowsAdmin(test.room); got != test.want {
+				t.Fatalf("AllowsAdmin(%q) = %v, want %v", test.room, got, test.want)
+			}
+		})
+	}
+}
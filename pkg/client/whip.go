@@ -3,6 +3,7 @@ package client
 import (
 	"net"
 
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
 	"github.com/pion/interceptor"
 	log "github.com/pion/ion-log"
 	"github.com/pion/rtcp"
@@ -34,8 +35,9 @@ func init() {
 }
 
 type WHIPConn struct {
-	pc      *webrtc.PeerConnection
-	OnTrack func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)
+	pc                      *webrtc.PeerConnection
+	OnTrack                 func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)
+	OnConnectionStateChange func(s webrtc.PeerConnectionState)
 }
 
 func NewWHIPConn() (*WHIPConn, error) {
@@ -117,6 +119,9 @@ func NewWHIPConn() (*WHIPConn, error) {
 
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
 		log.Infof("Peer Connection State has changed: %s\n", s.String())
+		if whip.OnConnectionStateChange != nil {
+			go whip.OnConnectionStateChange(s)
+		}
 	})
 
 	return whip, nil
@@ -199,6 +204,55 @@ func (w *WHIPConn) AddICECandidate(candidate webrtc.ICECandidateInit) error {
 	return w.pc.AddICECandidate(candidate)
 }
 
+// RestartICE creates an ICE restart offer and returns the sdpfrag to PATCH
+// to the WHIP resource
+func (w *WHIPConn) RestartICE() (*whip.SDPFragment, error) {
+	offer, err := w.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		log.Infof("CreateOffer err %v ", err)
+		return nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(w.pc)
+
+	if err = w.pc.SetLocalDescription(offer); err != nil {
+		log.Infof("SetLocalDescription err %v ", err)
+		return nil, err
+	}
+
+	<-gatherComplete
+
+	return whip.SDPFragmentFromDescription(w.pc.LocalDescription())
+}
+
+// CompleteICERestart applies the sdpfrag the WHIP resource answered to an ICE restart
+func (w *WHIPConn) CompleteICERestart(frag *whip.SDPFragment) error {
+	remote := w.pc.RemoteDescription()
+	if remote == nil {
+		return webrtc.ErrNoRemoteDescription
+	}
+
+	answer, err := whip.ReplaceICECredentials(remote, frag.ICEUfrag, frag.ICEPwd)
+	if err != nil {
+		return err
+	}
+
+	if err = w.pc.SetRemoteDescription(*answer); err != nil {
+		log.Infof("SetRemoteDescription err %v ", err)
+		return err
+	}
+
+	for _, m := range frag.Media {
+		mid := m.Mid
+		for _, c := range m.Candidates {
+			if err = w.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: c, SDPMid: &mid}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (w *WHIPConn) Close() {
 	if w.pc != nil && w.pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
 		if cErr := w.pc.Close(); cErr != nil {
@@ -0,0 +1,229 @@
+package fmp4
+
+import (
+	"errors"
+)
+
+var errShortHeader = errors.New("fmp4: header too short")
+
+// bitReader reads the bits of a codec header, most significant first
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errShortHeader
+	}
+	v := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint32(v), nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// ue reads an unsigned exp-Golomb code
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		if zeros++; zeros > 31 {
+			return 0, errors.New("fmp4: invalid exp-Golomb code")
+		}
+	}
+	v, err := r.bits(zeros)
+	return 1<<zeros - 1 + v, err
+}
+
+// se reads a signed exp-Golomb code
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1), err
+	}
+	return -int32(v / 2), err
+}
+
+// H264Dimensions returns the picture size of an H264 SPS NAL unit
+func H264Dimensions(sps []byte) (width, height uint16, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errShortHeader
+	}
+	// drop the emulation prevention bytes
+	rbsp := make([]byte, 0, len(sps))
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	r := &bitReader{data: rbsp}
+
+	profile, _ := r.bits(8)
+	r.bits(16) // constraint flags and level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	separateColourPlane := uint32(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat, _ = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane, _ = r.bit()
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if present, _ := r.bit(); present == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if listPresent, _ := r.bit(); listPresent == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					last, next := int32(8), int32(8)
+					for j := 0; j < size; j++ {
+						if next != 0 {
+							delta, _ := r.se()
+							next = (last + delta + 256) % 256
+						}
+						if next != 0 {
+							last = next
+						}
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	pocType, _ := r.ue()
+	switch pocType {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		cycle, _ := r.ue()
+		for i := uint32(0); i < cycle; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs, _ := r.ue()
+	heightMapUnits, _ := r.ue()
+	frameMbsOnly, _ := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if cropping, _ := r.bit(); cropping == 1 {
+		cropLeft, _ = r.ue()
+		cropRight, _ = r.ue()
+		cropTop, _ = r.ue()
+		cropBottom, _ = r.ue()
+	}
+	if _, err := r.bit(); err != nil {
+		// the vui flag follows, a reader that ran out did not get this far
+		return 0, 0, err
+	}
+
+	cropX, cropY := uint32(1), 2-frameMbsOnly
+	if chromaFormat != 0 && separateColourPlane == 0 {
+		if chromaFormat != 3 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+	}
+	w := (widthMbs+1)*16 - (cropLeft+cropRight)*cropX
+	h := (2-frameMbsOnly)*(heightMapUnits+1)*16 - (cropTop+cropBottom)*cropY
+	return uint16(w), uint16(h), nil
+}
+
+// VP8Keyframe parses the header of a VP8 frame. ok is false unless it is a
+// keyframe.
+func VP8Keyframe(frame []byte) (width, height uint16, ok bool) {
+	if len(frame) < 10 || frame[0]&1 != 0 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	width = (uint16(frame[7])<<8 | uint16(frame[6])) & 0x3fff
+	height = (uint16(frame[9])<<8 | uint16(frame[8])) & 0x3fff
+	return width, height, true
+}
+
+// VP9Keyframe parses the uncompressed header of a VP9 frame. ok is false
+// unless it is a keyframe.
+func VP9Keyframe(frame []byte) (width, height uint16, profile, bitDepth uint8, ok bool) {
+	r := &bitReader{data: frame}
+	if marker, err := r.bits(2); err != nil || marker != 2 {
+		return 0, 0, 0, 0, false
+	}
+	low, _ := r.bit()
+	high, _ := r.bit()
+	profile = uint8(high<<1 | low)
+	if profile == 3 {
+		r.bit() // reserved_zero
+	}
+	if showExisting, _ := r.bit(); showExisting == 1 {
+		return 0, 0, 0, 0, false
+	}
+	if frameType, _ := r.bit(); frameType != 0 {
+		return 0, 0, 0, 0, false
+	}
+	r.bits(2) // show_frame, error_resilient_mode
+	if sync, _ := r.bits(24); sync != 0x498342 {
+		return 0, 0, 0, 0, false
+	}
+
+	bitDepth = 8
+	if profile >= 2 {
+		if twelve, _ := r.bit(); twelve == 1 {
+			bitDepth = 12
+		} else {
+			bitDepth = 10
+		}
+	}
+	if colorSpace, _ := r.bits(3); colorSpace != 7 {
+		r.bit() // color_range
+		if profile == 1 || profile == 3 {
+			r.bits(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.bit() // reserved_zero
+	}
+
+	w, _ := r.bits(16)
+	h, err := r.bits(16)
+	if err != nil {
+		return 0, 0, 0, 0, false
+	}
+	return uint16(w + 1), uint16(h + 1), profile, bitDepth, true
+}
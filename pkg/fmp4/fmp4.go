@@ -0,0 +1,286 @@
+// Package fmp4 writes fragmented MP4 (ISO BMFF) files: an init segment with
+// the track descriptions followed by movie fragments. It supports H264, VP8
+// and VP9 video and Opus audio.
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Codec is the codec of a track
+type Codec int
+
+const (
+	CodecH264 Codec = iota
+	CodecVP8
+	CodecVP9
+	CodecOpus
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecH264:
+		return "H264"
+	case CodecVP8:
+		return "VP8"
+	case CodecVP9:
+		return "VP9"
+	case CodecOpus:
+		return "Opus"
+	}
+	return fmt.Sprintf("Codec(%d)", int(c))
+}
+
+// IsVideo tells whether c is a video codec
+func (c Codec) IsVideo() bool {
+	return c != CodecOpus
+}
+
+// Track describes a track of the file
+type Track struct {
+	ID        uint32
+	Codec     Codec
+	TimeScale uint32
+
+	// Width and Height are the video dimensions in pixels
+	Width  uint16
+	Height uint16
+	// SPS and PPS are the H264 parameter sets, without start codes
+	SPS []byte
+	PPS []byte
+	// Profile is the VP8 or VP9 profile
+	Profile uint8
+	// BitDepth is the VP9 bit depth, 8 when zero
+	BitDepth uint8
+
+	// Channels is the Opus channel count
+	Channels uint16
+}
+
+// Sample is a frame of video or a packet of audio. H264 samples hold
+// length-prefixed NAL units.
+type Sample struct {
+	Duration uint32
+	Keyframe bool
+	Data     []byte
+}
+
+// Fragment holds the samples of a track in a movie fragment, starting at
+// BaseTime in the units of the track's TimeScale
+type Fragment struct {
+	Track    *Track
+	BaseTime uint64
+	Samples  []Sample
+}
+
+const (
+	sampleFlagsSync    = 0x02000000 // depends on no other sample
+	sampleFlagsNonSync = 0x01010000 // depends on others, not a sync sample
+
+	trunDataOffset     = 0x000001
+	trunSampleDuration = 0x000100
+	trunSampleSize     = 0x000200
+	trunSampleFlags    = 0x000400
+
+	tfhdDefaultBaseIsMoof = 0x020000
+)
+
+// Init returns the init segment, the ftyp and moov boxes, of tracks
+func Init(tracks []*Track) ([]byte, error) {
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41"))
+
+	var nextID uint32
+	traks := make([][]byte, 0, len(tracks))
+	trexs := make([][]byte, 0, len(tracks))
+	for _, t := range tracks {
+		trak, err := t.trak()
+		if err != nil {
+			return nil, err
+		}
+		traks = append(traks, trak)
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(t.ID), u32(1), u32(0), u32(0), u32(0)))
+		if t.ID >= nextID {
+			nextID = t.ID + 1
+		}
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation and modification time
+		u32(1000), u32(0), // timescale and duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		matrix(), make([]byte, 24), u32(nextID))
+
+	moov := box("moov", append(append([][]byte{mvhd}, traks...), box("mvex", trexs...))...)
+	return append(ftyp, moov...), nil
+}
+
+func (t *Track) trak() ([]byte, error) {
+	entry, err := t.sampleEntry()
+	if err != nil {
+		return nil, err
+	}
+
+	var volume uint16
+	var width, height uint32
+	handler, name := "vide", "VideoHandler"
+	mediaHeader := fullBox("vmhd", 0, 1, make([]byte, 8))
+	if !t.Codec.IsVideo() {
+		volume = 0x0100
+		handler, name = "soun", "SoundHandler"
+		mediaHeader = fullBox("smhd", 0, 0, make([]byte, 4))
+	} else {
+		width, height = uint32(t.Width)<<16, uint32(t.Height)<<16
+	}
+
+	tkhd := fullBox("tkhd", 0, 3, // enabled and in movie
+		u32(0), u32(0), u32(t.ID), u32(0), u32(0), // times, track id, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0), // reserved, layer, group, volume, reserved
+		matrix(), u32(width), u32(height))
+
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.TimeScale), u32(0), u16(0x55c4), u16(0)) // language "und"
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), append([]byte(name), 0))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), entry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)))
+
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl))), nil
+}
+
+func (t *Track) sampleEntry() ([]byte, error) {
+	switch t.Codec {
+	case CodecH264:
+		if len(t.SPS) < 4 || len(t.PPS) == 0 {
+			return nil, fmt.Errorf("fmp4: H264 track %d has no SPS and PPS", t.ID)
+		}
+		avcC := box("avcC", []byte{1, t.SPS[1], t.SPS[2], t.SPS[3], 0xff, 0xe1},
+			u16(uint16(len(t.SPS))), t.SPS, []byte{1}, u16(uint16(len(t.PPS))), t.PPS)
+		return t.visualSampleEntry("avc1", avcC), nil
+	case CodecVP8, CodecVP9:
+		bitDepth := t.BitDepth
+		if bitDepth == 0 {
+			bitDepth = 8
+		}
+		// 4:2:0 colocated with luma, limited range, BT.709
+		vpcC := fullBox("vpcC", 1, 0, []byte{t.Profile, 0, bitDepth<<4 | 1<<1, 1, 1, 1}, u16(0))
+		typ := "vp09"
+		if t.Codec == CodecVP8 {
+			typ = "vp08"
+		}
+		return t.visualSampleEntry(typ, vpcC), nil
+	case CodecOpus:
+		channels := t.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		dOps := box("dOps", []byte{0, byte(channels)}, u16(312), u32(48000), u16(0), []byte{0})
+		return box("Opus", make([]byte, 6), u16(1), // reserved, data reference index
+			make([]byte, 8), u16(channels), u16(16), u16(0), u16(0), u32(48000<<16), dOps), nil
+	}
+	return nil, fmt.Errorf("fmp4: unsupported codec %v", t.Codec)
+}
+
+func (t *Track) visualSampleEntry(typ string, config []byte) []byte {
+	return box(typ, make([]byte, 6), u16(1), // reserved, data reference index
+		make([]byte, 16), u16(t.Width), u16(t.Height),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1), // 72 dpi, reserved, frame count
+		make([]byte, 32), u16(0x0018), u16(0xffff), config)
+}
+
+// MediaSegment returns a movie fragment, the moof and mdat boxes, with the
+// samples of fragments. seq numbers the fragments of a file from 1.
+func MediaSegment(seq uint32, fragments []Fragment) []byte {
+	// the data offsets do not change the size of the moof, it is built once
+	// to learn it and once with the offsets
+	moof := buildMoof(seq, fragments, 0)
+	moof = buildMoof(seq, fragments, uint32(len(moof))+8)
+
+	size := 8
+	for _, f := range fragments {
+		for _, s := range f.Samples {
+			size += len(s.Data)
+		}
+	}
+	out := make([]byte, 0, len(moof)+size)
+	out = append(out, moof...)
+	out = append(out, u32(uint32(size))...)
+	out = append(out, "mdat"...)
+	for _, f := range fragments {
+		for _, s := range f.Samples {
+			out = append(out, s.Data...)
+		}
+	}
+	return out
+}
+
+func buildMoof(seq uint32, fragments []Fragment, dataOffset uint32) []byte {
+	trafs := [][]byte{fullBox("mfhd", 0, 0, u32(seq))}
+	for _, f := range fragments {
+		entries := make([]byte, 0, 12*len(f.Samples))
+		var size uint32
+		for _, s := range f.Samples {
+			flags := uint32(sampleFlagsNonSync)
+			if s.Keyframe || !f.Track.Codec.IsVideo() {
+				flags = sampleFlagsSync
+			}
+			entries = append(entries, u32(s.Duration)...)
+			entries = append(entries, u32(uint32(len(s.Data)))...)
+			entries = append(entries, u32(flags)...)
+			size += uint32(len(s.Data))
+		}
+		trafs = append(trafs, box("traf",
+			fullBox("tfhd", 0, tfhdDefaultBaseIsMoof, u32(f.Track.ID)),
+			fullBox("tfdt", 1, 0, u64(f.BaseTime)),
+			fullBox("trun", 0, trunDataOffset|trunSampleDuration|trunSampleSize|trunSampleFlags,
+				u32(uint32(len(f.Samples))), u32(dataOffset), entries)))
+		dataOffset += size
+	}
+	return box("moof", trafs...)
+}
+
+func box(typ string, content ...[]byte) []byte {
+	size := 8
+	for _, c := range content {
+		size += len(c)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], typ)
+	for _, c := range content {
+		out = append(out, c...)
+	}
+	return out
+}
+
+func fullBox(typ string, version uint8, flags uint32, content ...[]byte) []byte {
+	head := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{head}, content...)...)
+}
+
+func matrix() []byte {
+	out := make([]byte, 0, 36)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		out = append(out, u32(v)...)
+	}
+	return out
+}
+
+func u16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func u32(v uint32) []byte {
+	out := make([]byte, 4)
+	binary.BigEndian.PutUint32(out, v)
+	return out
+}
+
+func u64(v uint64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, v)
+	return out
+}
@@ -0,0 +1,176 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// boxes splits b into its boxes, by type in order
+func boxes(t *testing.T, b []byte) ([]string, map[string][]byte) {
+	var types []string
+	contents := make(map[string][]byte)
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated box header %x", b)
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("box %q size %d, %d bytes left", b[4:8], size, len(b))
+		}
+		typ := string(b[4:8])
+		types = append(types, typ)
+		contents[typ] = b[8:size]
+		b = b[size:]
+	}
+	return types, contents
+}
+
+// child returns the content of the box at path below b, the full box header
+// included
+func child(t *testing.T, b []byte, path ...string) []byte {
+	for _, typ := range path {
+		_, contents := boxes(t, b)
+		var ok bool
+		if b, ok = contents[typ]; !ok {
+			t.Fatalf("no %q box in %v", typ, path)
+		}
+	}
+	return b
+}
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x47, 0xfe, 0xc8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name  string
+		track *Track
+		entry string
+	}{
+		{name: "h264", track: &Track{ID: 1, Codec: CodecH264, TimeScale: 90000, Width: 640, Height: 480, SPS: testSPS, PPS: testPPS}, entry: "avc1"},
+		{name: "vp8", track: &Track{ID: 1, Codec: CodecVP8, TimeScale: 90000, Width: 640, Height: 480}, entry: "vp08"},
+		{name: "vp9", track: &Track{ID: 1, Codec: CodecVP9, TimeScale: 90000, Width: 640, Height: 480}, entry: "vp09"},
+		{name: "opus", track: &Track{ID: 2, Codec: CodecOpus, TimeScale: 48000, Channels: 2}, entry: "Opus"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			init, err := Init([]*Track{test.track})
+			if err != nil {
+				t.Fatal(err)
+			}
+			types, _ := boxes(t, init)
+			if !reflect.DeepEqual(types, []string{"ftyp", "moov"}) {
+				t.Fatalf("boxes %v, want ftyp and moov", types)
+			}
+
+			tkhd := child(t, init, "moov", "trak", "tkhd")
+			if id := binary.BigEndian.Uint32(tkhd[12:]); id != test.track.ID {
+				t.Fatalf("track id %d, want %d", id, test.track.ID)
+			}
+			mdhd := child(t, init, "moov", "trak", "mdia", "mdhd")
+			if scale := binary.BigEndian.Uint32(mdhd[12:]); scale != test.track.TimeScale {
+				t.Fatalf("timescale %d, want %d", scale, test.track.TimeScale)
+			}
+			stsd := child(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+			if entry := string(stsd[12:16]); entry != test.entry {
+				t.Fatalf("sample entry %q, want %q", entry, test.entry)
+			}
+			trex := child(t, init, "moov", "mvex", "trex")
+			if id := binary.BigEndian.Uint32(trex[4:]); id != test.track.ID {
+				t.Fatalf("trex track id %d, want %d", id, test.track.ID)
+			}
+			mvhd := child(t, init, "moov", "mvhd")
+			if next := binary.BigEndian.Uint32(mvhd[len(mvhd)-4:]); next != test.track.ID+1 {
+				t.Fatalf("next track id %d, want %d", next, test.track.ID+1)
+			}
+		})
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	for _, track := range []*Track{
+		{ID: 1, Codec: CodecH264, TimeScale: 90000},
+		{ID: 1, Codec: Codec(9), TimeScale: 90000},
+	} {
+		if _, err := Init([]*Track{track}); err == nil {
+			t.Fatalf("no error for %v track without its configuration", track.Codec)
+		}
+	}
+}
+
+func TestMediaSegment(t *testing.T) {
+	video := &Track{ID: 1, Codec: CodecH264, TimeScale: 90000}
+	audio := &Track{ID: 2, Codec: CodecOpus, TimeScale: 48000}
+	segment := MediaSegment(7, []Fragment{
+		{Track: video, BaseTime: 90000, Samples: []Sample{
+			{Duration: 3000, Keyframe: true, Data: []byte{1, 1, 1}},
+			{Duration: 3000, Data: []byte{2, 2}},
+		}},
+		{Track: audio, BaseTime: 48000, Samples: []Sample{
+			{Duration: 960, Data: []byte{3, 3, 3, 3}},
+		}},
+	})
+
+	types, contents := boxes(t, segment)
+	if !reflect.DeepEqual(types, []string{"moof", "mdat"}) {
+		t.Fatalf("boxes %v, want moof and mdat", types)
+	}
+	if mdat := contents["mdat"]; !bytes.Equal(mdat, []byte{1, 1, 1, 2, 2, 3, 3, 3, 3}) {
+		t.Fatalf("mdat %x", mdat)
+	}
+	if seq := binary.BigEndian.Uint32(child(t, segment, "moof", "mfhd")[4:]); seq != 7 {
+		t.Fatalf("sequence number %d, want 7", seq)
+	}
+
+	// the trafs share a type, walk them in order
+	moof := child(t, segment, "moof")
+	var trafs [][]byte
+	for len(moof) > 0 {
+		size := binary.BigEndian.Uint32(moof)
+		if string(moof[4:8]) == "traf" {
+			trafs = append(trafs, moof[8:size])
+		}
+		moof = moof[size:]
+	}
+	if len(trafs) != 2 {
+		t.Fatalf("%d trafs, want 2", len(trafs))
+	}
+
+	moofSize := len(segment) - len(contents["mdat"]) - 8
+	for i, want := range []struct {
+		id       uint32
+		baseTime uint64
+		flags    []uint32
+		offset   int
+	}{
+		{id: 1, baseTime: 90000, flags: []uint32{sampleFlagsSync, sampleFlagsNonSync}, offset: 0},
+		{id: 2, baseTime: 48000, flags: []uint32{sampleFlagsSync}, offset: 5},
+	} {
+		traf := trafs[i]
+		if id := binary.BigEndian.Uint32(child(t, traf, "tfhd")[4:]); id != want.id {
+			t.Fatalf("traf %d track id %d, want %d", i, id, want.id)
+		}
+		if base := binary.BigEndian.Uint64(child(t, traf, "tfdt")[4:]); base != want.baseTime {
+			t.Fatalf("traf %d base time %d, want %d", i, base, want.baseTime)
+		}
+		trun := child(t, traf, "trun")
+		count := int(binary.BigEndian.Uint32(trun[4:]))
+		if count != len(want.flags) {
+			t.Fatalf("traf %d has %d samples, want %d", i, count, len(want.flags))
+		}
+		// the data offset is relative to the moof, past the mdat header
+		if offset := int(binary.BigEndian.Uint32(trun[8:])); offset != moofSize+8+want.offset {
+			t.Fatalf("traf %d data offset %d, want %d", i, offset, moofSize+8+want.offset)
+		}
+		for j, flags := range want.flags {
+			if got := binary.BigEndian.Uint32(trun[12+12*j+8:]); got != flags {
+				t.Fatalf("traf %d sample %d flags %x, want %x", i, j, got, flags)
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// AMF0 markers
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+var errAMF = errors.New("rtmp: malformed amf0 value")
+
+// amfObj is an AMF0 object, or ECMA array. Objects are written with their
+// keys in order, as some encoders expect "level" and "code" first.
+type amfObj []amfProp
+
+type amfProp struct {
+	key   string
+	value interface{}
+}
+
+// amfDecode reads the AMF0 values of b. Numbers decode to float64, strings
+// to string, objects and ECMA arrays to map[string]interface{}, strict
+// arrays to []interface{} and null and undefined to nil.
+func amfDecode(b []byte) ([]interface{}, error) {
+	r := bytes.NewReader(b)
+	var values []interface{}
+	for r.Len() > 0 {
+		v, err := amfRead(r)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func amfRead(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, errAMF
+	}
+	switch marker {
+	case amfNumber:
+		var n uint64
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, errAMF
+		}
+		return math.Float64frombits(n), nil
+	case amfBoolean:
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errAMF
+		}
+		return b != 0, nil
+	case amfString:
+		return amfReadString(r, 2)
+	case amfLongString:
+		return amfReadString(r, 4)
+	case amfObject:
+		return amfReadProps(r)
+	case amfECMAArray:
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, errAMF
+		}
+		return amfReadProps(r)
+	case amfStrictArray:
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil || int(n) > r.Len() {
+			return nil, errAMF
+		}
+		list := make([]interface{}, 0, n)
+		for i := uint32(0); i < n; i++ {
+			v, err := amfRead(r)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case amfDate:
+		// milliseconds and a time zone, read as the milliseconds
+		var ms uint64
+		if err := binary.Read(r, binary.BigEndian, &ms); err != nil {
+			return nil, errAMF
+		}
+		if _, err := r.Seek(2, io.SeekCurrent); err != nil {
+			return nil, errAMF
+		}
+		return math.Float64frombits(ms), nil
+	case amfNull, amfUndefined:
+		return nil, nil
+	}
+	return nil, errAMF
+}
+
+func amfReadString(r *bytes.Reader, size int) (string, error) {
+	var n uint32
+	if size == 2 {
+		var n16 uint16
+		if err := binary.Read(r, binary.BigEndian, &n16); err != nil {
+			return "", errAMF
+		}
+		n = uint32(n16)
+	} else if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", errAMF
+	}
+	if int64(n) > int64(r.Len()) {
+		return "", errAMF
+	}
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	return string(b), nil
+}
+
+// amfReadProps reads object properties up to the object end marker
+func amfReadProps(r *bytes.Reader) (map[string]interface{}, error) {
+	props := make(map[string]interface{})
+	for {
+		key, err := amfReadString(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			// the object end marker follows the empty key
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, errAMF
+			}
+			if marker == amfObjectEnd {
+				return props, nil
+			}
+			r.UnreadByte()
+		}
+		v, err := amfRead(r)
+		if err != nil {
+			return nil, err
+		}
+		props[key] = v
+	}
+}
+
+// amfEncode writes values as AMF0. It supports float64, int, bool, string,
+// amfObj and nil.
+func amfEncode(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		amfWrite(&b, v)
+	}
+	return b.Bytes()
+}
+
+func amfWrite(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case float64:
+		b.WriteByte(amfNumber)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case int:
+		amfWrite(b, float64(v))
+	case bool:
+		b.WriteByte(amfBoolean)
+		if v {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		if len(v) > math.MaxUint16 {
+			b.WriteByte(amfLongString)
+			binary.Write(b, binary.BigEndian, uint32(len(v)))
+		} else {
+			b.WriteByte(amfString)
+			binary.Write(b, binary.BigEndian, uint16(len(v)))
+		}
+		b.WriteString(v)
+	case amfObj:
+		b.WriteByte(amfObject)
+		for _, p := range v {
+			binary.Write(b, binary.BigEndian, uint16(len(p.key)))
+			b.WriteString(p.key)
+			amfWrite(b, p.value)
+		}
+		b.Write([]byte{0, 0, amfObjectEnd})
+	default:
+		b.WriteByte(amfNull)
+	}
+}
@@ -0,0 +1,81 @@
+package rtmp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAMFDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []interface{}
+		err  bool
+	}{
+		{
+			name: "number",
+			data: []byte{amfNumber, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0},
+			want: []interface{}{1.0},
+		},
+		{
+			name: "boolean and null",
+			data: []byte{amfBoolean, 1, amfNull, amfUndefined},
+			want: []interface{}{true, nil, nil},
+		},
+		{
+			name: "strings",
+			data: []byte{amfString, 0, 2, 'h', 'i', amfLongString, 0, 0, 0, 1, 'x'},
+			want: []interface{}{"hi", "x"},
+		},
+		{
+			name: "object",
+			data: []byte{amfObject, 0, 3, 'a', 'p', 'p', amfString, 0, 4, 'l', 'i', 'v', 'e', 0, 0, amfObjectEnd},
+			want: []interface{}{map[string]interface{}{"app": "live"}},
+		},
+		{
+			name: "ecma array",
+			data: []byte{amfECMAArray, 0, 0, 0, 1, 0, 5, 'w', 'i', 'd', 't', 'h', amfNumber, 0x40, 0x84, 0, 0, 0, 0, 0, 0, 0, 0, amfObjectEnd},
+			want: []interface{}{map[string]interface{}{"width": 640.0}},
+		},
+		{
+			name: "strict array",
+			data: []byte{amfStrictArray, 0, 0, 0, 2, amfBoolean, 0, amfNull},
+			want: []interface{}{[]interface{}{false, nil}},
+		},
+		{name: "truncated number", data: []byte{amfNumber, 0x3f}, err: true},
+		{name: "string past the end", data: []byte{amfString, 0, 9, 'a'}, err: true},
+		{name: "unterminated object", data: []byte{amfObject, 0, 1, 'a', amfNull}, err: true},
+		{name: "strict array longer than the data", data: []byte{amfStrictArray, 0xff, 0xff, 0xff, 0xff}, err: true},
+		{name: "unknown marker", data: []byte{0x7f}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := amfDecode(test.data)
+			if (err != nil) != test.err {
+				t.Fatalf("error %v, want an error: %v", err, test.err)
+			}
+			if !test.err && !reflect.DeepEqual(values, test.want) {
+				t.Fatalf("values %#v, want %#v", values, test.want)
+			}
+		})
+	}
+}
+
+func TestAMFEncode(t *testing.T) {
+	values := []interface{}{"_result", 1, true, nil, amfObj{{"level", "status"}, {"code", "NetStream.Publish.Start"}}}
+	decoded, err := amfDecode(amfEncode(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"_result", 1.0, true, nil, map[string]interface{}{"level": "status", "code": "NetStream.Publish.Start"}}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Fatalf("decoded %#v, want %#v", decoded, want)
+	}
+
+	// clients read the status keys in order
+	obj := amfEncode(amfObj{{"level", "status"}, {"code", "x"}})
+	if want := []byte{amfObject, 0, 5, 'l', 'e', 'v', 'e', 'l'}; !reflect.DeepEqual(obj[:len(want)], want) {
+		t.Fatalf("object starts with %x, want %x", obj[:len(want)], want)
+	}
+}
@@ -0,0 +1,486 @@
+// Package rtmp is a minimal RTMP server connection. It accepts one publisher
+// per connection, as hardware and software encoders push it, and hands out
+// the FLV audio, video and data messages of the stream. Only the plain
+// handshake is supported, which encoders use; the digest handshake of Flash
+// players is not.
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Message types
+const (
+	TypeSetChunkSize     = 1
+	TypeAbort            = 2
+	TypeAck              = 3
+	TypeUserControl      = 4
+	TypeWindowAckSize    = 5
+	TypeSetPeerBandwidth = 6
+	TypeAudio            = 8
+	TypeVideo            = 9
+	TypeDataAMF3         = 15
+	TypeCommandAMF3      = 17
+	TypeData             = 18
+	TypeCommand          = 20
+)
+
+const (
+	handshakeSize = 1536
+	// defaultChunkSize is the chunk size until a peer sets its own
+	defaultChunkSize = 128
+	// outChunkSize is the chunk size of the messages sent to the peer
+	outChunkSize = 4096
+	// windowAckSize is the window announced to the peer
+	windowAckSize = 2500000
+	// maxMessageSize bounds the messages a peer can make the server buffer
+	maxMessageSize = 16 << 20
+	// maxChunkStreams bounds the chunk streams of a peer, encoders use a few
+	maxChunkStreams = 64
+	// maxBuffered bounds the bytes of the partly read messages of a peer
+	// over all its chunk streams
+	maxBuffered = 2 * maxMessageSize
+
+	// chunk streams of the messages sent to the peer
+	csidControl = 2
+	csidCommand = 3
+	csidStatus  = 5
+
+	// publishStreamID is the message stream that createStream hands out
+	publishStreamID = 1
+)
+
+var (
+	errBadChunk   = errors.New("rtmp: malformed chunk")
+	errChunkLimit = errors.New("rtmp: too many chunk streams or buffered bytes")
+	errNotPublish = errors.New("rtmp: client does not publish")
+)
+
+// Message is a complete RTMP message
+type Message struct {
+	Type uint8
+	// Timestamp is the absolute timestamp in milliseconds
+	Timestamp uint32
+	StreamID  uint32
+	Payload   []byte
+}
+
+// chunkStream is the header state of a chunk stream of the peer
+type chunkStream struct {
+	timestamp uint32
+	// delta is the last timestamp field, reused by headers without one
+	delta    uint32
+	length   uint32
+	typ      uint8
+	streamID uint32
+	extended bool
+	// buf holds the payload of the message being read
+	buf []byte
+}
+
+// Conn is an RTMP connection of a publisher
+type Conn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+
+	chunkSize uint32
+	chunks    map[uint32]*chunkStream
+	// buffered is the size of the messages being read over all chunk streams
+	buffered uint32
+	// outChunk is the chunk size of the messages sent, outChunkSize once
+	// announced
+	outChunk int
+	// received counts the bytes read, an acknowledgement is sent every ack
+	// bytes
+	received uint32
+	acked    uint32
+	ack      uint32
+
+	app   string
+	tcURL string
+	name  string
+}
+
+// countingReader counts the bytes read for the acknowledgements
+type countingReader struct {
+	r io.Reader
+	c *Conn
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.c.received += uint32(n)
+	return n, err
+}
+
+// Accept runs the handshake on a new connection. timeout bounds every
+// network operation, so a publisher that stops sending is dropped.
+func Accept(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	c := &Conn{
+		conn:      conn,
+		w:         bufio.NewWriterSize(conn, 16*1024),
+		timeout:   timeout,
+		chunkSize: defaultChunkSize,
+		outChunk:  defaultChunkSize,
+		chunks:    make(map[uint32]*chunkStream),
+		ack:       windowAckSize,
+	}
+	c.r = bufio.NewReaderSize(countingReader{conn, c}, 64*1024)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return nil, err
+	}
+	if c0c1[0] != 3 {
+		return nil, fmt.Errorf("rtmp: unsupported version %d", c0c1[0])
+	}
+
+	// S0, S1 with our time and random bytes, and S2 echoing C1
+	s0s1 := make([]byte, 1+handshakeSize)
+	s0s1[0] = 3
+	binary.BigEndian.PutUint32(s0s1[1:], uint32(time.Now().Unix()))
+	rand.Read(s0s1[9:])
+	c.w.Write(s0s1)
+	c.w.Write(c0c1[1:])
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	c2 := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(c.r, c2); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// App is the application of the connect command, without a query
+func (c *Conn) App() string {
+	return c.app
+}
+
+// TCURL is the url the publisher connected to
+func (c *Conn) TCURL() string {
+	return c.tcURL
+}
+
+// RemoteAddr is the address of the publisher
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ReadPublish answers the connect and createStream commands of the
+// publisher and returns the stream name of its publish command, which may
+// carry a query. The caller then accepts or rejects the publish.
+func (c *Conn) ReadPublish() (name string, err error) {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return "", err
+		}
+		if msg.Type != TypeCommand && msg.Type != TypeCommandAMF3 {
+			continue
+		}
+		cmd, tx, args := c.command(msg)
+
+		switch cmd {
+		case "connect":
+			if len(args) > 0 {
+				if obj, ok := args[0].(map[string]interface{}); ok {
+					c.app, _ = obj["app"].(string)
+					c.tcURL, _ = obj["tcUrl"].(string)
+				}
+			}
+			c.app, _, _ = strings.Cut(c.app, "?")
+			c.app = strings.Trim(c.app, "/")
+
+			c.writeControl(TypeWindowAckSize, binary.BigEndian.AppendUint32(nil, windowAckSize))
+			c.writeControl(TypeSetPeerBandwidth, append(binary.BigEndian.AppendUint32(nil, windowAckSize), 2))
+			c.writeControl(TypeSetChunkSize, binary.BigEndian.AppendUint32(nil, outChunkSize))
+			err = c.writeMessage(csidCommand, TypeCommand, 0, amfEncode("_result", tx,
+				amfObj{{"fmsVer", "FMS/3,0,1,123"}, {"capabilities", 31}},
+				amfObj{{"level", "status"}, {"code", "NetConnection.Connect.Success"},
+					{"description", "Connection succeeded."}, {"objectEncoding", 0}}))
+		case "createStream":
+			err = c.writeMessage(csidCommand, TypeCommand, 0, amfEncode("_result", tx, nil, publishStreamID))
+		case "releaseStream", "FCPublish":
+			err = c.writeMessage(csidCommand, TypeCommand, 0, amfEncode("_result", tx, nil, nil))
+		case "publish":
+			if len(args) > 1 {
+				name, _ = args[1].(string)
+			}
+			if name == "" {
+				return "", errors.New("rtmp: publish without a stream name")
+			}
+			c.name = name
+			return name, nil
+		case "play":
+			return "", errNotPublish
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// AcceptPublish tells the publisher to start sending
+func (c *Conn) AcceptPublish() error {
+	// StreamBegin of the publish stream
+	c.writeControl(TypeUserControl, []byte{0, 0, 0, 0, 0, publishStreamID})
+	return c.status("status", "NetStream.Publish.Start", c.name+" is now published.")
+}
+
+// RejectPublish refuses the publish with a NetStream.Publish status code,
+// e.g. "BadName" or "Unauthorized"
+func (c *Conn) RejectPublish(code, description string) error {
+	return c.status("error", "NetStream.Publish."+code, description)
+}
+
+func (c *Conn) status(level, code, description string) error {
+	return c.writeMessage(csidStatus, TypeCommand, publishStreamID, amfEncode("onStatus", 0, nil,
+		amfObj{{"level", level}, {"code", code}, {"description", description}}))
+}
+
+// ReadMessage returns the next audio, video or data message of the stream.
+// It returns io.EOF when the publisher unpublishes.
+func (c *Conn) ReadMessage() (*Message, error) {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Type {
+		case TypeAudio, TypeVideo, TypeData:
+			return msg, nil
+		case TypeCommand, TypeCommandAMF3:
+			switch cmd, _, _ := c.command(msg); cmd {
+			case "FCUnpublish", "deleteStream", "closeStream":
+				return nil, io.EOF
+			}
+		}
+	}
+}
+
+// command decodes a command message into its name, transaction id and
+// arguments after the command object
+func (c *Conn) command(msg *Message) (name string, tx float64, args []interface{}) {
+	payload := msg.Payload
+	if msg.Type == TypeCommandAMF3 && len(payload) > 0 {
+		// AMF3 commands are AMF0 after a format byte
+		payload = payload[1:]
+	}
+	values, _ := amfDecode(payload)
+	if len(values) > 0 {
+		name, _ = values[0].(string)
+	}
+	if len(values) > 1 {
+		tx, _ = values[1].(float64)
+	}
+	if len(values) > 2 {
+		args = values[2:]
+	}
+	return name, tx, args
+}
+
+// readMessage reads chunks up to the next complete message, handling the
+// protocol control messages
+func (c *Conn) readMessage() (*Message, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if c.received-c.acked >= c.ack {
+			c.acked = c.received
+			if err := c.writeControl(TypeAck, binary.BigEndian.AppendUint32(nil, c.received)); err != nil {
+				return nil, err
+			}
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.Type {
+		case TypeSetChunkSize:
+			if len(msg.Payload) < 4 {
+				return nil, errBadChunk
+			}
+			size := binary.BigEndian.Uint32(msg.Payload) & 0x7fffffff
+			if size == 0 || size > maxMessageSize {
+				return nil, errBadChunk
+			}
+			c.chunkSize = size
+		case TypeAbort:
+			if len(msg.Payload) >= 4 {
+				if cs := c.chunks[binary.BigEndian.Uint32(msg.Payload)]; cs != nil {
+					c.buffered -= uint32(cap(cs.buf))
+					cs.buf = nil
+				}
+			}
+		case TypeWindowAckSize:
+			if len(msg.Payload) >= 4 && binary.BigEndian.Uint32(msg.Payload) > 0 {
+				c.ack = binary.BigEndian.Uint32(msg.Payload)
+			}
+		case TypeUserControl:
+			// answer a ping request with its timestamp
+			if len(msg.Payload) >= 6 && binary.BigEndian.Uint16(msg.Payload) == 6 {
+				if err := c.writeControl(TypeUserControl, append([]byte{0, 7}, msg.Payload[2:6]...)); err != nil {
+					return nil, err
+				}
+			}
+		case TypeAck, TypeSetPeerBandwidth:
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// readChunk reads one chunk, it returns the message the chunk completes or
+// nil
+func (c *Conn) readChunk() (*Message, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+
+	b0, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	format := b0 >> 6
+	csid := uint32(b0 & 0x3f)
+	switch csid {
+	case 0:
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b)
+	case 1:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b[0]) + uint32(b[1])<<8
+	}
+
+	cs := c.chunks[csid]
+	if cs == nil {
+		if format != 0 {
+			return nil, errBadChunk
+		}
+		if len(c.chunks) >= maxChunkStreams {
+			return nil, errChunkLimit
+		}
+		cs = &chunkStream{}
+		c.chunks[csid] = cs
+	}
+
+	var header [11]byte
+	size := [4]int{11, 7, 3, 0}[format]
+	if _, err := io.ReadFull(c.r, header[:size]); err != nil {
+		return nil, err
+	}
+	start := len(cs.buf) == 0
+	if format < 3 {
+		cs.delta = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		cs.extended = cs.delta == 0xffffff
+	}
+	if format < 2 {
+		length := uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+		if length > maxMessageSize {
+			return nil, errBadChunk
+		}
+		// the header of a chunk continuing a message cannot change it
+		if !start && (length != cs.length || header[6] != cs.typ) {
+			return nil, errBadChunk
+		}
+		cs.length = length
+		cs.typ = header[6]
+	}
+	if format == 0 {
+		cs.streamID = binary.LittleEndian.Uint32(header[7:])
+	}
+	if cs.extended {
+		var ext [4]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			cs.delta = binary.BigEndian.Uint32(ext[:])
+		}
+	}
+	if start {
+		if format == 0 {
+			cs.timestamp = cs.delta
+		} else {
+			cs.timestamp += cs.delta
+		}
+		if c.buffered+cs.length > maxBuffered {
+			return nil, errChunkLimit
+		}
+		cs.buf = make([]byte, 0, cs.length)
+		c.buffered += cs.length
+	}
+
+	n := cs.length - uint32(len(cs.buf))
+	if n > c.chunkSize {
+		n = c.chunkSize
+	}
+	chunk := cs.buf[len(cs.buf) : len(cs.buf)+int(n)]
+	if _, err := io.ReadFull(c.r, chunk); err != nil {
+		return nil, err
+	}
+	cs.buf = cs.buf[:len(cs.buf)+int(n)]
+	if uint32(len(cs.buf)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &Message{Type: cs.typ, Timestamp: cs.timestamp, StreamID: cs.streamID, Payload: cs.buf}
+	c.buffered -= uint32(cap(cs.buf))
+	cs.buf = nil
+	return msg, nil
+}
+
+func (c *Conn) writeControl(typ uint8, payload []byte) error {
+	return c.writeMessage(csidControl, typ, 0, payload)
+}
+
+// writeMessage sends a message with a zero timestamp
+func (c *Conn) writeMessage(csid uint8, typ uint8, streamID uint32, payload []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+
+	header := make([]byte, 12)
+	header[0] = csid
+	header[4], header[5], header[6] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	header[7] = typ
+	binary.LittleEndian.PutUint32(header[8:], streamID)
+	c.w.Write(header)
+
+	rest := payload
+	for len(rest) > c.outChunk {
+		c.w.Write(rest[:c.outChunk])
+		rest = rest[c.outChunk:]
+		// a type 3 header continues the message
+		c.w.WriteByte(0xc0 | csid)
+	}
+	c.w.Write(rest)
+	if typ == TypeSetChunkSize {
+		c.outChunk = int(binary.BigEndian.Uint32(payload))
+	}
+	return c.w.Flush()
+}
@@ -0,0 +1,201 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// bufConn is a net.Conn reading from a buffer and discarding what is written
+type bufConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufConn) Read(b []byte) (int, error)       { return c.r.Read(b) }
+func (c bufConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c bufConn) SetReadDeadline(time.Time) error  { return nil }
+func (c bufConn) SetWriteDeadline(time.Time) error { return nil }
+
+// newTestConn is a Conn past the handshake that reads data
+func newTestConn(data []byte) *Conn {
+	conn := bufConn{r: bytes.NewReader(data)}
+	c := &Conn{
+		conn:      conn,
+		w:         bufio.NewWriter(conn),
+		timeout:   time.Second,
+		chunkSize: defaultChunkSize,
+		outChunk:  defaultChunkSize,
+		chunks:    make(map[uint32]*chunkStream),
+		ack:       windowAckSize,
+	}
+	c.r = bufio.NewReader(countingReader{conn, c})
+	return c
+}
+
+// chunk builds a chunk with a basic header on csid 4 and the message header
+// fields of format
+func chunk(format byte, timestamp uint32, length int, typ byte, payload []byte) []byte {
+	b := []byte{format<<6 | 4}
+	if format < 3 {
+		b = append(b, byte(timestamp>>16), byte(timestamp>>8), byte(timestamp))
+	}
+	if format < 2 {
+		b = append(b, byte(length>>16), byte(length>>8), byte(length), typ)
+	}
+	if format == 0 {
+		b = append(b, 1, 0, 0, 0)
+	}
+	return append(b, payload...)
+}
+
+func TestReadChunks(t *testing.T) {
+	long := bytes.Repeat([]byte{0xab}, 200)
+
+	tests := []struct {
+		name string
+		data []byte
+		want []*Message
+		err  error
+	}{
+		{
+			name: "single chunk",
+			data: chunk(0, 1000, 3, TypeVideo, []byte{1, 2, 3}),
+			want: []*Message{{Type: TypeVideo, Timestamp: 1000, StreamID: 1, Payload: []byte{1, 2, 3}}},
+		},
+		{
+			name: "message over two chunks",
+			data: append(chunk(0, 0, 200, TypeVideo, long[:128]), chunk(3, 0, 0, 0, long[128:])...),
+			want: []*Message{{Type: TypeVideo, StreamID: 1, Payload: long}},
+		},
+		{
+			name: "timestamp deltas",
+			data: bytes.Join([][]byte{
+				chunk(0, 100, 1, TypeVideo, []byte{1}),
+				chunk(1, 40, 2, TypeAudio, []byte{2, 3}),
+				chunk(2, 33, 0, 0, []byte{4, 5}),
+				chunk(3, 0, 0, 0, []byte{6, 7}),
+			}, nil),
+			want: []*Message{
+				{Type: TypeVideo, Timestamp: 100, StreamID: 1, Payload: []byte{1}},
+				{Type: TypeAudio, Timestamp: 140, StreamID: 1, Payload: []byte{2, 3}},
+				{Type: TypeAudio, Timestamp: 173, StreamID: 1, Payload: []byte{4, 5}},
+				{Type: TypeAudio, Timestamp: 206, StreamID: 1, Payload: []byte{6, 7}},
+			},
+		},
+		{
+			name: "extended timestamp",
+			data: append(chunk(0, 0xffffff, 1, TypeVideo, nil), 0x01, 0x00, 0x00, 0x00, 9),
+			want: []*Message{{Type: TypeVideo, Timestamp: 0x01000000, StreamID: 1, Payload: []byte{9}}},
+		},
+		{
+			name: "first chunk without a full header",
+			data: chunk(1, 0, 1, TypeVideo, []byte{1}),
+			err:  errBadChunk,
+		},
+		{
+			name: "shorter length while a message is buffered",
+			data: append(chunk(0, 0, 130, TypeVideo, long[:128]), chunk(1, 0, 2, TypeVideo, long[:2])...),
+			err:  errBadChunk,
+		},
+		{
+			name: "other type while a message is buffered",
+			data: append(chunk(0, 0, 200, TypeVideo, long[:128]), chunk(1, 0, 200, TypeAudio, long[128:])...),
+			err:  errBadChunk,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestConn(test.data)
+			var got []*Message
+			for {
+				msg, err := c.readMessage()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					if err != test.err {
+						t.Fatalf("error %v, want %v", err, test.err)
+					}
+					return
+				}
+				got = append(got, msg)
+			}
+			if test.err != nil {
+				t.Fatalf("no error, want %v", test.err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("messages %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// chunkOn is a chunk of format 0 on the chunk stream csid, 2 to 319
+func chunkOn(csid uint32, length int, payload []byte) []byte {
+	b := chunk(0, 0, length, TypeVideo, payload)
+	if csid < 64 {
+		b[0] = byte(csid)
+		return b
+	}
+	return append([]byte{0, byte(csid - 64)}, b[1:]...)
+}
+
+func TestReadChunkLimits(t *testing.T) {
+	var streams []byte
+	for csid := uint32(4); csid < 4+maxChunkStreams+1; csid++ {
+		streams = append(streams, chunkOn(csid, 1, []byte{1})...)
+	}
+	// the third of the long messages is one too many
+	var buffered []byte
+	for csid := uint32(4); csid < 7; csid++ {
+		buffered = append(buffered, chunkOn(csid, maxMessageSize-1, make([]byte, defaultChunkSize))...)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		messages int
+		err      error
+	}{
+		{name: "too many chunk streams", data: streams, messages: maxChunkStreams, err: errChunkLimit},
+		{name: "too many buffered bytes", data: buffered, err: errChunkLimit},
+		{
+			// completed messages no longer count
+			name:     "buffered bytes released",
+			data:     append(chunkOn(4, 2, []byte{1, 2}), chunkOn(4, 2, []byte{3, 4})...),
+			messages: 2,
+			err:      io.EOF,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestConn(test.data)
+			messages := 0
+			for {
+				msg, err := c.readChunk()
+				if err != nil {
+					if err != test.err {
+						t.Fatalf("error %v, want %v", err, test.err)
+					}
+					break
+				}
+				if msg != nil {
+					messages++
+				}
+			}
+			if messages != test.messages {
+				t.Fatalf("%d messages, want %d", messages, test.messages)
+			}
+			if test.err == io.EOF && c.buffered != 0 {
+				t.Fatalf("%d bytes buffered after the messages", c.buffered)
+			}
+		})
+	}
+}
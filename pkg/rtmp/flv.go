@@ -0,0 +1,143 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// FLV codec ids of the video and audio messages
+const (
+	VideoCodecAVC = 7
+	AudioCodecAAC = 10
+)
+
+// AVC packet types
+const (
+	AVCSequenceHeader = 0
+	AVCNALU           = 1
+	AVCEndOfSequence  = 2
+)
+
+var errBadTag = errors.New("rtmp: malformed flv tag")
+
+// VideoTag is the FLV header of a video message
+type VideoTag struct {
+	Keyframe bool
+	Codec    uint8
+	// PacketType and CompositionTime are set for AVC
+	PacketType      uint8
+	CompositionTime int32
+	// Data is the AVCDecoderConfigurationRecord of a sequence header, or
+	// the length-prefixed NAL units of a picture
+	Data []byte
+}
+
+// ParseVideo reads the FLV header of a video message payload
+func ParseVideo(payload []byte) (*VideoTag, error) {
+	if len(payload) < 1 {
+		return nil, errBadTag
+	}
+	tag := &VideoTag{Keyframe: payload[0]>>4 == 1, Codec: payload[0] & 0x0f, Data: payload[1:]}
+	if tag.Codec != VideoCodecAVC {
+		return tag, nil
+	}
+	if len(payload) < 5 {
+		return nil, errBadTag
+	}
+	tag.PacketType = payload[1]
+	// a signed 24 bit value
+	tag.CompositionTime = int32(uint32(payload[2])<<24|uint32(payload[3])<<16|uint32(payload[4])<<8) >> 8
+	tag.Data = payload[5:]
+	return tag, nil
+}
+
+// AudioCodec is the FLV sound format of an audio message payload
+func AudioCodec(payload []byte) uint8 {
+	if len(payload) < 1 {
+		return 0
+	}
+	return payload[0] >> 4
+}
+
+// ParseMetaData returns the properties of an onMetaData data message, or nil
+// for other data messages. The "@setDataFrame" of encoders is skipped.
+func ParseMetaData(payload []byte) map[string]interface{} {
+	values, _ := amfDecode(payload)
+	if len(values) > 0 && values[0] == "@setDataFrame" {
+		values = values[1:]
+	}
+	if len(values) < 2 || values[0] != "onMetaData" {
+		return nil
+	}
+	props, _ := values[1].(map[string]interface{})
+	return props
+}
+
+// AVCConfig is an AVCDecoderConfigurationRecord
+type AVCConfig struct {
+	SPS [][]byte
+	PPS [][]byte
+	// LengthSize is the size of the NAL unit lengths of the pictures
+	LengthSize int
+}
+
+// ParseAVCConfig reads the AVCDecoderConfigurationRecord of a sequence header
+func ParseAVCConfig(b []byte) (*AVCConfig, error) {
+	if len(b) < 6 {
+		return nil, errBadTag
+	}
+	conf := &AVCConfig{LengthSize: int(b[4]&0x03) + 1}
+	count := int(b[5] & 0x1f)
+	b = b[6:]
+	for i := 0; i < 2; i++ {
+		for ; count > 0; count-- {
+			if len(b) < 2 {
+				return nil, errBadTag
+			}
+			size := int(binary.BigEndian.Uint16(b))
+			if size == 0 || len(b) < 2+size {
+				return nil, errBadTag
+			}
+			if i == 0 {
+				conf.SPS = append(conf.SPS, b[2:2+size])
+			} else {
+				conf.PPS = append(conf.PPS, b[2:2+size])
+			}
+			b = b[2+size:]
+		}
+		if i == 0 {
+			if len(b) < 1 {
+				return nil, errBadTag
+			}
+			count = int(b[0])
+			b = b[1:]
+		}
+	}
+	if len(conf.SPS) == 0 || len(conf.SPS[0]) < 4 || len(conf.PPS) == 0 {
+		return nil, errBadTag
+	}
+	return conf, nil
+}
+
+// NALUs splits the length-prefixed NAL units of a picture
+func (conf *AVCConfig) NALUs(b []byte) ([][]byte, error) {
+	var nalus [][]byte
+	for len(b) > 0 {
+		if len(b) < conf.LengthSize {
+			return nil, errBadTag
+		}
+		size := 0
+		for _, c := range b[:conf.LengthSize] {
+			size = size<<8 | int(c)
+		}
+		b = b[conf.LengthSize:]
+		if size > len(b) {
+			return nil, errBadTag
+		}
+		if size > 0 {
+			nalus = append(nalus, b[:size])
+		}
+		b = b[size:]
+	}
+	return nalus, nil
+}
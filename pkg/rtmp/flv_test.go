@@ -0,0 +1,142 @@
+package rtmp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVideo(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    *VideoTag
+		err     error
+	}{
+		{
+			name:    "avc sequence header",
+			payload: []byte{0x17, AVCSequenceHeader, 0, 0, 0, 1, 2},
+			want:    &VideoTag{Keyframe: true, Codec: VideoCodecAVC, PacketType: AVCSequenceHeader, Data: []byte{1, 2}},
+		},
+		{
+			name:    "avc picture with composition time",
+			payload: []byte{0x27, AVCNALU, 0, 0, 66, 9},
+			want:    &VideoTag{Codec: VideoCodecAVC, PacketType: AVCNALU, CompositionTime: 66, Data: []byte{9}},
+		},
+		{
+			name:    "negative composition time",
+			payload: []byte{0x27, AVCNALU, 0xff, 0xff, 0xfe},
+			want:    &VideoTag{Codec: VideoCodecAVC, PacketType: AVCNALU, CompositionTime: -2, Data: []byte{}},
+		},
+		{
+			name:    "other codec",
+			payload: []byte{0x12, 7},
+			want:    &VideoTag{Keyframe: true, Codec: 2, Data: []byte{7}},
+		},
+		{name: "empty", payload: nil, err: errBadTag},
+		{name: "short avc header", payload: []byte{0x17, 1, 0}, err: errBadTag},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tag, err := ParseVideo(test.payload)
+			if err != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(tag, test.want) {
+				t.Fatalf("tag %+v, want %+v", tag, test.want)
+			}
+		})
+	}
+}
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac}
+	testPPS = []byte{0x68, 0xce}
+)
+
+func TestParseAVCConfig(t *testing.T) {
+	record := []byte{1, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0, 5}
+	record = append(record, testSPS...)
+	record = append(record, 1, 0, 2)
+	record = append(record, testPPS...)
+
+	tests := []struct {
+		name   string
+		record []byte
+		want   *AVCConfig
+		err    error
+	}{
+		{
+			name:   "one sps and pps",
+			record: record,
+			want:   &AVCConfig{SPS: [][]byte{testSPS}, PPS: [][]byte{testPPS}, LengthSize: 4},
+		},
+		{name: "truncated sps", record: record[:10], err: errBadTag},
+		{name: "no pps", record: append(append([]byte{}, record[:13]...), 0), err: errBadTag},
+		{name: "short sps", record: []byte{1, 0x64, 0, 0x1f, 0xff, 0xe1, 0, 2, 0x67, 0x64, 1, 0, 2, 0x68, 0xce}, err: errBadTag},
+		{name: "too short", record: []byte{1, 2, 3}, err: errBadTag},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf, err := ParseAVCConfig(test.record)
+			if err != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(conf, test.want) {
+				t.Fatalf("config %+v, want %+v", conf, test.want)
+			}
+		})
+	}
+}
+
+func TestNALUs(t *testing.T) {
+	tests := []struct {
+		name       string
+		lengthSize int
+		data       []byte
+		want       [][]byte
+		err        error
+	}{
+		{
+			name:       "four byte lengths",
+			lengthSize: 4,
+			data:       []byte{0, 0, 0, 2, 0x65, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0x41},
+			want:       [][]byte{{0x65, 1}, {0x41}},
+		},
+		{
+			name:       "two byte lengths",
+			lengthSize: 2,
+			data:       []byte{0, 3, 0x41, 1, 2},
+			want:       [][]byte{{0x41, 1, 2}},
+		},
+		{name: "length past the end", lengthSize: 4, data: []byte{0, 0, 0, 9, 0x65}, err: errBadTag},
+		{name: "truncated length", lengthSize: 4, data: []byte{0, 0}, err: errBadTag},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nalus, err := (&AVCConfig{LengthSize: test.lengthSize}).NALUs(test.data)
+			if err != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(nalus, test.want) {
+				t.Fatalf("nalus %x, want %x", nalus, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMetaData(t *testing.T) {
+	meta := amfEncode("@setDataFrame", "onMetaData", amfObj{{"audiocodecid", 10}, {"width", 1280}})
+	props := ParseMetaData(meta)
+	if props["audiocodecid"] != 10.0 || props["width"] != 1280.0 {
+		t.Fatalf("metadata %v", props)
+	}
+	if props := ParseMetaData(amfEncode("onMetaData", amfObj{{"videocodecid", 7}})); props["videocodecid"] != 7.0 {
+		t.Fatalf("metadata without @setDataFrame %v", props)
+	}
+	if props := ParseMetaData(amfEncode("onCuePoint", amfObj{})); props != nil {
+		t.Fatalf("metadata of another data message %v", props)
+	}
+}
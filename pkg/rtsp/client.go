@@ -0,0 +1,511 @@
+// Package rtsp is a minimal RTSP client. It plays a stream with its RTP and
+// RTCP interleaved on the RTSP connection, which IP cameras commonly support
+// and which needs no UDP ports.
+package rtsp
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// defaultSessionTimeout is the session timeout when the server gives none
+const defaultSessionTimeout = 60 * time.Second
+
+var (
+	// ErrUnauthorized is returned when the server refuses the credentials
+	ErrUnauthorized = errors.New("rtsp: unauthorized")
+	errBadResponse  = errors.New("rtsp: malformed response")
+)
+
+// Media is a media section of the stream description
+type Media struct {
+	// Type is "video" or "audio"
+	Type string
+	// Codec is the encoding name, e.g. "H264", "opus" or "PCMA"
+	Codec       string
+	PayloadType uint8
+	ClockRate   uint32
+	Channels    uint16
+	// Fmtp holds the format parameters, e.g. the H264 sprop-parameter-sets
+	Fmtp string
+	// Channel is the interleaved channel of the RTP once set up, the RTCP is
+	// on Channel+1
+	Channel int
+
+	control string
+}
+
+// Client is an RTSP session with a server
+type Client struct {
+	url     *url.URL
+	user    *url.Userinfo
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	// writeLock serializes the requests, keep-alives are sent while the
+	// packets are read
+	writeLock sync.Mutex
+	cseq      int
+	session   string
+	// sessionTimeout is the timeout the server gave the session
+	sessionTimeout time.Duration
+	// base is the url the media controls are relative to
+	base string
+	// scheme is "Basic" or "Digest" once the server asked for credentials,
+	// realm, nonce and qop are the digest challenge
+	scheme string
+	realm  string
+	nonce  string
+	qop    string
+	nc     int
+	// channels is the number of interleaved channels set up
+	channels int
+}
+
+// Dial connects to the server of rawURL. The credentials of the url are used
+// when the server asks for them. timeout bounds every network operation.
+func Dial(rawURL string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("rtsp: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		user:           u.User,
+		conn:           conn,
+		r:              bufio.NewReaderSize(conn, 64*1024),
+		timeout:        timeout,
+		sessionTimeout: defaultSessionTimeout,
+	}
+	u.User = nil
+	c.url = u
+	c.base = u.String()
+	return c, nil
+}
+
+// Close ends the session and the connection
+func (c *Client) Close() error {
+	if c.session != "" {
+		c.writeLock.Lock()
+		c.write("TEARDOWN", c.url.String(), nil)
+		c.writeLock.Unlock()
+	}
+	return c.conn.Close()
+}
+
+// SessionTimeout is how long the server keeps the session without requests
+func (c *Client) SessionTimeout() time.Duration {
+	return c.sessionTimeout
+}
+
+// Describe returns the media of the stream
+func (c *Client) Describe() ([]*Media, error) {
+	res, err := c.do("DESCRIBE", c.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+	if base := res.header.Get("Content-Base"); base != "" {
+		c.base = base
+	} else if loc := res.header.Get("Content-Location"); loc != "" {
+		c.base = loc
+	}
+
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal(res.body); err != nil {
+		return nil, fmt.Errorf("rtsp: bad stream description: %w", err)
+	}
+
+	var medias []*Media
+	for _, md := range desc.MediaDescriptions {
+		if len(md.MediaName.Formats) == 0 {
+			continue
+		}
+		pt, err := strconv.Atoi(md.MediaName.Formats[0])
+		if err != nil {
+			continue
+		}
+		m := &Media{Type: md.MediaName.Media, PayloadType: uint8(pt)}
+		// the static payload types need no rtpmap
+		switch pt {
+		case 0:
+			m.Codec, m.ClockRate, m.Channels = "PCMU", 8000, 1
+		case 8:
+			m.Codec, m.ClockRate, m.Channels = "PCMA", 8000, 1
+		}
+		for _, a := range md.Attributes {
+			switch a.Key {
+			case "rtpmap":
+				if format, value, ok := strings.Cut(a.Value, " "); ok && format == md.MediaName.Formats[0] {
+					m.parseRTPMap(value)
+				}
+			case "fmtp":
+				if format, value, ok := strings.Cut(a.Value, " "); ok && format == md.MediaName.Formats[0] {
+					m.Fmtp = value
+				}
+			case "control":
+				m.control = a.Value
+			}
+		}
+		if m.Codec != "" {
+			medias = append(medias, m)
+		}
+	}
+	return medias, nil
+}
+
+// parseRTPMap reads "encoding/clock rate[/channels]"
+func (m *Media) parseRTPMap(value string) {
+	parts := strings.Split(value, "/")
+	m.Codec = parts[0]
+	if len(parts) > 1 {
+		rate, _ := strconv.ParseUint(parts[1], 10, 32)
+		m.ClockRate = uint32(rate)
+	}
+	m.Channels = 1
+	if len(parts) > 2 {
+		channels, _ := strconv.ParseUint(parts[2], 10, 16)
+		m.Channels = uint16(channels)
+	}
+}
+
+// Setup asks for the RTP of m on the next interleaved channels
+func (c *Client) Setup(m *Media) error {
+	header := map[string]string{
+		"Transport": fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", c.channels, c.channels+1),
+	}
+	res, err := c.do("SETUP", c.controlURL(m.control), header)
+	if err != nil {
+		return err
+	}
+
+	m.Channel = c.channels
+	for _, param := range strings.Split(res.header.Get("Transport"), ";") {
+		if value := strings.TrimPrefix(param, "interleaved="); value != param {
+			first, _, _ := strings.Cut(value, "-")
+			if channel, err := strconv.Atoi(first); err == nil {
+				m.Channel = channel
+			}
+		}
+	}
+	c.channels = m.Channel + 2
+
+	if session := res.header.Get("Session"); session != "" {
+		id, params, _ := strings.Cut(session, ";")
+		c.session = strings.TrimSpace(id)
+		for _, param := range strings.Split(params, ";") {
+			if value := strings.TrimPrefix(strings.TrimSpace(param), "timeout="); value != param {
+				if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+					c.sessionTimeout = time.Duration(secs) * time.Second
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// controlURL resolves the control of a media against the base url. A relative
+// control names a path below the base, which keeps its query unless the
+// control has its own.
+func (c *Client) controlURL(control string) string {
+	if control == "" || control == "*" {
+		return c.base
+	}
+	ref, err := url.Parse(control)
+	if err != nil {
+		return control
+	}
+	if ref.IsAbs() {
+		return ref.String()
+	}
+	base, err := url.Parse(c.base)
+	if err != nil {
+		return control
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		base.RawPath = ""
+	}
+	u := base.ResolveReference(ref)
+	if ref.RawQuery == "" {
+		u.RawQuery = base.RawQuery
+	}
+	return u.String()
+}
+
+// Play starts the stream, the packets are then read with ReadPacket
+func (c *Client) Play() error {
+	_, err := c.do("PLAY", c.base, map[string]string{"Range": "npt=0.000-"})
+	return err
+}
+
+// KeepAlive refreshes the session while it plays. The answer is skipped by
+// ReadPacket.
+func (c *Client) KeepAlive() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.write("GET_PARAMETER", c.base, nil)
+}
+
+// ReadPacket returns the next interleaved packet and its channel
+func (c *Client) ReadPacket() (int, []byte, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if b[0] != '$' {
+			// the answer to a keep-alive
+			if _, err := c.readResponse(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		var head [4]byte
+		if _, err := io.ReadFull(c.r, head[:]); err != nil {
+			return 0, nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint16(head[2:]))
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return 0, nil, err
+		}
+		return int(head[1]), data, nil
+	}
+}
+
+// WritePacket sends an interleaved packet on channel, e.g. RTCP on the
+// channel after the media's
+func (c *Client) WritePacket(channel int, data []byte) error {
+	if len(data) > 0xffff {
+		return errors.New("rtsp: packet too large")
+	}
+	frame := append([]byte{'$', byte(channel), byte(len(data) >> 8), byte(len(data))}, data...)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+type response struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// do sends a request and waits for its answer, answering a request for
+// credentials once
+func (c *Client) do(method, uri string, header map[string]string) (*response, error) {
+	for attempt := 0; ; attempt++ {
+		c.writeLock.Lock()
+		err := c.write(method, uri, header)
+		c.writeLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		var res *response
+		for {
+			c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+			b, err := c.r.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if b[0] == '$' {
+				// a packet that came before the answer
+				if _, _, err := c.ReadPacket(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if res, err = c.readResponse(); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		switch {
+		case res.status == 401 && attempt == 0 && c.user != nil:
+			if err := c.challenge(res.header.Values("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		case res.status == 401:
+			return nil, ErrUnauthorized
+		case res.status != 200:
+			return nil, fmt.Errorf("rtsp: %v %v: status %v", method, uri, res.status)
+		}
+		return res, nil
+	}
+}
+
+// write sends a request, c.writeLock must be held
+func (c *Client) write(method, uri string, header map[string]string) error {
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v %v RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: livekit-whip-go\r\n", method, uri, c.cseq)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %v\r\n", c.session)
+	}
+	if auth := c.authorization(method, uri); auth != "" {
+		fmt.Fprintf(&b, "Authorization: %v\r\n", auth)
+	}
+	for k, v := range header {
+		fmt.Fprintf(&b, "%v: %v\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+func (c *Client) readResponse() (*response, error) {
+	tp := textproto.NewReader(c.r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "RTSP/") {
+		return nil, errBadResponse
+	}
+	code, _, _ := strings.Cut(rest, " ")
+	status, err := strconv.Atoi(code)
+	if err != nil {
+		return nil, errBadResponse
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &response{status: status, header: header}
+	if length := header.Get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 {
+			return nil, errBadResponse
+		}
+		res.body = make([]byte, n)
+		if _, err := io.ReadFull(c.r, res.body); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// challenge takes the request for credentials of the server, Digest is
+// preferred over Basic
+func (c *Client) challenge(values []string) error {
+	for _, value := range values {
+		scheme, params, _ := strings.Cut(value, " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		c.scheme = "Digest"
+		for _, param := range splitParams(params) {
+			k, v, _ := strings.Cut(param, "=")
+			v = strings.Trim(v, `"`)
+			switch strings.ToLower(strings.TrimSpace(k)) {
+			case "realm":
+				c.realm = v
+			case "nonce":
+				c.nonce = v
+			case "qop":
+				// auth is the only protection of a request without body
+				for _, qop := range strings.Split(v, ",") {
+					if strings.TrimSpace(qop) == "auth" {
+						c.qop = "auth"
+					}
+				}
+			}
+		}
+		return nil
+	}
+	for _, value := range values {
+		if scheme, _, _ := strings.Cut(value, " "); strings.EqualFold(scheme, "Basic") {
+			c.scheme = "Basic"
+			return nil
+		}
+	}
+	return ErrUnauthorized
+}
+
+// splitParams splits the comma separated parameters of a challenge, commas
+// within quotes included
+func splitParams(s string) []string {
+	var params []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			params = append(params, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(params, strings.TrimSpace(s[start:]))
+}
+
+// authorization answers the challenge of the server for a request
+func (c *Client) authorization(method, uri string) string {
+	if c.user == nil || c.scheme == "" {
+		return ""
+	}
+	user := c.user.Username()
+	pass, _ := c.user.Password()
+	if c.scheme == "Basic" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+
+	ha1 := md5Hex(user + ":" + c.realm + ":" + pass)
+	ha2 := md5Hex(method + ":" + uri)
+	if c.qop == "" {
+		return fmt.Sprintf(`Digest username="%v", realm="%v", nonce="%v", uri="%v", response="%v"`,
+			user, c.realm, c.nonce, uri, md5Hex(ha1+":"+c.nonce+":"+ha2))
+	}
+	c.nc++
+	nc := fmt.Sprintf("%08x", c.nc)
+	cnonce := make([]byte, 8)
+	rand.Read(cnonce)
+	cn := hex.EncodeToString(cnonce)
+	return fmt.Sprintf(`Digest username="%v", realm="%v", nonce="%v", uri="%v", qop=%v, nc=%v, cnonce="%v", response="%v"`,
+		user, c.realm, c.nonce, uri, c.qop, nc, cn, md5Hex(ha1+":"+c.nonce+":"+nc+":"+cn+":"+c.qop+":"+ha2))
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
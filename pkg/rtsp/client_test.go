@@ -0,0 +1,279 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		control string
+		want    string
+	}{
+		{name: "aggregate", base: "rtsp://cam/live", control: "*", want: "rtsp://cam/live"},
+		{name: "no control", base: "rtsp://cam/live", control: "", want: "rtsp://cam/live"},
+		{name: "relative", base: "rtsp://cam/live", control: "trackID=1", want: "rtsp://cam/live/trackID=1"},
+		{name: "relative to a directory", base: "rtsp://cam/live/", control: "trackID=1", want: "rtsp://cam/live/trackID=1"},
+		{name: "base with a query", base: "rtsp://cam:554/stream?channel=1&subtype=0", control: "trackID=0", want: "rtsp://cam:554/stream/trackID=0?channel=1&subtype=0"},
+		{name: "control with a query", base: "rtsp://cam/stream?channel=1", control: "track1?x=2", want: "rtsp://cam/stream/track1?x=2"},
+		{name: "absolute", base: "rtsp://cam/live", control: "rtsp://cam:8554/live/track1", want: "rtsp://cam:8554/live/track1"},
+		{name: "absolute other case", base: "rtsp://cam/live", control: "RTSP://cam/live/track1", want: "rtsp://cam/live/track1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Client{base: test.base}
+			if got := c.controlURL(test.control); got != test.want {
+				t.Fatalf("control url %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// testServer is an RTSP server on a local port that answers each request
+// with the response of handle
+type testServer struct {
+	addr     string
+	requests chan *testRequest
+}
+
+type testRequest struct {
+	method string
+	uri    string
+	header textproto.MIMEHeader
+}
+
+func newTestServer(t *testing.T, handle func(req *testRequest) string) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv := &testServer{addr: l.Addr().String(), requests: make(chan *testRequest, 16)}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			header, err := tp.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			req := &testRequest{method: fields[0], uri: fields[1], header: header}
+			srv.requests <- req
+			res := handle(req)
+			if !strings.HasPrefix(res, "$") {
+				res = strings.Replace(res, "\r\n", "\r\nCSeq: "+header.Get("CSeq")+"\r\n", 1)
+			}
+			if _, err := io.WriteString(conn, res); err != nil {
+				return
+			}
+		}
+	}()
+	return srv
+}
+
+const testSDP = "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=cam\r\nt=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\na=fmtp:96 packetization-mode=1\r\na=control:trackID=1\r\n" +
+	"m=audio 0 RTP/AVP 8\r\na=control:trackID=2\r\n"
+
+// interleaved frames data on channel
+func interleaved(channel byte, data []byte) string {
+	return string(append([]byte{'$', channel, byte(len(data) >> 8), byte(len(data))}, data...))
+}
+
+func TestClientPlay(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) string {
+		switch req.method {
+		case "DESCRIBE":
+			return fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Base: %v\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%v",
+				"rtsp://cam/live/", len(testSDP), testSDP)
+		case "SETUP":
+			return "RTSP/1.0 200 OK\r\nTransport: " + req.header.Get("Transport") + "\r\nSession: 12345678;timeout=30\r\n\r\n"
+		case "PLAY":
+			// packets may come ahead of a keep-alive answer
+			return "RTSP/1.0 200 OK\r\n\r\n" + interleaved(0, []byte{0x80, 96, 0, 1}) + interleaved(3, []byte{0x80, 200})
+		case "GET_PARAMETER":
+			return "RTSP/1.0 200 OK\r\n\r\n" + interleaved(2, []byte{0x80, 8, 0, 2})
+		}
+		return "RTSP/1.0 405 Method Not Allowed\r\n\r\n"
+	})
+
+	c, err := Dial("rtsp://"+srv.addr+"/live", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	medias, err := c.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(medias) != 2 {
+		t.Fatalf("%d medias, want 2", len(medias))
+	}
+	video, audio := medias[0], medias[1]
+	if video.Type != "video" || video.Codec != "H264" || video.ClockRate != 90000 || video.Fmtp != "packetization-mode=1" {
+		t.Fatalf("video %+v", video)
+	}
+	if audio.Type != "audio" || audio.Codec != "PCMA" || audio.ClockRate != 8000 || audio.PayloadType != 8 {
+		t.Fatalf("audio %+v", audio)
+	}
+	<-srv.requests
+
+	for i, m := range medias {
+		if err := c.Setup(m); err != nil {
+			t.Fatal(err)
+		}
+		req := <-srv.requests
+		if want := fmt.Sprintf("rtsp://cam/live/trackID=%d", i+1); req.uri != want {
+			t.Fatalf("setup of %v, want %v", req.uri, want)
+		}
+		if m.Channel != 2*i {
+			t.Fatalf("%v on channel %d, want %d", m.Type, m.Channel, 2*i)
+		}
+		if i > 0 && req.header.Get("Session") != "12345678" {
+			t.Fatalf("session %q", req.header.Get("Session"))
+		}
+	}
+	if c.SessionTimeout() != 30*time.Second {
+		t.Fatalf("session timeout %v", c.SessionTimeout())
+	}
+
+	if err := c.Play(); err != nil {
+		t.Fatal(err)
+	}
+	if req := <-srv.requests; req.uri != "rtsp://cam/live/" {
+		t.Fatalf("play of %v", req.uri)
+	}
+	if err := c.KeepAlive(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		channel int
+		data    []byte
+	}{
+		{0, []byte{0x80, 96, 0, 1}},
+		{3, []byte{0x80, 200}},
+		{2, []byte{0x80, 8, 0, 2}},
+	} {
+		channel, data, err := c.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if channel != want.channel || !bytes.Equal(data, want.data) {
+			t.Fatalf("packet %x on channel %d, want %x on %d", data, channel, want.data, want.channel)
+		}
+	}
+}
+
+func TestClientDigest(t *testing.T) {
+	const realm, nonce = "cam", "abc123"
+	srv := newTestServer(t, func(req *testRequest) string {
+		auth := req.header.Get("Authorization")
+		if auth == "" {
+			return `RTSP/1.0 401 Unauthorized` + "\r\n" +
+				`WWW-Authenticate: Basic realm="cam"` + "\r\n" +
+				`WWW-Authenticate: Digest realm="` + realm + `", nonce="` + nonce + `", qop="auth,auth-int"` + "\r\n\r\n"
+		}
+		params := make(map[string]string)
+		for _, param := range splitParams(strings.TrimPrefix(auth, "Digest ")) {
+			k, v, _ := strings.Cut(param, "=")
+			params[k] = strings.Trim(v, `"`)
+		}
+		ha1 := md5Hex("admin:" + realm + ":secret")
+		ha2 := md5Hex(req.method + ":" + req.uri)
+		want := md5Hex(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		if !strings.HasPrefix(auth, "Digest ") || params["username"] != "admin" || params["qop"] != "auth" || params["response"] != want {
+			return "RTSP/1.0 401 Unauthorized\r\n\r\n"
+		}
+		return fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Length: %d\r\n\r\n%v", len(testSDP), testSDP)
+	})
+
+	c, err := Dial("rtsp://admin:secret@"+srv.addr+"/live", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Describe(); err != nil {
+		t.Fatal(err)
+	}
+	if first := <-srv.requests; first.header.Get("Authorization") != "" {
+		t.Fatalf("credentials sent before the challenge: %v", first.header.Get("Authorization"))
+	}
+	if retry := <-srv.requests; strings.Contains(retry.uri, "secret") {
+		t.Fatalf("password in the request uri %v", retry.uri)
+	}
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) string {
+		return "RTSP/1.0 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"cam\"\r\n\r\n"
+	})
+
+	c, err := Dial("rtsp://admin:wrong@"+srv.addr+"/live", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Describe(); err != ErrUnauthorized {
+		t.Fatalf("error %v, want %v", err, ErrUnauthorized)
+	}
+	<-srv.requests
+	if retry := <-srv.requests; !strings.HasPrefix(retry.header.Get("Authorization"), "Basic ") {
+		t.Fatalf("authorization %q, want basic", retry.header.Get("Authorization"))
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		channel int
+		packet  []byte
+		err     error
+	}{
+		{name: "packet", data: interleaved(1, []byte{1, 2, 3}), channel: 1, packet: []byte{1, 2, 3}},
+		{name: "empty packet", data: interleaved(4, nil), channel: 4, packet: []byte{}},
+		{name: "after a response", data: "RTSP/1.0 200 OK\r\nCSeq: 5\r\n\r\n" + interleaved(0, []byte{9}), packet: []byte{9}},
+		{name: "truncated header", data: "$\x00\x00", err: io.ErrUnexpectedEOF},
+		{name: "truncated packet", data: "$\x00\x00\x05\x01", err: io.ErrUnexpectedEOF},
+		{name: "garbage", data: "HTTP/1.1 200 OK\r\n\r\n", err: errBadResponse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			c := &Client{conn: client, r: bufio.NewReader(strings.NewReader(test.data)), timeout: time.Second}
+
+			channel, packet, err := c.ReadPacket()
+			if err != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if err == nil && (channel != test.channel || !bytes.Equal(packet, test.packet)) {
+				t.Fatalf("packet %x on channel %d, want %x on %d", packet, channel, test.packet, test.channel)
+			}
+		})
+	}
+}
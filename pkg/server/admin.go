@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminAPIPrefix is the prefix of the versioned admin API
+const adminAPIPrefix = "/api/v1"
+
+// sessionInfo describes a WHIP or WHEP session in the admin API
+type sessionInfo struct {
+	ID            string             `json:"id"`
+	Type          string             `json:"type"`
+	Room          string             `json:"room"`
+	Stream        string             `json:"stream,omitempty"`
+	Participant   string             `json:"participant,omitempty"`
+	State         string             `json:"state"`
+	CreatedAt     time.Time          `json:"createdAt"`
+	UptimeSeconds float64            `json:"uptimeSeconds"`
+	Codecs        []string           `json:"codecs"`
+	CandidatePair *candidatePairInfo `json:"candidatePair,omitempty"`
+	BytesSent     uint64             `json:"bytesSent"`
+	BytesReceived uint64             `json:"bytesReceived"`
+	// Bitrate is the average bitrate in bits per second since the session
+	// started, received for publishers and sent for the others
+	Bitrate uint64 `json:"bitrate"`
+	// Subscribers counts the local viewers of a publisher's stream
+	Subscribers int `json:"subscribers"`
+}
+
+type candidatePairInfo struct {
+	Local  candidateInfo `json:"local"`
+	Remote candidateInfo `json:"remote"`
+}
+
+type candidateInfo struct {
+	Address  string `json:"address"`
+	Port     uint16 `json:"port"`
+	Protocol string `json:"protocol"`
+	Type     string `json:"type"`
+}
+
+// agentInfo describes a LiveKit agent in the admin API
+type agentInfo struct {
+	Room        string   `json:"room"`
+	Participant string   `json:"participant"`
+	Name        string   `json:"name,omitempty"`
+	State       string   `json:"state"`
+	Refs        int      `json:"refs"`
+	Tracks      []string `json:"tracks"`
+}
+
+// sessionInfo describes the session id, s.listLock must be held
+func (s *Server) sessionInfo(id string, state *whipState) sessionInfo {
+	info := sessionInfo{
+		ID:            id,
+		Type:          state.sessionType(),
+		Room:          state.room,
+		Stream:        state.stream,
+		State:         state.connectionState().String(),
+		CreatedAt:     state.created,
+		UptimeSeconds: time.Since(state.created).Seconds(),
+	}
+	if state.ingest != nil {
+		info.Codecs = state.ingest.codecs()
+	} else {
+		info.Codecs = state.whipConn.Codecs()
+	}
+	if info.Codecs == nil {
+		info.Codecs = []string{}
+	}
+	if state.publish {
+		info.Participant = state.participant.Identity
+		for _, sub := range s.conns {
+			if !sub.publish && sub.room == state.room && sub.stream == state.stream {
+				info.Subscribers++
+			}
+		}
+	}
+
+	if state.ingest != nil {
+		info.BytesReceived = state.ingest.bytesReceived()
+	} else {
+		if pair := state.whipConn.SelectedCandidatePair(); pair != nil {
+			info.CandidatePair = &candidatePairInfo{
+				Local:  candidateInfo{Address: pair.Local.Address, Port: pair.Local.Port, Protocol: pair.Local.Protocol.String(), Type: pair.Local.Typ.String()},
+				Remote: candidateInfo{Address: pair.Remote.Address, Port: pair.Remote.Port, Protocol: pair.Remote.Protocol.String(), Type: pair.Remote.Typ.String()},
+			}
+		}
+		info.BytesSent, info.BytesReceived = state.whipConn.BytesTransferred()
+	}
+	bytes := info.BytesSent
+	if state.publish {
+		bytes = info.BytesReceived
+	}
+	if info.UptimeSeconds > 0 {
+		info.Bitrate = uint64(float64(bytes*8) / info.UptimeSeconds)
+	}
+	return info
+}
+
+// info describes the agent for the admin API
+func (a *roomAgent) info() agentInfo {
+	state := a.state()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	info := agentInfo{
+		Room:        a.room,
+		Participant: a.participant.Identity,
+		Name:        a.participant.Name,
+		State:       state,
+		Refs:        a.refs,
+		Tracks:      []string{},
+	}
+	for _, t := range a.tracks {
+		info.Tracks = append(info.Tracks, t.opts.Name+"/"+t.track.Kind().String())
+	}
+	sort.Strings(info.Tracks)
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("failed to encode response", err)
+	}
+}
+
+// handleAdminSessions lists the sessions, of one room with ?room=
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	if !s.authorizeAdmin(w, r, room) {
+		return
+	}
+
+	s.listLock.RLock()
+	list := []sessionInfo{}
+	for id, state := range s.conns {
+		if room == "" || state.room == room {
+			list = append(list, s.sessionInfo(id, state))
+		}
+	}
+	s.listLock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	writeJSON(w, list)
+}
+
+func (s *Server) handleAdminSession(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s.listLock.RLock()
+	state, found := s.conns[id]
+	var info sessionInfo
+	if found {
+		info = s.sessionInfo(id, state)
+	}
+	s.listLock.RUnlock()
+
+	if !found {
+		if s.authorizeAdmin(w, r, "") {
+			httpError(w, http.StatusNotFound, "404 - session "+id+" not found")
+		}
+		return
+	}
+	if !s.authorizeAdmin(w, r, state.room) {
+		return
+	}
+	writeJSON(w, info)
+}
+
+// handleAdminDisconnect force-disconnects a session
+func (s *Server) handleAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	state, found := s.conns[id]
+	if !found {
+		if s.authorizeAdmin(w, r, "") {
+			httpError(w, http.StatusNotFound, "404 - session "+id+" not found")
+		}
+		return
+	}
+	if !s.authorizeAdmin(w, r, state.room) {
+		return
+	}
+	state.close()
+	delete(s.conns, id)
+	s.sessionRemoved(id, state)
+	log.Printf("%v session %v disconnected by admin", state.sessionType(), id)
+	s.printWhipState()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminAgents lists the LiveKit agents, of one room with ?room=
+func (s *Server) handleAdminAgents(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	if !s.authorizeAdmin(w, r, room) {
+		return
+	}
+
+	s.agentsLock.Lock()
+	agents := make([]*roomAgent, 0, len(s.rtcAgents))
+	for _, a := range s.rtcAgents {
+		if room == "" || a.room == room {
+			agents = append(agents, a)
+		}
+	}
+	s.agentsLock.Unlock()
+
+	list := []agentInfo{}
+	for _, a := range agents {
+		list = append(list, a.info())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Room != list[j].Room {
+			return list[i].Room < list[j].Room
+		}
+		return list[i].Participant < list[j].Participant
+	})
+	writeJSON(w, list)
+}
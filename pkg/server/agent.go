@@ -0,0 +1,331 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	agentReconnectMinBackoff = time.Second
+	agentReconnectMaxBackoff = 30 * time.Second
+)
+
+// agentTrack is a track the agent keeps published while it is connected. A
+// simulcast track is published from its layers, track is then the first layer.
+type agentTrack struct {
+	key    string
+	track  webrtc.TrackLocal
+	layers []*lksdk.LocalSampleTrack
+	opts   lksdk.TrackPublicationOptions
+	sid    string
+}
+
+// roomAgent is the LiveKit participant that publishes WHIP tracks to one
+// room, either every track of the room or those of a single publisher. It
+// connects lazily on the first published track, is reference counted by the
+// tracks it publishes and reconnects with backoff after LiveKit drops it,
+// republishing the active tracks.
+type roomAgent struct {
+	s           *Server
+	room        string
+	participant participantInfo
+
+	lock       sync.Mutex
+	conn       *lksdk.Room
+	generation int
+	connecting bool
+	closed     bool
+	refs       int
+	tracks     map[string]*agentTrack
+}
+
+// agentTrackKey identifies a track of the agent's room by stream and kind,
+// like the published tracks. Track ids come from the publishers and repeat
+// across them.
+func agentTrackKey(stream string, kind webrtc.RTPCodecType) string {
+	return stream + "/" + kind.String()
+}
+
+// agentKey identifies the agent of participant in room
+func agentKey(room string, participant participantInfo) string {
+	return room + "/" + participant.Identity
+}
+
+// acquireAgent returns the agent of participant in room, creating it if
+// needed. Every call must be paired with releaseAgent.
+func (s *Server) acquireAgent(room string, participant participantInfo) *roomAgent {
+	s.agentsLock.Lock()
+	defer s.agentsLock.Unlock()
+
+	key := agentKey(room, participant)
+	a, ok := s.rtcAgents[key]
+	if !ok {
+		a = &roomAgent{
+			s:           s,
+			room:        room,
+			participant: participant,
+			tracks:      make(map[string]*agentTrack),
+		}
+		s.rtcAgents[key] = a
+	}
+	a.lock.Lock()
+	a.refs++
+	a.lock.Unlock()
+	return a
+}
+
+// releaseAgent drops a reference, the agent leaves the room with the last one
+func (s *Server) releaseAgent(a *roomAgent) {
+	s.agentsLock.Lock()
+	a.lock.Lock()
+	a.refs--
+	last := a.refs <= 0
+	a.lock.Unlock()
+	key := agentKey(a.room, a.participant)
+	if last && s.rtcAgents[key] == a {
+		delete(s.rtcAgents, key)
+	}
+	s.agentsLock.Unlock()
+
+	if last {
+		a.close()
+	}
+}
+
+// state returns the connection state of the agent for the metrics
+func (a *roomAgent) state() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch {
+	case a.conn != nil:
+		return "connected"
+	case a.connecting:
+		return "connecting"
+	}
+	return "disconnected"
+}
+
+// closeAgents disconnects every agent regardless of its references
+func (s *Server) closeAgents() {
+	s.agentsLock.Lock()
+	agents := s.rtcAgents
+	s.rtcAgents = make(map[string]*roomAgent)
+	s.agentsLock.Unlock()
+
+	for _, a := range agents {
+		a.close()
+	}
+}
+
+// publish keeps track published in the room, connecting the agent if needed
+func (a *roomAgent) publish(track webrtc.TrackLocal, opts lksdk.TrackPublicationOptions) {
+	a.add(&agentTrack{track: track, opts: opts})
+}
+
+// publishSimulcast keeps the simulcast layers published in the room as one
+// track. It is unpublished with the first layer.
+func (a *roomAgent) publishSimulcast(layers []*lksdk.LocalSampleTrack, opts lksdk.TrackPublicationOptions) {
+	a.add(&agentTrack{track: layers[0], layers: layers, opts: opts})
+}
+
+func (a *roomAgent) add(t *agentTrack) {
+	t.key = agentTrackKey(t.opts.Name, t.track.Kind())
+
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return
+	}
+	// another source of the stream leaves the room to this one
+	old := a.tracks[t.key]
+	a.tracks[t.key] = t
+	conn := a.conn
+	if conn == nil && !a.connecting {
+		a.connecting = true
+		go a.connectLoop()
+	}
+	a.lock.Unlock()
+
+	if old != nil {
+		a.unpublishTrack(conn, old)
+	}
+	// without a connection the track is published once connectLoop succeeds
+	if conn != nil {
+		a.publishTrack(conn, t)
+	}
+}
+
+// unpublish removes track of stream from the room
+func (a *roomAgent) unpublish(stream string, track webrtc.TrackLocal) {
+	key := agentTrackKey(stream, track.Kind())
+
+	a.lock.Lock()
+	t, ok := a.tracks[key]
+	if !ok || t.track != track {
+		// the stream has a newer track
+		a.lock.Unlock()
+		return
+	}
+	delete(a.tracks, key)
+	conn := a.conn
+	a.lock.Unlock()
+
+	a.unpublishTrack(conn, t)
+}
+
+// unpublishTrack removes the publication of t, if it has one on conn
+func (a *roomAgent) unpublishTrack(conn *lksdk.Room, t *agentTrack) {
+	a.lock.Lock()
+	sid := t.sid
+	t.sid = ""
+	a.lock.Unlock()
+
+	if conn != nil && sid != "" {
+		if err := conn.LocalParticipant.UnpublishTrack(sid); err != nil {
+			log.Println("failed to unpublish ", sid, " rtc track", err)
+		} else {
+			log.Println("unpublished rtc track ", sid)
+			a.emit(eventTrackUnpublished, t, sid, nil)
+		}
+	}
+}
+
+func (a *roomAgent) publishTrack(conn *lksdk.Room, t *agentTrack) {
+	opts := t.opts
+	var pub *lksdk.LocalTrackPublication
+	var err error
+	if len(t.layers) > 0 {
+		// PublishSimulcastTrack sorts the layers in place
+		layers := append([]*lksdk.LocalSampleTrack(nil), t.layers...)
+		pub, err = conn.LocalParticipant.PublishSimulcastTrack(layers, &opts)
+	} else {
+		pub, err = conn.LocalParticipant.PublishTrack(t.track, &opts)
+	}
+	if err != nil {
+		log.Println("failed to publish rtc track", t.opts.Name, err)
+		a.emit(eventTrackPublishFailed, t, "", err)
+		return
+	}
+	log.Println("published rtc track", t.opts.Name)
+	a.emit(eventTrackPublished, t, pub.SID(), nil)
+
+	a.lock.Lock()
+	current := a.conn == conn && a.tracks[t.key] == t
+	if current {
+		t.sid = pub.SID()
+	}
+	a.lock.Unlock()
+
+	// the track went away while it was being published
+	if !current {
+		if err := conn.LocalParticipant.UnpublishTrack(pub.SID()); err != nil {
+			log.Println("failed to unpublish ", pub.SID(), " rtc track", err)
+		}
+	}
+}
+
+// connectLoop connects the agent with backoff and publishes the active tracks
+func (a *roomAgent) connectLoop() {
+	backoff := agentReconnectMinBackoff
+	for {
+		a.lock.Lock()
+		a.generation++
+		generation := a.generation
+		closed := a.closed
+		a.lock.Unlock()
+		if closed {
+			return
+		}
+
+		conn, err := a.s.createAgent(a.room, &lksdk.RoomCallback{
+			OnDisconnected: func() {
+				a.onDisconnected(generation)
+			},
+		}, a.participant)
+		if err != nil {
+			log.Printf("failed to create agent %v for room %v: %v, retry in %v", a.participant.Identity, a.room, err, backoff)
+			a.emit(eventAgentConnectFailed, nil, "", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > agentReconnectMaxBackoff {
+				backoff = agentReconnectMaxBackoff
+			}
+			continue
+		}
+
+		a.lock.Lock()
+		if a.closed || a.generation != generation {
+			a.lock.Unlock()
+			conn.Disconnect()
+			return
+		}
+		log.Println("created rtc agent", a.participant.Identity, "for room", a.room)
+		a.emit(eventAgentConnected, nil, "", nil)
+		a.conn = conn
+		a.connecting = false
+		var tracks []*agentTrack
+		for _, t := range a.tracks {
+			tracks = append(tracks, t)
+		}
+		a.lock.Unlock()
+
+		for _, t := range tracks {
+			a.publishTrack(conn, t)
+		}
+		return
+	}
+}
+
+func (a *roomAgent) onDisconnected(generation int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed || a.generation != generation || a.conn == nil {
+		return
+	}
+
+	log.Printf("rtc agent %v for room %v disconnected, reconnecting", a.participant.Identity, a.room)
+	a.emit(eventAgentDisconnected, nil, "", nil)
+	a.conn = nil
+	for _, t := range a.tracks {
+		t.sid = ""
+	}
+	a.connecting = true
+	go a.connectLoop()
+}
+
+// close leaves the room, the agent can not be used afterwards
+func (a *roomAgent) close() {
+	a.lock.Lock()
+	a.closed = true
+	conn := a.conn
+	a.conn = nil
+	a.lock.Unlock()
+
+	if conn != nil {
+		conn.Disconnect()
+		log.Println("disconnected rtc agent", a.participant.Identity, "for room", a.room)
+		a.emit(eventAgentDisconnected, nil, "", nil)
+	}
+}
+
+// emit sends an agent event, about track t when it is set
+func (a *roomAgent) emit(typ string, t *agentTrack, sid string, err error) {
+	ev := serverEvent{
+		Type:        typ,
+		Room:        a.room,
+		Participant: a.participant.Identity,
+		TrackSid:    sid,
+	}
+	if t != nil {
+		ev.Stream = t.opts.Name
+		ev.Track = t.track.Kind().String()
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	a.s.events.emit(ev)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session and LiveKit event types
+const (
+	eventPublishStarted     = "publish_started"
+	eventSubscriberJoined   = "subscriber_joined"
+	eventConnectionState    = "connection_state"
+	eventSessionRemoved     = "session_removed"
+	eventTrackPublished     = "track_published"
+	eventTrackUnpublished   = "track_unpublished"
+	eventTrackPublishFailed = "track_publish_failed"
+	eventAgentConnected     = "agent_connected"
+	eventAgentConnectFailed = "agent_connect_failed"
+	eventAgentDisconnected  = "agent_disconnected"
+)
+
+// eventBufferSize is how many events a slow listener may lag behind before
+// events are dropped for it
+const eventBufferSize = 64
+
+// serverEvent is a lifecycle event of a session or a LiveKit agent
+type serverEvent struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room"`
+	Stream  string    `json:"stream,omitempty"`
+	Session string    `json:"session,omitempty"`
+	// SessionType is publish, subscribe, whep or whep_room
+	SessionType string `json:"sessionType,omitempty"`
+	Participant string `json:"participant,omitempty"`
+	// State is the connection state for connection_state events
+	State string `json:"state,omitempty"`
+	// Track and TrackSid describe the LiveKit track of track_* events
+	Track    string `json:"track,omitempty"`
+	TrackSid string `json:"trackSid,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// eventBus fans the server events out to the listeners
+type eventBus struct {
+	lock      sync.Mutex
+	listeners map[int]chan serverEvent
+	nextId    int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{listeners: make(map[int]chan serverEvent)}
+}
+
+// listen returns a channel of the events from now on and a function that
+// stops listening and closes it
+func (b *eventBus) listen() (<-chan serverEvent, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.nextId++
+	id := b.nextId
+	ch := make(chan serverEvent, eventBufferSize)
+	b.listeners[id] = ch
+	return ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, ok := b.listeners[id]; ok {
+			delete(b.listeners, id)
+			close(ch)
+		}
+	}
+}
+
+// emit sends ev to every listener without blocking
+func (b *eventBus) emit(ev serverEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, ch := range b.listeners {
+		select {
+		case ch <- ev:
+		default:
+			log.Println("server event dropped for a slow listener", ev.Type)
+		}
+	}
+}
+
+// sessionEvent builds an event of type typ for session id
+func sessionEvent(typ, id string, state *whipState) serverEvent {
+	ev := serverEvent{
+		Type:        typ,
+		Room:        state.room,
+		Stream:      state.stream,
+		Session:     id,
+		SessionType: state.sessionType(),
+	}
+	if state.publish {
+		ev.Participant = state.participant.Identity
+	}
+	return ev
+}
+
+// sessionStarted emits publish_started or subscriber_joined for a new session
+func (s *Server) sessionStarted(id string, state *whipState) {
+	typ := eventSubscriberJoined
+	if state.publish {
+		typ = eventPublishStarted
+	}
+	s.events.emit(sessionEvent(typ, id, state))
+}
+
+// sessionRemoved emits session_removed for a session taken out of s.conns
+func (s *Server) sessionRemoved(id string, state *whipState) {
+	s.events.emit(sessionEvent(eventSessionRemoved, id, state))
+}
+
+// sourceStarted emits publish_started for an RTMP publisher going live, which
+// publishes without a session in s.conns. The returned func emits its
+// session_removed.
+func (s *Server) sourceStarted(id, room, stream string, participant participantInfo) func() {
+	ev := serverEvent{
+		Type:        eventPublishStarted,
+		Room:        room,
+		Stream:      stream,
+		Session:     id,
+		SessionType: "publish",
+		Participant: participant.Identity,
+	}
+	s.events.emit(ev)
+	return func() {
+		ev.Type = eventSessionRemoved
+		ev.Time = time.Time{}
+		s.events.emit(ev)
+	}
+}
+
+// handleEvents streams the server events as server-sent events, of one room
+// with ?room=
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	if !s.authorizeAdmin(w, r, room) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "500 - streaming unsupported")
+		return
+	}
+
+	events, stop := s.events.listen()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev := <-events:
+			if room != "" && ev.Room != room {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Println("failed to encode server event", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %v\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.shutdown:
+			return
+		}
+	}
+}
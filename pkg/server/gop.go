@@ -0,0 +1,232 @@
+package server
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// gopCacheMaxPackets bounds the cache of one track, a longer GOP is not
+	// cached until the next keyframe
+	gopCacheMaxPackets = 4096
+)
+
+// gopCache keeps the packets of a published video track since its last
+// keyframe. WHEP viewers get their own gopTrack that starts with the cached
+// packets, so playback starts without asking the publisher for a keyframe.
+type gopCache struct {
+	codec    webrtc.RTPCodecCapability
+	id       string
+	streamID string
+	keyframe func(payload []byte) bool
+
+	lock    sync.Mutex
+	packets []*rtp.Packet
+	// valid is set while packets starts with a keyframe
+	valid  bool
+	tracks map[*gopTrack]struct{}
+}
+
+// newGOPCache returns a cache for a VP8 or H264 track, nil for other codecs
+func newGOPCache(codec webrtc.RTPCodecCapability, id, streamID string) *gopCache {
+	var keyframe func([]byte) bool
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		keyframe = isVP8Keyframe
+	case strings.ToLower(webrtc.MimeTypeH264):
+		keyframe = isH264Keyframe
+	default:
+		return nil
+	}
+	return &gopCache{
+		codec:    codec,
+		id:       id,
+		streamID: streamID,
+		keyframe: keyframe,
+		tracks:   make(map[*gopTrack]struct{}),
+	}
+}
+
+// write caches pkt and forwards it to the viewers' tracks
+func (c *gopCache) write(pkt *rtp.Packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// a keyframe starts a new GOP with its first packet, parameter sets sent
+	// ahead of an IDR share its timestamp and stay in the cache
+	if c.keyframe(pkt.Payload) && (len(c.packets) == 0 || c.packets[len(c.packets)-1].Timestamp != pkt.Timestamp) {
+		c.packets = c.packets[:0]
+		c.valid = true
+	}
+	if c.valid {
+		if len(c.packets) < gopCacheMaxPackets {
+			cached := *pkt
+			cached.Payload = append([]byte(nil), pkt.Payload...)
+			c.packets = append(c.packets, &cached)
+		} else {
+			c.packets = nil
+			c.valid = false
+		}
+	}
+
+	for t := range c.tracks {
+		if t.primed {
+			t.write(pkt)
+		} else if c.valid {
+			t.prime(c.packets)
+		}
+	}
+}
+
+// hasKeyframe reports whether a joining viewer can start from the cache
+func (c *gopCache) hasKeyframe() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.valid
+}
+
+// newTrack returns a track for one viewer
+func (c *gopCache) newTrack() *gopTrack {
+	return &gopTrack{cache: c}
+}
+
+// gopTrack is one viewer's copy of a cached track. Until its peer connection
+// can send, it waits; it then sends the cached GOP followed by the live
+// packets, with its own sequence numbers and timestamps.
+type gopTrack struct {
+	cache *gopCache
+
+	// the fields below are guarded by cache.lock
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writer      webrtc.TrackLocalWriter
+	primed      bool
+	seqOffset   uint16
+	tsOffset    uint32
+}
+
+// ID implements webrtc.TrackLocal
+func (t *gopTrack) ID() string { return t.cache.id }
+
+// StreamID implements webrtc.TrackLocal
+func (t *gopTrack) StreamID() string { return t.cache.streamID }
+
+// RID implements webrtc.TrackLocal
+func (t *gopTrack) RID() string { return "" }
+
+// Kind implements webrtc.TrackLocal
+func (t *gopTrack) Kind() webrtc.RTPCodecType { return webrtc.RTPCodecTypeVideo }
+
+// Bind implements webrtc.TrackLocal
+func (t *gopTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := matchCodec(t.cache.codec, ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	t.cache.lock.Lock()
+	defer t.cache.lock.Unlock()
+
+	t.ssrc = ctx.SSRC()
+	t.payloadType = codec.PayloadType
+	t.writer = ctx.WriteStream()
+	t.cache.tracks[t] = struct{}{}
+	return codec, nil
+}
+
+// Unbind implements webrtc.TrackLocal
+func (t *gopTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.cache.lock.Lock()
+	defer t.cache.lock.Unlock()
+
+	delete(t.cache.tracks, t)
+	return nil
+}
+
+// prime sends the cached GOP once the peer connection can send, cache.lock
+// must be held. Packets written before then are dropped by pion, so priming
+// is retried with every packet until the first one goes out.
+func (t *gopTrack) prime(packets []*rtp.Packet) {
+	t.seqOffset = uint16(rand.Uint32()) - packets[0].SequenceNumber
+	t.tsOffset = rand.Uint32() - packets[0].Timestamp
+	if n, err := t.send(packets[0]); err != nil || n == 0 {
+		return
+	}
+	t.primed = true
+	for _, pkt := range packets[1:] {
+		t.write(pkt)
+	}
+}
+
+// write sends a live packet, cache.lock must be held
+func (t *gopTrack) write(pkt *rtp.Packet) {
+	if _, err := t.send(pkt); err != nil {
+		delete(t.cache.tracks, t)
+	}
+}
+
+func (t *gopTrack) send(pkt *rtp.Packet) (int, error) {
+	header := pkt.Header
+	// the publisher's header extension ids mean nothing to the viewer
+	header.Extension = false
+	header.Extensions = nil
+	header.SSRC = uint32(t.ssrc)
+	header.PayloadType = uint8(t.payloadType)
+	header.SequenceNumber += t.seqOffset
+	header.Timestamp += t.tsOffset
+	return t.writer.WriteRTP(&header, pkt.Payload)
+}
+
+// matchCodec picks the negotiated codec of a binding, preferring the same
+// fmtp line
+func matchCodec(codec webrtc.RTPCodecCapability, params []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	for _, p := range params {
+		if strings.EqualFold(p.MimeType, codec.MimeType) && p.SDPFmtpLine == codec.SDPFmtpLine {
+			return p, true
+		}
+	}
+	for _, p := range params {
+		if strings.EqualFold(p.MimeType, codec.MimeType) {
+			return p, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// isVP8Keyframe reports whether payload starts a VP8 keyframe
+func isVP8Keyframe(payload []byte) bool {
+	var vp8 codecs.VP8Packet
+	if _, err := vp8.Unmarshal(payload); err != nil {
+		return false
+	}
+	return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+}
+
+// isH264Keyframe reports whether payload carries an SPS or the start of an IDR
+// slice, alone, aggregated in a STAP-A or fragmented in an FU-A
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch naluType := payload[0] & 0x1f; naluType {
+	case 5, 7:
+		return true
+	case 24:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+	case 28:
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == 5
+	}
+	return false
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/fmp4"
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// hlsDefaultSegmentDuration is the segment length when
+	// hls_segment_duration is not set, segments end at the first keyframe
+	// after it
+	hlsDefaultSegmentDuration = 2 * time.Second
+	// hlsPartDuration is the length of the partial segments, a part ends with
+	// the first frame after it
+	hlsPartDuration = 400 * time.Millisecond
+	// hlsPartTarget is the least part target duration announced
+	hlsPartTarget = 500 * time.Millisecond
+	// hlsSegmentCount is the number of complete segments in the playlist
+	hlsSegmentCount = 7
+	// hlsPartSegments is the number of complete segments whose parts are
+	// listed in a low-latency playlist
+	hlsPartSegments = 2
+	// hlsStartTimeout is how long a playlist request waits for the first
+	// segment of a stream
+	hlsStartTimeout = 15 * time.Second
+)
+
+// hlsStream serves the output of a muxer as an HLS media playlist of fMP4
+// segments, with partial segments and blocking playlist reloads for
+// low-latency players when hls_low_latency is set.
+type hlsStream struct {
+	key             string
+	lowLatency      bool
+	segmentDuration time.Duration
+
+	lock sync.Mutex
+	// changed is closed and replaced whenever a part is added or the stream
+	// ends
+	changed  chan struct{}
+	init     []byte
+	segments []*hlsSegment
+	// current is the segment being filled, nil before the stream starts
+	current *hlsSegment
+	// independent is set when the next part starts with a keyframe
+	independent bool
+	maxSegment  time.Duration
+	maxPart     time.Duration
+	ended       bool
+}
+
+// hlsSegment is a media segment, made of the parts that are its fragments
+type hlsSegment struct {
+	msn      uint64
+	parts    []*hlsPart
+	duration time.Duration
+}
+
+type hlsPart struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+func (s *Server) newHLSStream(m *mp4Muxer, state *whipState) mp4Sink {
+	segmentDuration := time.Duration(s.conf.WHIP.HLSSegmentDuration) * time.Second
+	if segmentDuration <= 0 {
+		segmentDuration = hlsDefaultSegmentDuration
+	}
+	return &hlsStream{
+		key:             m.key,
+		lowLatency:      s.conf.WHIP.HLSLowLatency,
+		segmentDuration: segmentDuration,
+		changed:         make(chan struct{}),
+	}
+}
+
+// newHLSTrack adds a published track of state to the HLS stream of its
+// stream. It returns nil when HLS is off or the codec cannot be served.
+func (s *Server) newHLSTrack(state *whipState, codec webrtc.RTPCodecParameters) *mp4Track {
+	if !s.conf.WHIP.HLS {
+		return nil
+	}
+	t := s.hls.addTrack(state, codec)
+	if t == nil {
+		log.Printf("HLS of %v is not supported, track of %v not served", codec.MimeType, state.stream)
+		return nil
+	}
+	return t
+}
+
+func (h *hlsStream) start(init []byte, tracks []*fmp4.Track) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.init = init
+	h.current = &hlsSegment{}
+	// the muxer starts at a keyframe
+	h.independent = true
+	log.Printf("HLS of %v started with %v", h.key, fmp4TrackNames(tracks))
+	return nil
+}
+
+func (h *hlsStream) fragment(data []byte, duration time.Duration, boundary bool) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.current == nil {
+		return nil
+	}
+
+	h.current.parts = append(h.current.parts, &hlsPart{data: data, duration: duration, independent: h.independent})
+	h.current.duration += duration
+	h.independent = boundary
+	if duration > h.maxPart {
+		h.maxPart = duration
+	}
+
+	if boundary && h.current.duration >= h.segmentDuration {
+		if h.current.duration > h.maxSegment {
+			h.maxSegment = h.current.duration
+		}
+		h.segments = append(h.segments, h.current)
+		if len(h.segments) > hlsSegmentCount {
+			h.segments = h.segments[len(h.segments)-hlsSegmentCount:]
+		}
+		h.current = &hlsSegment{msn: h.current.msn + 1}
+	}
+	h.notify()
+	return nil
+}
+
+func (h *hlsStream) close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.ended {
+		return nil
+	}
+	// what is left of the current segment becomes the last one
+	if h.current != nil && len(h.current.parts) > 0 {
+		h.segments = append(h.segments, h.current)
+		h.current = &hlsSegment{msn: h.current.msn + 1}
+	}
+	h.ended = true
+	h.notify()
+	log.Printf("HLS of %v ended", h.key)
+	return nil
+}
+
+// notify wakes the waiting requests, h.lock must be held
+func (h *hlsStream) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// waitHLS blocks until ready, called with h.lock held, returns true, the
+// stream ends, the request is cancelled or timeout passes
+func (s *Server) waitHLS(r *http.Request, h *hlsStream, timeout time.Duration, ready func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		h.lock.Lock()
+		ok, ended, changed := ready(), h.ended, h.changed
+		h.lock.Unlock()
+		if ok || ended {
+			return ok
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		case <-s.shutdown:
+			return false
+		}
+	}
+}
+
+// segment returns the complete segment msn, h.lock must be held
+func (h *hlsStream) segment(msn uint64) *hlsSegment {
+	for _, seg := range h.segments {
+		if seg.msn == msn {
+			return seg
+		}
+	}
+	return nil
+}
+
+// part returns part i of segment msn, complete or not, h.lock must be held
+func (h *hlsStream) part(msn uint64, i int) *hlsPart {
+	seg := h.segment(msn)
+	if seg == nil && h.current != nil && h.current.msn == msn {
+		seg = h.current
+	}
+	if seg == nil || i >= len(seg.parts) {
+		return nil
+	}
+	return seg.parts[i]
+}
+
+// playlist writes the media playlist, query is appended to the uris. h.lock
+// must be held.
+func (h *hlsStream) playlist(query string) []byte {
+	var b bytes.Buffer
+	version := 7
+	if h.lowLatency {
+		version = 9
+	}
+	target := h.segmentDuration
+	if h.maxSegment > target {
+		target = h.maxSegment
+	}
+	partTarget := hlsPartTarget
+	if h.maxPart > partTarget {
+		partTarget = h.maxPart
+	}
+
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Round(target.Seconds())))
+	if h.lowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget.Seconds())
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", h.segments[0].msn)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init.mp4%v\"\n", query)
+
+	for i, seg := range h.segments {
+		if h.lowLatency && i >= len(h.segments)-hlsPartSegments {
+			h.writeParts(&b, seg, query)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.5f,\n%d.m4s%v\n", seg.duration.Seconds(), seg.msn, query)
+	}
+	if h.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if h.lowLatency {
+		h.writeParts(&b, h.current, query)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%d.%d.m4s%v\"\n", h.current.msn, len(h.current.parts), query)
+	}
+	return b.Bytes()
+}
+
+func (h *hlsStream) writeParts(b *bytes.Buffer, seg *hlsSegment, query string) {
+	for i, part := range seg.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.5f,URI=\"%d.%d.m4s%v\"", part.duration.Seconds(), seg.msn, i, query)
+		if part.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// handleHLS serves the playlist, init segment, segments and parts of the HLS
+// stream of a published stream under /hls/{room}/{stream}/
+func (s *Server) handleHLS(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	room, stream, file := vars["room"], vars["stream"], vars["file"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// players cannot always set headers, the token may come in the url and
+	// is then passed on to the uris of the playlist
+	query := ""
+	if token := r.URL.Query().Get("token"); token != "" {
+		if r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		query = "?token=" + url.QueryEscape(token)
+	}
+	if _, ok := s.authorize(w, r, room, stream, false); !ok {
+		return
+	}
+
+	m := s.hls.get(room, stream)
+	if m == nil {
+		httpError(w, http.StatusNotFound, "404 - stream "+room+"/"+stream+" not found")
+		return
+	}
+	h := m.sink.(*hlsStream)
+
+	switch {
+	case file == "index.m3u8":
+		s.serveHLSPlaylist(w, r, h, query)
+	case file == "init.mp4":
+		if !s.waitHLS(r, h, hlsStartTimeout, func() bool { return h.init != nil }) {
+			httpError(w, http.StatusNotFound, "404 - stream "+room+"/"+stream+" has not started")
+			return
+		}
+		h.lock.Lock()
+		data := h.init
+		h.lock.Unlock()
+		writeHLSMedia(w, data)
+	case strings.HasSuffix(file, ".m4s"):
+		s.serveHLSMedia(w, r, h, strings.TrimSuffix(file, ".m4s"))
+	default:
+		httpError(w, http.StatusNotFound, "404 - "+file+" not found")
+	}
+}
+
+// serveHLSPlaylist answers a playlist request, holding blocking reloads
+// (_HLS_msn and _HLS_part) until the playlist has the segment or part asked for
+func (s *Server) serveHLSPlaylist(w http.ResponseWriter, r *http.Request, h *hlsStream, query string) {
+	if !s.waitHLS(r, h, hlsStartTimeout, func() bool { return len(h.segments) > 0 }) {
+		httpError(w, http.StatusNotFound, "404 - stream "+h.key+" has no segments yet")
+		return
+	}
+
+	if msnParam := r.URL.Query().Get("_HLS_msn"); msnParam != "" && h.lowLatency {
+		msn, err := strconv.ParseUint(msnParam, 10, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "400 - bad _HLS_msn")
+			return
+		}
+		part := -1
+		if partParam := r.URL.Query().Get("_HLS_part"); partParam != "" {
+			if part, err = strconv.Atoi(partParam); err != nil || part < 0 {
+				httpError(w, http.StatusBadRequest, "400 - bad _HLS_part")
+				return
+			}
+		}
+
+		h.lock.Lock()
+		next := h.current.msn
+		target := h.segmentDuration
+		if h.maxSegment > target {
+			target = h.maxSegment
+		}
+		h.lock.Unlock()
+		if msn > next+1 {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("400 - segment %v is too far ahead", msn))
+			return
+		}
+
+		ready := func() bool {
+			if part < 0 {
+				return h.current.msn > msn
+			}
+			return h.current.msn > msn || h.current.msn == msn && len(h.current.parts) > part
+		}
+		if !s.waitHLS(r, h, 3*target, ready) {
+			h.lock.Lock()
+			ended := h.ended
+			h.lock.Unlock()
+			if !ended {
+				httpError(w, http.StatusServiceUnavailable, "503 - stream "+h.key+" stalled")
+				return
+			}
+		}
+	}
+
+	h.lock.Lock()
+	data := h.playlist(query)
+	h.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// serveHLSMedia answers a segment request, {msn}, or a part request,
+// {msn}.{part}. The part of the preload hint is held until it is complete.
+func (s *Server) serveHLSMedia(w http.ResponseWriter, r *http.Request, h *hlsStream, name string) {
+	msnParam, partParam, isPart := strings.Cut(name, ".")
+	msn, err := strconv.ParseUint(msnParam, 10, 64)
+	part := 0
+	if err == nil && isPart {
+		part, err = strconv.Atoi(partParam)
+	}
+	if err != nil || part < 0 {
+		httpError(w, http.StatusNotFound, "404 - "+name+".m4s not found")
+		return
+	}
+
+	var data []byte
+	if isPart {
+		ready := func() bool {
+			return h.part(msn, part) != nil || h.current == nil || h.current.msn != msn || len(h.current.parts) != part
+		}
+		s.waitHLS(r, h, 3*h.segmentDuration, ready)
+		h.lock.Lock()
+		if p := h.part(msn, part); p != nil {
+			data = p.data
+		}
+		h.lock.Unlock()
+	} else {
+		h.lock.Lock()
+		if seg := h.segment(msn); seg != nil {
+			for _, p := range seg.parts {
+				data = append(data, p.data...)
+			}
+		}
+		h.lock.Unlock()
+	}
+	if data == nil {
+		httpError(w, http.StatusNotFound, "404 - "+name+".m4s of "+h.key+" not found")
+		return
+	}
+	writeHLSMedia(w, data)
+}
+
+func writeHLSMedia(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/auth"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+)
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	log.Print(msg)
+	w.WriteHeader(code)
+	w.Write([]byte(msg))
+}
+
+// authorize checks the bearer token of r against room and stream, answering
+// 401 or 403 when it does not grant the request. The claims are nil when auth
+// is disabled.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, room, stream string, publish bool) (*auth.Claims, bool) {
+	claims, ok := s.authenticate(w, r)
+	if !ok || !allows(w, claims, room, stream, publish) {
+		return nil, false
+	}
+	return claims, true
+}
+
+// authenticate checks the bearer token of r, answering 401 when it is missing
+// or invalid. The claims are nil when auth is disabled.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*auth.Claims, bool) {
+	if !s.conf.WHIP.Auth {
+		return nil, true
+	}
+
+	claims, err := auth.Verify(r.Header.Get("Authorization"), s.conf.LiveKitServer.APIKey, s.conf.LiveKitServer.APISecret)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="whip"`)
+		httpError(w, http.StatusUnauthorized, "401 - "+err.Error())
+		return nil, false
+	}
+	return claims, true
+}
+
+// allows answers 403 unless claims grant the request, nil claims grant any
+func allows(w http.ResponseWriter, claims *auth.Claims, room, stream string, publish bool) bool {
+	if claims != nil && !claims.Allows(room, stream, publish) {
+		httpError(w, http.StatusForbidden, fmt.Sprintf("403 - %v: room: %v, stream: %v", auth.ErrForbidden, room, stream))
+		return false
+	}
+	return true
+}
+
+// authorizeAdmin checks that the bearer token of r may administer room, all
+// rooms when room is empty. It answers 401 or 403 otherwise. The admin API
+// needs a token even when auth is disabled for WHIP and WHEP.
+func (s *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request, room string) bool {
+	claims, err := auth.Verify(r.Header.Get("Authorization"), s.conf.LiveKitServer.APIKey, s.conf.LiveKitServer.APISecret)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="whip"`)
+		httpError(w, http.StatusUnauthorized, "401 - "+err.Error())
+		return false
+	}
+
+	if !claims.AllowsAdmin(room) {
+		httpError(w, http.StatusForbidden, fmt.Sprintf("403 - token does not grant roomAdmin: room: %v", room))
+		return false
+	}
+	return true
+}
+
+// iceETag identifies the current ICE session of a resource
+func iceETag(c *whip.WHIPConn) string {
+	ufrag, _ := c.LocalICECredentials()
+	return "\"" + ufrag + "\""
+}
+
+// handlePatch applies a trickle-ice-sdpfrag PATCH to the resource of state.
+// Trickled candidates are answered with 204, an ICE restart with 200 and the
+// new local credentials.
+func handlePatch(w http.ResponseWriter, r *http.Request, state *whipState) {
+	if state.ingest != nil {
+		httpError(w, http.StatusMethodNotAllowed, "405 - an rtp or rtsp ingest has no ice session to patch")
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), whip.MimeTypeSDPFragment) {
+		httpError(w, http.StatusUnsupportedMediaType, "415 - patch must be "+whip.MimeTypeSDPFragment)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "400 - failed to read sdpfrag")
+		return
+	}
+	log.Printf("sdpfrag => %v", string(body))
+
+	frag, err := whip.ParseSDPFragment(string(body))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("400 - bad sdpfrag: %v", err))
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && ifMatch != "*" && ifMatch != iceETag(state.whipConn) {
+		httpError(w, http.StatusPreconditionFailed, "412 - ice session "+ifMatch+" does not match")
+		return
+	}
+
+	ufrag, _ := state.whipConn.RemoteICECredentials()
+	restart := ifMatch == "*" || (frag.ICEUfrag != "" && frag.ICEUfrag != ufrag && frag.ICEPwd != "")
+	if restart {
+		if frag.ICEUfrag == "" || frag.ICEPwd == "" {
+			httpError(w, http.StatusBadRequest, "400 - ice restart needs ice-ufrag and ice-pwd")
+			return
+		}
+		local, err := state.whipConn.RestartICE(frag.ICEUfrag, frag.ICEPwd)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, fmt.Sprintf("500 - ice restart failed: %v", err))
+			return
+		}
+		if err = state.whipConn.AddSDPFragment(frag); err != nil {
+			log.Printf("failed to add candidates after ice restart: %v", err)
+		}
+		w.Header().Set("Content-Type", whip.MimeTypeSDPFragment)
+		w.Header().Set("ETag", iceETag(state.whipConn))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(local.Marshal()))
+		return
+	}
+
+	if err = state.whipConn.AddSDPFragment(frag); err != nil {
+		code := http.StatusUnprocessableEntity
+		if err == whip.ErrICECredentialsMismatch {
+			code = http.StatusConflict
+		}
+		httpError(w, code, fmt.Sprintf("%d - failed to add candidates: %v", code, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setWHEPHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PATCH, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, ETag, Link, Accept-Patch, Accept-Post")
+}
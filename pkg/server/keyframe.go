@@ -0,0 +1,185 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// keyframeMinInterval rate-limits the keyframe requests sent upstream,
+	// requests arriving in between are coalesced into one
+	keyframeMinInterval = 500 * time.Millisecond
+)
+
+// keyframeRequester sends keyframe requests for one upstream video track on
+// demand, coalesced and rate-limited, and optionally on a fallback interval
+type keyframeRequester struct {
+	send func()
+
+	lock    sync.Mutex
+	last    time.Time
+	pending *time.Timer
+	stop    chan struct{}
+	closed  bool
+}
+
+// newKeyframeRequester creates a requester calling send. A positive fallback
+// also requests a keyframe on that interval, whether anyone asked or not.
+func newKeyframeRequester(send func(), fallback time.Duration) *keyframeRequester {
+	k := &keyframeRequester{
+		send: send,
+		stop: make(chan struct{}),
+	}
+	if fallback > 0 {
+		go func() {
+			ticker := time.NewTicker(fallback)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					k.request()
+				case <-k.stop:
+					return
+				}
+			}
+		}()
+	}
+	return k
+}
+
+// pliRequester requests keyframes of track from its WHIP publisher with PLIs
+func (s *Server) pliRequester(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, m *publisherMetrics) *keyframeRequester {
+	return newKeyframeRequester(func() {
+		if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+			log.Println(err)
+			return
+		}
+		m.pliSent()
+	}, time.Duration(s.conf.WHIP.PLIInterval)*time.Second)
+}
+
+// request asks for a keyframe, at most once per keyframeMinInterval. It is a
+// no-op on a nil requester, e.g. for audio tracks.
+func (k *keyframeRequester) request() {
+	if k == nil {
+		return
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.closed || k.pending != nil {
+		return
+	}
+	wait := keyframeMinInterval - time.Since(k.last)
+	if wait <= 0 {
+		k.last = time.Now()
+		go k.send()
+		return
+	}
+	k.pending = time.AfterFunc(wait, func() {
+		k.lock.Lock()
+		k.pending = nil
+		closed := k.closed
+		k.last = time.Now()
+		k.lock.Unlock()
+		if !closed {
+			k.send()
+		}
+	})
+}
+
+func (k *keyframeRequester) close() {
+	if k == nil {
+		return
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.closed {
+		return
+	}
+	k.closed = true
+	if k.pending != nil {
+		k.pending.Stop()
+		k.pending = nil
+	}
+	close(k.stop)
+}
+
+// isKeyframeRequest reports whether pkts ask for a keyframe
+func isKeyframeRequest(pkts []rtcp.Packet) bool {
+	for _, pkt := range pkts {
+		switch pkt.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			return true
+		}
+	}
+	return false
+}
+
+// readRTCP reads the RTCP of a subscriber's sender until it is closed, records
+// it in m and passes its keyframe requests on to k. m is closed with the
+// sender.
+func readRTCP(sender *webrtc.RTPSender, k *keyframeRequester, m *subscriberMetrics) {
+	defer m.close()
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		m.observeRTCP(pkts)
+		if isKeyframeRequest(pkts) {
+			k.request()
+		}
+	}
+}
+
+// keyframeTrack passes the keyframe requests a peer connection receives for
+// the track on to a requester. It is published to LiveKit in place of the
+// plain track, whose sender RTCP lksdk does not expose.
+type keyframeTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	keyframes *keyframeRequester
+	// metrics returns the metrics of a binding
+	metrics func() *subscriberMetrics
+}
+
+// Bind implements webrtc.TrackLocal
+func (t *keyframeTrack) Bind(c webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(c)
+	if err != nil {
+		return codec, err
+	}
+	go readKeyframeRequests(c.RTCPReader(), t.keyframes, t.metrics())
+	return codec, nil
+}
+
+// readKeyframeRequests reads r until it is closed. lksdk reads the same
+// sender for its RTT estimate, so each packet reaches only one of the two
+// readers; LiveKit repeats a keyframe request until a keyframe arrives. m is
+// closed with r.
+func readKeyframeRequests(r interceptor.RTCPReader, k *keyframeRequester, m *subscriberMetrics) {
+	defer m.close()
+	buf := make([]byte, 1500)
+	for {
+		i, _, err := r.Read(buf, interceptor.Attributes{})
+		if err != nil {
+			return
+		}
+		pkts, err := rtcp.Unmarshal(buf[:i])
+		if err != nil {
+			continue
+		}
+		m.observeRTCP(pkts)
+		if isKeyframeRequest(pkts) {
+			k.request()
+		}
+	}
+}
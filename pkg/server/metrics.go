@@ -0,0 +1,279 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "whip"
+
+// metrics are the Prometheus metrics of a server. They live in a registry of
+// their own so that embedding applications keep the default one.
+type metrics struct {
+	registry *prometheus.Registry
+
+	packets      *prometheus.CounterVec
+	bytes        *prometheus.CounterVec
+	plisSent     *prometheus.CounterVec
+	plisReceived *prometheus.CounterVec
+	fractionLost *prometheus.HistogramVec
+	jitter       *prometheus.HistogramVec
+	offerAnswer  *prometheus.HistogramVec
+
+	// refs counts the users of a label set, its series are deleted with the
+	// last one
+	lock sync.Mutex
+	refs map[string]int
+}
+
+var (
+	sessionsDesc = prometheus.NewDesc(metricsNamespace+"_sessions",
+		"Active sessions by room and type (publish, subscribe, whep, whep_room).",
+		[]string{"room", "type"}, nil)
+	agentStateDesc = prometheus.NewDesc(metricsNamespace+"_livekit_agent_state",
+		"LiveKit agents by room, participant and connection state, 1 for the current state.",
+		[]string{"room", "participant", "state"}, nil)
+)
+
+func newMetrics(s *Server) *metrics {
+	publisherLabels := []string{"room", "stream", "kind"}
+	subscriberLabels := []string{"room", "stream", "kind", "subscriber"}
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "forwarded_packets_total",
+			Help:      "RTP packets received from publishers and forwarded.",
+		}, publisherLabels),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "forwarded_bytes_total",
+			Help:      "RTP payload bytes received from publishers and forwarded.",
+		}, publisherLabels),
+		plisSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "pli_sent_total",
+			Help:      "Keyframe requests sent to publishers.",
+		}, publisherLabels),
+		plisReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "pli_received_total",
+			Help:      "Keyframe requests received from subscribers by subscriber type (whep, whep_room, subscribe, livekit).",
+		}, subscriberLabels),
+		fractionLost: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscriber_fraction_lost",
+			Help:      "Fraction of packets lost as reported in the receiver reports of subscribers.",
+			Buckets:   []float64{0, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1},
+		}, subscriberLabels),
+		jitter: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscriber_jitter_seconds",
+			Help:      "Interarrival jitter as reported in the receiver reports of subscribers.",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5},
+		}, subscriberLabels),
+		offerAnswer: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "offer_answer_seconds",
+			Help:      "Time from receiving an offer to sending the answer, by session type.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"type"}),
+		refs: make(map[string]int),
+	}
+	m.registry.MustRegister(m.packets, m.bytes, m.plisSent, m.plisReceived, m.fractionLost, m.jitter, m.offerAnswer, &stateCollector{s: s})
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// acquire counts a user of the label set key and returns its release, which
+// calls remove after the last user
+func (m *metrics) acquire(key string, remove func()) func() {
+	m.lock.Lock()
+	m.refs[key]++
+	m.lock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			if m.refs[key]--; m.refs[key] > 0 {
+				return
+			}
+			delete(m.refs, key)
+			remove()
+		})
+	}
+}
+
+// publisher returns the metrics of a published track of stream. Its series
+// are removed once every user released them.
+func (m *metrics) publisher(room, stream string, kind webrtc.RTPCodecType) *publisherMetrics {
+	labels := []string{room, stream, kind.String()}
+	return &publisherMetrics{
+		packets:  m.packets.WithLabelValues(labels...),
+		bytes:    m.bytes.WithLabelValues(labels...),
+		plisSent: m.plisSent.WithLabelValues(labels...),
+		release: m.acquire("publisher\x00"+strings.Join(labels, "\x00"), func() {
+			m.packets.DeleteLabelValues(labels...)
+			m.bytes.DeleteLabelValues(labels...)
+			m.plisSent.DeleteLabelValues(labels...)
+		}),
+	}
+}
+
+// subscriber returns the metrics of a track of stream sent to a subscriber of
+// type typ. Its series are removed once every user released them.
+func (m *metrics) subscriber(room, stream string, kind webrtc.RTPCodecType, typ string, clockRate uint32) *subscriberMetrics {
+	labels := []string{room, stream, kind.String(), typ}
+	return &subscriberMetrics{
+		plisReceived: m.plisReceived.WithLabelValues(labels...),
+		fractionLost: m.fractionLost.WithLabelValues(labels...),
+		jitter:       m.jitter.WithLabelValues(labels...),
+		clockRate:    clockRate,
+		release: m.acquire("subscriber\x00"+strings.Join(labels, "\x00"), func() {
+			m.plisReceived.DeleteLabelValues(labels...)
+			m.fractionLost.DeleteLabelValues(labels...)
+			m.jitter.DeleteLabelValues(labels...)
+		}),
+	}
+}
+
+// publisherMetrics are the metrics of a published track. Its methods are
+// no-ops on nil.
+type publisherMetrics struct {
+	packets  prometheus.Counter
+	bytes    prometheus.Counter
+	plisSent prometheus.Counter
+	release  func()
+}
+
+// forwarded counts a packet received from the publisher
+func (t *publisherMetrics) forwarded(pkt *rtp.Packet) {
+	if t == nil {
+		return
+	}
+	t.packets.Inc()
+	t.bytes.Add(float64(len(pkt.Payload)))
+}
+
+// pliSent counts a keyframe request sent to the publisher
+func (t *publisherMetrics) pliSent() {
+	if t == nil {
+		return
+	}
+	t.plisSent.Inc()
+}
+
+// close releases the series of the track
+func (t *publisherMetrics) close() {
+	if t == nil {
+		return
+	}
+	t.release()
+}
+
+// subscriberMetrics are the metrics of a track sent to a subscriber. Its
+// methods are no-ops on nil.
+type subscriberMetrics struct {
+	plisReceived prometheus.Counter
+	fractionLost prometheus.Observer
+	jitter       prometheus.Observer
+	clockRate    uint32
+	release      func()
+}
+
+// observeRTCP records the receiver reports and keyframe requests of a
+// subscriber
+func (t *subscriberMetrics) observeRTCP(pkts []rtcp.Packet) {
+	if t == nil {
+		return
+	}
+	for _, pkt := range pkts {
+		switch pkt := pkt.(type) {
+		case *rtcp.ReceiverReport:
+			for _, r := range pkt.Reports {
+				t.fractionLost.Observe(float64(r.FractionLost) / 256)
+				if t.clockRate > 0 {
+					t.jitter.Observe(float64(r.Jitter) / float64(t.clockRate))
+				}
+			}
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			t.plisReceived.Inc()
+		}
+	}
+}
+
+// close releases the series of the track
+func (t *subscriberMetrics) close() {
+	if t == nil {
+		return
+	}
+	t.release()
+}
+
+// localTrackMetrics returns the metrics of a track sent to a subscriber of
+// type typ
+func (s *Server) localTrackMetrics(room, stream, typ string, track webrtc.TrackLocal) *subscriberMetrics {
+	var clockRate uint32
+	switch t := track.(type) {
+	case *webrtc.TrackLocalStaticRTP:
+		clockRate = t.Codec().ClockRate
+	case *gopTrack:
+		clockRate = t.cache.codec.ClockRate
+	}
+	return s.metrics.subscriber(room, stream, track.Kind(), typ, clockRate)
+}
+
+// stateCollector reports the sessions and LiveKit agents as they are at
+// scrape time
+type stateCollector struct {
+	s *Server
+}
+
+// Describe implements prometheus.Collector
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+	ch <- agentStateDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	type sessionKey struct{ room, typ string }
+	sessions := make(map[sessionKey]int)
+	c.s.listLock.RLock()
+	for _, state := range c.s.conns {
+		sessions[sessionKey{state.room, state.sessionType()}]++
+	}
+	c.s.listLock.RUnlock()
+	for key, n := range sessions {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(n), key.room, key.typ)
+	}
+
+	c.s.agentsLock.Lock()
+	agents := make([]*roomAgent, 0, len(c.s.rtcAgents))
+	for _, a := range c.s.rtcAgents {
+		agents = append(agents, a)
+	}
+	c.s.agentsLock.Unlock()
+	for _, a := range agents {
+		current := a.state()
+		for _, state := range []string{"connected", "connecting", "disconnected"} {
+			value := 0.0
+			if state == current {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(agentStateDesc, prometheus.GaugeValue, value, a.room, a.participant.Identity, state)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/fmp4"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// recordFormatMP4 muxes the tracks of a stream into one fragmented MP4
+	recordFormatMP4 = "mp4"
+
+	// mp4StartWait is how long a muxer waits for every track of the stream
+	// and their sender reports before it starts with the tracks it has
+	mp4StartWait = 3 * time.Second
+	// mp4FragmentDuration bounds a recorded fragment when no keyframe starts
+	// a new one
+	mp4FragmentDuration = 2 * time.Second
+	// mp4MaxPending bounds the samples a track keeps while the muxer waits to
+	// start
+	mp4MaxPending = 1000
+)
+
+// mp4Sink takes the output of an mp4Muxer. Its methods are called with the
+// muxer's lock held.
+type mp4Sink interface {
+	// start begins the output with the init segment of tracks
+	start(init []byte, tracks []*fmp4.Track) error
+	// fragment takes the next movie fragment, duration long. boundary is set
+	// when the next fragment starts with a video keyframe, or always without
+	// video, so that the output can be split after it.
+	fragment(data []byte, duration time.Duration, boundary bool) error
+	// close ends the output
+	close() error
+}
+
+// mp4Muxers holds the muxers of one use, recording or HLS, by room and stream
+type mp4Muxers struct {
+	// codecs are the codecs the sinks take
+	codecs []fmp4.Codec
+	// fragmentDuration bounds a fragment when no keyframe starts a new one
+	fragmentDuration time.Duration
+	newSink          func(m *mp4Muxer, state *whipState) mp4Sink
+
+	lock   sync.Mutex
+	muxers map[string]*mp4Muxer
+}
+
+// mp4Muxer muxes the tracks of a published stream into fragmented MP4 for its
+// sink. It starts at a video keyframe once every track of the stream has its
+// codec configuration, and places the tracks on one timeline with their RTCP
+// sender reports, or their arrival times when a track has none. It is
+// reference counted by its tracks.
+type mp4Muxer struct {
+	muxers   *mp4Muxers
+	key      string
+	stream   string
+	expected map[webrtc.RTPCodecType]bool
+	sink     mp4Sink
+
+	lock        sync.Mutex
+	refs        int
+	tracks      []*mp4Track
+	firstPacket time.Time
+	started     bool
+	closed      bool
+	// video is set when the output has a video track, it is then split at
+	// keyframes only
+	video bool
+	// bySR is set when the timeline comes from the sender reports
+	bySR bool
+	// t0 is the time of the timeline's origin
+	t0  time.Time
+	seq uint32
+}
+
+// mp4Track is a track of an mp4Muxer, it implements media.Writer
+type mp4Track struct {
+	m         *mp4Muxer
+	kind      webrtc.RTPCodecType
+	clockRate uint32
+	sampler   *rtpSampler
+
+	// the sync references from the first packet and the last sender report
+	hasArrival bool
+	arrival    time.Time
+	arrivalTS  uint32
+	hasSR      bool
+	srTime     time.Time
+	srTS       uint32
+
+	// pending holds the samples received before the muxer started
+	pending []*mediaSample
+
+	// track is set when the track is part of the output
+	track *fmp4.Track
+	begun bool
+	// held is the last sample, its duration is known once the next arrives
+	held    *mediaSample
+	heldDTS uint64
+	lastTS  uint32
+	lastDur uint32
+	// samples wait for the next fragment, which starts at fragmentDTS
+	samples     []fmp4.Sample
+	fragmentDTS uint64
+	// baseDTS is the timeline position the fragment times count from
+	baseDTS uint64
+}
+
+// newMP4Muxers makes a registry of muxers of codecs
+func newMP4Muxers(codecs []fmp4.Codec, fragmentDuration time.Duration, newSink func(m *mp4Muxer, state *whipState) mp4Sink) *mp4Muxers {
+	return &mp4Muxers{
+		codecs:           codecs,
+		fragmentDuration: fragmentDuration,
+		newSink:          newSink,
+		muxers:           make(map[string]*mp4Muxer),
+	}
+}
+
+// supports tells whether codec can be muxed
+func (ms *mp4Muxers) supports(codec webrtc.RTPCodecCapability) (fmp4.Codec, bool) {
+	c, ok := fmp4Codec(codec)
+	if !ok {
+		return c, false
+	}
+	for _, supported := range ms.codecs {
+		if c == supported {
+			return c, true
+		}
+	}
+	return c, false
+}
+
+// get returns the muxer of room and stream, nil when there is none
+func (ms *mp4Muxers) get(room, stream string) *mp4Muxer {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.muxers[room+"/"+stream]
+}
+
+// addTrack adds a track of state to the muxer of its stream, it returns nil
+// when the codec cannot be muxed
+func (ms *mp4Muxers) addTrack(state *whipState, codec webrtc.RTPCodecParameters) *mp4Track {
+	c, ok := ms.supports(codec.RTPCodecCapability)
+	if !ok {
+		return nil
+	}
+	kind := webrtc.RTPCodecTypeAudio
+	if c.IsVideo() {
+		kind = webrtc.RTPCodecTypeVideo
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	key := state.room + "/" + state.stream
+	m := ms.muxers[key]
+	if m != nil && m.hasTrack(kind) {
+		// a publisher back with another codec starts anew, the old muxer
+		// ends with its last track
+		delete(ms.muxers, key)
+		m = nil
+	}
+	if m == nil {
+		m = &mp4Muxer{
+			muxers:   ms,
+			key:      key,
+			stream:   state.stream,
+			expected: make(map[webrtc.RTPCodecType]bool),
+		}
+		// the publisher may send any codec of the offer, so every kind of it
+		// the muxer takes is waited for
+		for kind, offered := range state.offered {
+			if _, ok := ms.supports(offered); ok {
+				m.expected[kind] = true
+			}
+		}
+		m.sink = ms.newSink(m, state)
+		ms.muxers[key] = m
+	}
+
+	t := &mp4Track{m: m, kind: kind, clockRate: codec.ClockRate, sampler: newRTPSampler(c, codec.RTPCodecCapability)}
+	m.lock.Lock()
+	m.refs++
+	m.tracks = append(m.tracks, t)
+	m.lock.Unlock()
+	return t
+}
+
+func (m *mp4Muxer) hasTrack(kind webrtc.RTPCodecType) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, t := range m.tracks {
+		if t.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteRTP implements media.Writer
+func (t *mp4Track) WriteRTP(pkt *rtp.Packet) error {
+	now := time.Now()
+	m := t.m
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	samples := t.sampler.push(pkt)
+	if m.firstPacket.IsZero() {
+		m.firstPacket = now
+	}
+	if !t.hasArrival {
+		t.hasArrival = true
+		t.arrival = now
+		t.arrivalTS = pkt.Timestamp
+	}
+	for _, sample := range samples {
+		if err := m.add(t, sample); err != nil {
+			m.fail(err)
+			return nil
+		}
+	}
+	if !m.started {
+		m.tryStart()
+	}
+	return nil
+}
+
+// senderReport takes the sync reference of an RTCP sender report
+func (t *mp4Track) senderReport(ntp time.Time, rtpTime uint32) {
+	t.m.lock.Lock()
+	defer t.m.lock.Unlock()
+	t.hasSR = true
+	t.srTime = ntp
+	t.srTS = rtpTime
+}
+
+// Close implements media.Writer, the output ends with the last track
+func (t *mp4Track) Close() error {
+	m := t.m
+	m.muxers.lock.Lock()
+	m.lock.Lock()
+	m.refs--
+	last := m.refs == 0
+	if last && m.muxers.muxers[m.key] == m {
+		delete(m.muxers.muxers, m.key)
+	}
+	m.muxers.lock.Unlock()
+	defer m.lock.Unlock()
+
+	if !last || m.closed {
+		return nil
+	}
+	m.closed = true
+	if !m.started {
+		return m.sink.close()
+	}
+	// the last samples last as long as the ones before them
+	for _, t := range m.tracks {
+		if t.track != nil && t.held != nil {
+			t.push(t.lastDur)
+		}
+	}
+	err := m.writeFragment(false)
+	if cerr := m.sink.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// add takes a sample of t, m.lock must be held
+func (m *mp4Muxer) add(t *mp4Track, sample *mediaSample) error {
+	if !m.started {
+		if t.kind == webrtc.RTPCodecTypeVideo && sample.keyframe {
+			t.pending = t.pending[:0]
+		}
+		if t.kind == webrtc.RTPCodecTypeAudio || len(t.pending) > 0 || sample.keyframe {
+			t.pending = append(t.pending, sample)
+		}
+		if len(t.pending) > mp4MaxPending {
+			if t.kind == webrtc.RTPCodecTypeVideo {
+				t.pending = nil
+			} else {
+				t.pending = t.pending[1:]
+			}
+		}
+		return nil
+	}
+	if t.track == nil {
+		return nil
+	}
+
+	if !t.begun {
+		offset := m.refTime(t, sample.timestamp).Sub(m.t0)
+		if offset < 0 {
+			// before the start of the output
+			return nil
+		}
+		t.begun = true
+		t.held = sample
+		t.heldDTS = uint64(offset.Seconds()*float64(t.clockRate) + 0.5)
+		t.lastTS = sample.timestamp
+		return nil
+	}
+
+	duration := sample.timestamp - t.lastTS
+	if int32(duration) <= 0 {
+		// reordered or repeated
+		return nil
+	}
+	if duration > t.clockRate*10 && t.lastDur > 0 {
+		// a jump in the timestamps is taken as one frame
+		duration = t.lastDur
+	}
+	t.push(duration)
+	t.held = sample
+	t.lastTS = sample.timestamp
+
+	if t.kind == webrtc.RTPCodecTypeVideo && sample.keyframe {
+		return m.writeFragment(true)
+	}
+	for _, t := range m.tracks {
+		if t.track != nil && len(t.samples) > 0 && t.dtsDuration(t.heldDTS-t.fragmentDTS) >= m.muxers.fragmentDuration {
+			return m.writeFragment(!m.video)
+		}
+	}
+	return nil
+}
+
+// push moves the held sample of t to the next fragment
+func (t *mp4Track) push(duration uint32) {
+	if duration == 0 {
+		duration = t.clockRate / 30
+	}
+	if len(t.samples) == 0 {
+		t.fragmentDTS = t.heldDTS
+	}
+	t.samples = append(t.samples, fmp4.Sample{Duration: duration, Keyframe: t.held.keyframe, Data: t.held.data})
+	t.heldDTS += uint64(duration)
+	t.lastDur = duration
+	t.held = nil
+}
+
+// dtsDuration converts a duration in units of the track's clock
+func (t *mp4Track) dtsDuration(dts uint64) time.Duration {
+	return time.Duration(dts) * time.Second / time.Duration(t.clockRate)
+}
+
+// refTime is the time of an RTP timestamp of t
+func (m *mp4Muxer) refTime(t *mp4Track, ts uint32) time.Time {
+	base, baseTS := t.arrival, t.arrivalTS
+	if m.bySR {
+		base, baseTS = t.srTime, t.srTS
+	}
+	return base.Add(time.Duration(int32(ts-baseTS)) * time.Second / time.Duration(t.clockRate))
+}
+
+// tryStart starts the output once the tracks are ready, m.lock must be held
+func (m *mp4Muxer) tryStart() {
+	var ready []*mp4Track
+	var video *mp4Track
+	kinds := make(map[webrtc.RTPCodecType]bool)
+	allSR := true
+	for _, t := range m.tracks {
+		if !t.sampler.configured || len(t.pending) == 0 {
+			continue
+		}
+		ready = append(ready, t)
+		kinds[t.kind] = true
+		allSR = allSR && t.hasSR
+		if t.kind == webrtc.RTPCodecTypeVideo {
+			video = t
+		}
+	}
+
+	complete := len(ready) > 0
+	for kind := range m.expected {
+		complete = complete && kinds[kind]
+	}
+	waited := time.Since(m.firstPacket)
+	switch {
+	case complete && allSR:
+	case len(ready) == 0 || waited < mp4StartWait:
+		return
+	case video == nil && m.expected[webrtc.RTPCodecTypeVideo] && waited < 3*mp4StartWait:
+		// the video is worth waiting a little longer for
+		return
+	}
+
+	m.bySR = allSR
+	anchor := ready[0]
+	if video != nil {
+		anchor = video
+	}
+	m.t0 = m.refTime(anchor, anchor.pending[0].timestamp)
+
+	var id uint32
+	for _, t := range ready {
+		id++
+		track := t.sampler.track
+		track.ID = id
+		t.track = &track
+	}
+	m.started = true
+	m.video = video != nil
+	init, err := fmp4.Init(m.outputTracks())
+	if err == nil {
+		err = m.sink.start(init, m.outputTracks())
+	}
+	if err != nil {
+		m.fail(err)
+		return
+	}
+
+	for _, t := range ready {
+		pending := t.pending
+		t.pending = nil
+		for _, sample := range pending {
+			if err := m.add(t, sample); err != nil {
+				m.fail(err)
+				return
+			}
+		}
+	}
+	for _, t := range m.tracks {
+		t.pending = nil
+	}
+}
+
+// outputTracks returns the tracks that are part of the output
+func (m *mp4Muxer) outputTracks() []*fmp4.Track {
+	var tracks []*fmp4.Track
+	for _, t := range m.tracks {
+		if t.track != nil {
+			tracks = append(tracks, t.track)
+		}
+	}
+	return tracks
+}
+
+// restart begins a new output, e.g. a new file: the fragments are numbered
+// from 1 again and the times count from the earliest of the held samples, so
+// that every track keeps its place on the timeline. It returns the init
+// segment. m.lock must be held.
+func (m *mp4Muxer) restart() ([]byte, error) {
+	start := time.Duration(-1)
+	for _, t := range m.tracks {
+		if t.track == nil || t.held == nil {
+			continue
+		}
+		if at := t.dtsDuration(t.heldDTS); start < 0 || at < start {
+			start = at
+		}
+	}
+	if start >= 0 {
+		for _, t := range m.tracks {
+			if t.track != nil {
+				t.baseDTS = uint64(start.Seconds() * float64(t.clockRate))
+			}
+		}
+	}
+	m.seq = 0
+	return fmp4.Init(m.outputTracks())
+}
+
+// writeFragment passes the samples waiting in the tracks to the sink as a
+// fragment, m.lock must be held
+func (m *mp4Muxer) writeFragment(boundary bool) error {
+	var fragments []fmp4.Fragment
+	var duration time.Duration
+	for _, t := range m.tracks {
+		if t.track == nil || len(t.samples) == 0 {
+			continue
+		}
+		base := uint64(0)
+		if t.fragmentDTS > t.baseDTS {
+			base = t.fragmentDTS - t.baseDTS
+		}
+		fragments = append(fragments, fmp4.Fragment{Track: t.track, BaseTime: base, Samples: t.samples})
+		if d := t.dtsDuration(t.heldDTS - t.fragmentDTS); d > duration {
+			duration = d
+		}
+		t.samples = nil
+	}
+	if len(fragments) == 0 {
+		return nil
+	}
+
+	m.seq++
+	return m.sink.fragment(fmp4.MediaSegment(m.seq, fragments), duration, boundary)
+}
+
+// fail stops the muxer after an error, m.lock must be held
+func (m *mp4Muxer) fail(err error) {
+	log.Printf("muxing %v stopped: %v", m.stream, err)
+	m.closed = true
+	m.sink.close()
+}
+
+// newMP4TrackRecorder adds a track of state to the MP4 recording of its
+// stream, it returns nil when the codec cannot be muxed
+func (s *Server) newMP4TrackRecorder(state *whipState, codec webrtc.RTPCodecParameters) *trackRecorder {
+	t := s.recordings.addTrack(state, codec)
+	if t == nil {
+		log.Printf("recording %v to mp4 is not supported, track of %v not recorded", codec.MimeType, state.stream)
+		return nil
+	}
+	rec := t.m.sink.(*mp4Recording)
+	log.Printf("recording %v of %v to mp4 in %v", codec.MimeType, state.stream, rec.dir)
+	return &trackRecorder{path: fmt.Sprintf("%v of %v", codec.MimeType, filepath.Join(rec.dir, recordingName(state.stream))), writer: t}
+}
+
+// mp4Recording writes the output of a muxer to files. A file rolls over at a
+// boundary when it reaches record_max_size or record_max_duration.
+type mp4Recording struct {
+	m           *mp4Muxer
+	dir         string
+	stream      string
+	maxSize     int64
+	maxDuration time.Duration
+
+	tracks    []*fmp4.Track
+	file      *os.File
+	path      string
+	size      int64
+	fileStart time.Time
+}
+
+func (s *Server) newMP4Recording(m *mp4Muxer, state *whipState) mp4Sink {
+	dir := s.conf.WHIP.RecordDir
+	if dir == "" {
+		dir = defaultRecordDir
+	}
+	return &mp4Recording{
+		m:           m,
+		dir:         filepath.Join(dir, recordingName(state.room)),
+		stream:      state.stream,
+		maxSize:     int64(s.conf.WHIP.RecordMaxSize) << 20,
+		maxDuration: time.Duration(s.conf.WHIP.RecordMaxDuration) * time.Second,
+	}
+}
+
+func (r *mp4Recording) start(init []byte, tracks []*fmp4.Track) error {
+	r.tracks = tracks
+	return r.openFile(init)
+}
+
+func (r *mp4Recording) fragment(data []byte, duration time.Duration, boundary bool) error {
+	if r.file == nil {
+		return nil
+	}
+	if _, err := r.file.Write(data); err != nil {
+		return err
+	}
+	r.size += int64(len(data))
+
+	if !boundary {
+		return nil
+	}
+	if (r.maxSize <= 0 || r.size < r.maxSize) && (r.maxDuration <= 0 || time.Since(r.fileStart) < r.maxDuration) {
+		return nil
+	}
+	init, err := r.m.restart()
+	if err != nil {
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		log.Printf("failed to close recording %v: %v", r.path, err)
+	}
+	log.Printf("recording %v rolled over", r.path)
+	return r.openFile(init)
+}
+
+func (r *mp4Recording) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	log.Printf("recording %v finished", r.path)
+	return err
+}
+
+// openFile starts a file named after the stream and the current time with
+// the init segment
+func (r *mp4Recording) openFile(init []byte) error {
+	r.file = nil
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+
+	r.fileStart = time.Now()
+	name := recordingName(r.stream) + "-" + r.fileStart.UTC().Format(recordingTimeFormat)
+	path := filepath.Join(r.dir, name+".mp4")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(r.dir, fmt.Sprintf("%v-%v.mp4", name, i))
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(init); err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.path = path
+	r.size = int64(len(init))
+	log.Printf("recording %v of %v to %v", fmp4TrackNames(r.tracks), r.stream, path)
+	return nil
+}
+
+func fmp4TrackNames(tracks []*fmp4.Track) string {
+	names := ""
+	for i, t := range tracks {
+		if i > 0 {
+			names += "+"
+		}
+		names += t.Codec.String()
+	}
+	return names
+}
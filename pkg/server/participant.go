@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/url"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/auth"
+)
+
+const (
+	// sharedParticipantIdentity publishes every WHIP stream of a room when
+	// participant_per_publisher is off
+	sharedParticipantIdentity = "whip-bot"
+)
+
+// participantInfo is the LiveKit participant a WHIP publisher shows up as
+type participantInfo struct {
+	Identity string
+	Name     string
+	Metadata string
+}
+
+// publisherParticipant derives the participant of a publish session from the
+// query of its url. In the shared mode all publishers of a room use
+// "whip-bot". Otherwise the stream id is the default identity and name,
+// overridden by the "identity", "name" and "metadata" query parameters, which
+// are in turn overridden by the token claims when auth is enabled.
+func (s *Server) publisherParticipant(query url.Values, stream string, claims *auth.Claims) participantInfo {
+	if !s.conf.WHIP.ParticipantPerPublisher {
+		return participantInfo{Identity: sharedParticipantIdentity}
+	}
+
+	p := participantInfo{Identity: stream, Name: stream}
+
+	if v := query.Get("identity"); v != "" {
+		p.Identity = v
+	}
+	if v := query.Get("name"); v != "" {
+		p.Name = v
+	}
+	if v := query.Get("metadata"); v != "" {
+		p.Metadata = v
+	}
+
+	if claims != nil {
+		if claims.Identity != "" {
+			p.Identity = claims.Identity
+		}
+		if claims.Name != "" {
+			p.Name = claims.Name
+		}
+		if claims.Metadata != "" {
+			p.Metadata = claims.Metadata
+		}
+	}
+	return p
+}
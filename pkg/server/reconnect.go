@@ -0,0 +1,325 @@
+package server
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// publisherReconnectGrace is how long the local track and the LiveKit
+	// publication of a track outlive its publisher, waiting for it to come back
+	publisherReconnectGrace = 10 * time.Second
+)
+
+// trackSource is a published track as it arrives, a *webrtc.TrackRemote of a
+// WHIP publisher or an RTP/UDP stream
+type trackSource interface {
+	ID() string
+	StreamID() string
+	Kind() webrtc.RTPCodecType
+	Codec() webrtc.RTPCodecParameters
+	SSRC() webrtc.SSRC
+}
+
+// rtcpWriter sends RTCP to the publisher of a trackSource, e.g. its
+// *webrtc.PeerConnection
+type rtcpWriter interface {
+	WriteRTCP(pkts []rtcp.Packet) error
+}
+
+// publishedTrack is a track published over WHIP as the subscribers and LiveKit
+// see it. A publisher reconnecting to the same room and stream within
+// publisherReconnectGrace continues it: its packets are renumbered to follow
+// the previous ones, so downstream decoders do not notice the switch.
+type publishedTrack struct {
+	s           *Server
+	key         string
+	participant participantInfo
+	local       *webrtc.TrackLocalStaticRTP
+	lkTrack     webrtc.TrackLocal
+	gop         *gopCache
+	keyframes   *keyframeRequester
+	agent       *roomAgent
+	metrics     *publisherMetrics
+	recorder    *trackRecorder
+	hls         *mp4Track
+
+	lock     sync.Mutex
+	state    *whipState
+	pc       rtcpWriter
+	source   trackSource
+	timer    *time.Timer
+	finished bool
+	// rebase is set when source changed, the offsets are computed from its
+	// first packet
+	rebase    bool
+	started   bool
+	lastSeq   uint16
+	lastTS    uint32
+	lastTime  time.Time
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+// publishedTrackKey identifies the published track of a kind of a stream
+func publishedTrackKey(state *whipState, kind webrtc.RTPCodecType) string {
+	return state.room + "/" + state.stream + "/" + kind.String()
+}
+
+// claimTrack returns the published track for track of state's publisher,
+// continuing the one its previous connection left behind when it matches
+func (s *Server) claimTrack(state *whipState, pc rtcpWriter, track trackSource) *publishedTrack {
+	key := publishedTrackKey(state, track.Kind())
+	agent := s.acquireAgent(state.room, state.participant)
+
+	s.listLock.Lock()
+	if p, ok := s.published[key]; ok {
+		if p.takeOver(state, pc, track) {
+			s.attachTrack(state, p.local, p.keyframes, p.gop)
+			s.listLock.Unlock()
+			s.releaseAgent(agent)
+			log.Printf("publisher of %v resumed its %v track", state.stream, track.Kind())
+			p.keyframes.request()
+			return p
+		}
+		// another codec or participant cannot continue the old track
+		delete(s.published, key)
+		defer p.finish()
+	}
+
+	p := &publishedTrack{
+		s:           s,
+		key:         key,
+		participant: state.participant,
+		agent:       agent,
+		state:       state,
+		pc:          pc,
+		source:      track,
+		metrics:     s.metrics.publisher(state.room, state.stream, track.Kind()),
+	}
+	if state.record {
+		p.recorder = s.newTrackRecorder(state, track.Codec())
+	}
+	p.hls = s.newHLSTrack(state, track.Codec())
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		p.keyframes = newKeyframeRequester(p.requestKeyframe, time.Duration(s.conf.WHIP.PLIInterval)*time.Second)
+	}
+	p.local, p.gop = s.newLocalTrack(track)
+	// LiveKit's keyframe requests arrive on the RTCP of the published track.
+	// It is set before p is shared, finish reads it.
+	p.lkTrack = p.local
+	if p.keyframes != nil {
+		room, stream, clockRate := state.room, state.stream, track.Codec().ClockRate
+		p.lkTrack = &keyframeTrack{TrackLocalStaticRTP: p.local, keyframes: p.keyframes, metrics: func() *subscriberMetrics {
+			return s.metrics.subscriber(room, stream, webrtc.RTPCodecTypeVideo, "livekit", clockRate)
+		}}
+	}
+	s.attachTrack(state, p.local, p.keyframes, p.gop)
+	s.published[key] = p
+	s.listLock.Unlock()
+
+	// LiveKit publishing runs in the background so that a slow or unreachable
+	// LiveKit server never holds up the local subscribers
+	agent.publish(p.lkTrack, lksdk.TrackPublicationOptions{Name: state.stream})
+	return p
+}
+
+// takeOver switches p to the track of a reconnected publisher. It fails when
+// the track cannot continue p. s.listLock must be held.
+func (p *publishedTrack) takeOver(state *whipState, pc rtcpWriter, track trackSource) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	codec := track.Codec().RTPCodecCapability
+	if p.finished || p.participant.Identity != state.participant.Identity ||
+		!strings.EqualFold(p.local.Codec().MimeType, codec.MimeType) || p.local.Codec().ClockRate != codec.ClockRate {
+		return false
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.state = state
+	p.pc = pc
+	p.source = track
+	p.rebase = true
+	return true
+}
+
+// write forwards a packet of source. It returns false once source is no
+// longer the publisher of p.
+func (p *publishedTrack) write(source trackSource, pkt *rtp.Packet) bool {
+	p.lock.Lock()
+	if p.source != source {
+		p.lock.Unlock()
+		return false
+	}
+	if p.rebase {
+		p.rebase = false
+		if p.started {
+			// continue one frame interval or the time elapsed after the last packet
+			elapsed := uint32(time.Since(p.lastTime).Seconds() * float64(p.local.Codec().ClockRate))
+			if elapsed == 0 {
+				elapsed = 1
+			}
+			p.seqOffset = p.lastSeq + 1 - pkt.SequenceNumber
+			p.tsOffset = p.lastTS + elapsed - pkt.Timestamp
+		}
+	}
+	p.metrics.forwarded(pkt)
+	out := *pkt
+	out.SequenceNumber += p.seqOffset
+	out.Timestamp += p.tsOffset
+	p.started = true
+	p.lastSeq = out.SequenceNumber
+	p.lastTS = out.Timestamp
+	p.lastTime = time.Now()
+	p.lock.Unlock()
+
+	if err := p.local.WriteRTP(&out); err != nil {
+		return false
+	}
+	if p.gop != nil {
+		p.gop.write(&out)
+	}
+	p.recorder.write(&out)
+	if p.hls != nil {
+		p.hls.WriteRTP(&out)
+	}
+	return true
+}
+
+// readSenderReports reads the sender reports of source from its receiver
+func (p *publishedTrack) readSenderReports(source *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	for {
+		pkts, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok {
+				p.senderReport(source, sr)
+			}
+		}
+	}
+}
+
+// senderReport passes a sender report of source to the recorder and the HLS
+// stream, its RTP time shifted like the packets
+func (p *publishedTrack) senderReport(source trackSource, sr *rtcp.SenderReport) {
+	if sr.SSRC != uint32(source.SSRC()) {
+		return
+	}
+	p.lock.Lock()
+	current := p.source == source && !p.rebase
+	rtpTime := sr.RTPTime + p.tsOffset
+	p.lock.Unlock()
+	if !current {
+		return
+	}
+	p.recorder.senderReport(ntpTime(sr.NTPTime), rtpTime)
+	if p.hls != nil {
+		p.hls.senderReport(ntpTime(sr.NTPTime), rtpTime)
+	}
+}
+
+// ntpTime converts a 64 bit NTP timestamp
+func ntpTime(ntp uint64) time.Time {
+	const ntpEpochOffset = 2208988800 // seconds from 1900 to 1970
+	secs := int64(ntp>>32) - ntpEpochOffset
+	nanos := int64((ntp & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
+
+// requestKeyframe asks the current publisher for a keyframe
+func (p *publishedTrack) requestKeyframe() {
+	p.lock.Lock()
+	pc, source := p.pc, p.source
+	p.lock.Unlock()
+
+	if pc == nil {
+		return
+	}
+	if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(source.SSRC())}}); err != nil {
+		log.Println(err)
+		return
+	}
+	p.metrics.pliSent()
+}
+
+// releaseTrack is called when source ends. Unless a reconnected publisher took p
+// over already, p is kept for publisherReconnectGrace, or finished right away
+// when the server is shutting down.
+func (s *Server) releaseTrack(p *publishedTrack, source trackSource) {
+	s.listLock.RLock()
+	closed := s.closed
+	s.listLock.RUnlock()
+
+	p.lock.Lock()
+	if p.source != source {
+		p.lock.Unlock()
+		return
+	}
+	p.pc = nil
+	p.source = nil
+	if !closed {
+		p.timer = time.AfterFunc(publisherReconnectGrace, func() { s.expireTrack(p) })
+		p.lock.Unlock()
+		return
+	}
+	p.lock.Unlock()
+	s.expireTrack(p)
+}
+
+// expireTrack finishes p unless it was taken over in the meantime
+func (s *Server) expireTrack(p *publishedTrack) {
+	s.listLock.Lock()
+	p.lock.Lock()
+	if p.source != nil || p.finished {
+		p.lock.Unlock()
+		s.listLock.Unlock()
+		return
+	}
+	p.lock.Unlock()
+	if s.published[p.key] == p {
+		delete(s.published, p.key)
+	}
+	s.listLock.Unlock()
+
+	p.finish()
+}
+
+// finish removes the local track and unpublishes it from LiveKit
+func (p *publishedTrack) finish() {
+	p.lock.Lock()
+	if p.finished {
+		p.lock.Unlock()
+		return
+	}
+	p.finished = true
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	state := p.state
+	p.lock.Unlock()
+
+	p.s.removeTrack(state, p.local)
+	p.keyframes.close()
+	p.recorder.close()
+	if p.hls != nil {
+		p.hls.Close()
+	}
+	p.metrics.close()
+	if p.lkTrack != nil {
+		p.agent.unpublish(state.stream, p.lkTrack)
+	}
+	p.s.releaseAgent(p.agent)
+}
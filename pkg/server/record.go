@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// defaultRecordDir is where recordings go when record_dir is not set
+const defaultRecordDir = "recordings"
+
+// recordingTimeFormat is the start time in the recording file names
+const recordingTimeFormat = "20060102T150405Z"
+
+// recordRequested tells whether a publish session records its tracks, the
+// "record" query parameter overrides the record setting
+func (s *Server) recordRequested(r *http.Request) bool {
+	if v := r.URL.Query().Get("record"); v != "" {
+		if record, err := strconv.ParseBool(v); err == nil {
+			return record
+		}
+		log.Printf("invalid record parameter %q ignored", v)
+	}
+	return s.conf.WHIP.Record
+}
+
+// trackRecorder writes the packets of a published track to a file. Its
+// methods are no-ops on nil.
+type trackRecorder struct {
+	path string
+
+	lock   sync.Mutex
+	writer media.Writer
+}
+
+// newTrackRecorder opens the recording of a track of state, named after the
+// room, the stream and the session start time. It returns nil when the codec
+// cannot be recorded or the file cannot be created.
+func (s *Server) newTrackRecorder(state *whipState, codec webrtc.RTPCodecParameters) *trackRecorder {
+	if strings.EqualFold(s.conf.WHIP.RecordFormat, recordFormatMP4) {
+		return s.newMP4TrackRecorder(state, codec)
+	}
+
+	var ext string
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9):
+		ext = ".ivf"
+	case strings.ToLower(webrtc.MimeTypeH264):
+		ext = ".h264"
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		ext = ".ogg"
+	default:
+		log.Printf("recording %v is not supported, track of %v not recorded", codec.MimeType, state.stream)
+		return nil
+	}
+
+	dir := s.conf.WHIP.RecordDir
+	if dir == "" {
+		dir = defaultRecordDir
+	}
+	dir = filepath.Join(dir, recordingName(state.room))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("failed to create recording directory %v: %v", dir, err)
+		return nil
+	}
+	path := filepath.Join(dir, recordingName(state.stream)+"-"+state.created.UTC().Format(recordingTimeFormat)+ext)
+
+	var writer media.Writer
+	var err error
+	switch ext {
+	case ".ivf":
+		if strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9) {
+			writer, err = newVP9Writer(path, codec.ClockRate)
+		} else {
+			writer, err = ivfwriter.New(path)
+		}
+	case ".h264":
+		writer, err = h264writer.New(path)
+	case ".ogg":
+		writer, err = oggwriter.New(path, codec.ClockRate, codec.Channels)
+	}
+	if err != nil {
+		log.Printf("failed to create recording %v: %v", path, err)
+		return nil
+	}
+	log.Printf("recording %v of %v to %v", codec.MimeType, state.stream, path)
+	return &trackRecorder{path: path, writer: writer}
+}
+
+// recordingName makes a room or stream name safe to use as a file name
+func recordingName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(safe, ".") == "" {
+		return strings.Repeat("_", len(safe)+1)
+	}
+	return safe
+}
+
+// write records a packet, the recording stops at the first write error
+func (t *trackRecorder) write(pkt *rtp.Packet) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.writer == nil {
+		return
+	}
+	if err := t.writer.WriteRTP(pkt); err != nil {
+		log.Printf("recording %v stopped: %v", t.path, err)
+		t.writer.Close()
+		t.writer = nil
+	}
+}
+
+// senderReport passes the sync reference of an RTCP sender report to the
+// writers that use one
+func (t *trackRecorder) senderReport(ntp time.Time, rtpTime uint32) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if w, ok := t.writer.(interface{ senderReport(time.Time, uint32) }); ok {
+		w.senderReport(ntp, rtpTime)
+	}
+}
+
+// close finishes the recording
+func (t *trackRecorder) close() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.writer == nil {
+		return
+	}
+	if err := t.writer.Close(); err != nil {
+		log.Printf("failed to close recording %v: %v", t.path, err)
+	}
+	t.writer = nil
+	log.Printf("recording %v finished", t.path)
+}
+
+// vp9Writer writes VP9 to an IVF file, which pion's ivfwriter does not
+// support. The frames are timestamped in units of the RTP clock.
+type vp9Writer struct {
+	file *os.File
+
+	started bool
+	firstTS uint32
+	count   uint32
+	frame   []byte
+}
+
+func newVP9Writer(path string, clockRate uint32) (*vp9Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)  // version
+	binary.LittleEndian.PutUint16(header[6:], 32) // header size
+	copy(header[8:], "VP90")
+	binary.LittleEndian.PutUint16(header[12:], 640) // width, the decoder reads the real one
+	binary.LittleEndian.PutUint16(header[14:], 480) // height
+	binary.LittleEndian.PutUint32(header[16:], clockRate)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	// header[24:28] is the frame count, written by Close
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &vp9Writer{file: file}, nil
+}
+
+// WriteRTP implements media.Writer. Frames before the first keyframe are
+// dropped.
+func (w *vp9Writer) WriteRTP(pkt *rtp.Packet) error {
+	if w.file == nil {
+		return fmt.Errorf("vp9 recording is closed")
+	}
+	if len(pkt.Payload) == 0 {
+		return nil
+	}
+
+	vp9 := codecs.VP9Packet{}
+	if _, err := vp9.Unmarshal(pkt.Payload); err != nil {
+		return err
+	}
+	if !w.started {
+		if !vp9.B || vp9.P {
+			return nil
+		}
+		w.started = true
+		w.firstTS = pkt.Timestamp
+	}
+	// the packets up to the marker make up a frame
+	w.frame = append(w.frame, vp9.Payload...)
+	if !pkt.Marker {
+		return nil
+	}
+
+	frameHeader := make([]byte, 12)
+	binary.LittleEndian.PutUint32(frameHeader[0:], uint32(len(w.frame)))
+	binary.LittleEndian.PutUint64(frameHeader[4:], uint64(pkt.Timestamp-w.firstTS))
+	w.count++
+	if _, err := w.file.Write(frameHeader); err != nil {
+		return err
+	}
+	_, err := w.file.Write(w.frame)
+	w.frame = w.frame[:0]
+	return err
+}
+
+// Close implements media.Writer
+func (w *vp9Writer) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	defer func() { w.file = nil }()
+
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.count)
+	if _, err := w.file.Seek(24, io.SeekStart); err == nil {
+		w.file.Write(count)
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,531 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/util"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// sseExtensionRel is the Link relation of the WHEP server-sent events extension
+	sseExtensionRel = "urn:ietf:params:whep:ext:core:server-sent-events"
+	// sseKeepAliveInterval keeps idle event streams open through proxies
+	sseKeepAliveInterval = 15 * time.Second
+
+	roomEventRenegotiate = "renegotiate"
+	roomEventTracks      = "tracks"
+)
+
+// roomEvent is a server-sent event of a whole-room WHEP session
+type roomEvent struct {
+	Event string
+	Data  interface{}
+}
+
+// renegotiateEvent carries a server offer, answered by PATCHing the
+// resource with an application/sdp body
+type renegotiateEvent struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// tracksEvent lists the tracks of the room after a renegotiation
+type tracksEvent struct {
+	Tracks []roomTrackInfo `json:"tracks"`
+}
+
+// roomListener is an event stream of a whole-room session, set up by POSTing
+// the event types it wants
+type roomListener struct {
+	events    chan roomEvent
+	types     map[string]bool
+	connected bool
+}
+
+type roomTrackInfo struct {
+	Participant string `json:"participant"`
+	TrackId     string `json:"trackId"`
+	StreamId    string `json:"streamId"`
+	Kind        string `json:"kind"`
+}
+
+// roomViewer is a WHEP session watching every track of a LiveKit room. It
+// follows tracks being published and unpublished by adding them to and
+// removing them from the peer connection and renegotiating through
+// server-sent events.
+type roomViewer struct {
+	whipConn *whip.WHIPConn
+	src      *participantSource
+
+	lock    sync.Mutex
+	senders map[string]*webrtc.RTPSender
+	// started is set once the viewer's offer is answered, renegotiation is
+	// only possible from then on
+	started     bool
+	negotiating bool
+	pending     bool
+	closed      bool
+	listeners   map[string]*roomListener
+}
+
+func newRoomViewer(whipConn *whip.WHIPConn, src *participantSource) *roomViewer {
+	return &roomViewer{
+		whipConn:  whipConn,
+		src:       src,
+		senders:   make(map[string]*webrtc.RTPSender),
+		listeners: make(map[string]*roomListener),
+	}
+}
+
+// addTracks adds the current tracks of the room before the first answer. The
+// tracks that do not fit the viewer's offer are negotiated once its event
+// stream is connected.
+func (v *roomViewer) addTracks() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for sid, t := range v.src.sourceTracks() {
+		sender, err := v.whipConn.AddTrack(t.local)
+		if err != nil {
+			return err
+		}
+		v.senders[sid] = sender
+		go readRTCP(sender, t.keyframes, v.src.s.localTrackMetrics(v.src.room, t.participant, "whep_room", t.local))
+	}
+	return nil
+}
+
+// start allows renegotiation once the first answer has been created
+func (v *roomViewer) start() {
+	v.lock.Lock()
+	v.started = true
+	v.lock.Unlock()
+}
+
+// sync brings the senders in line with the tracks of the room and renegotiates
+// when they changed or when force is set
+func (v *roomViewer) sync(force bool) {
+	v.lock.Lock()
+	if v.closed || !v.started {
+		v.lock.Unlock()
+		return
+	}
+
+	tracks := v.src.sourceTracks()
+	changed := force
+	for sid, sender := range v.senders {
+		if _, ok := tracks[sid]; !ok {
+			if err := v.whipConn.RemoveTrack(sender); err != nil {
+				log.Println("failed to remove room track", sid, err)
+			}
+			delete(v.senders, sid)
+			changed = true
+		}
+	}
+	for sid, t := range tracks {
+		if _, ok := v.senders[sid]; ok {
+			continue
+		}
+		sender, err := v.whipConn.AddTrack(t.local)
+		if err != nil {
+			log.Println("failed to add room track", sid, err)
+			continue
+		}
+		v.senders[sid] = sender
+		go readRTCP(sender, t.keyframes, v.src.s.localTrackMetrics(v.src.room, t.participant, "whep_room", t.local))
+		changed = true
+	}
+
+	if !changed {
+		v.lock.Unlock()
+		return
+	}
+	if v.negotiating {
+		v.pending = true
+		v.lock.Unlock()
+		return
+	}
+	v.negotiating = true
+	v.lock.Unlock()
+	v.renegotiate()
+}
+
+// renegotiate sends a new offer to the viewer. It is called with
+// v.negotiating set and without v.lock, creating the offer waits for ICE
+// gathering.
+func (v *roomViewer) renegotiate() {
+	offer, err := v.whipConn.CreateOffer()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if err != nil {
+		log.Println("failed to create room offer", err)
+		v.negotiating = false
+		return
+	}
+	v.send(roomEvent{Event: roomEventRenegotiate, Data: renegotiateEvent{Type: "offer", SDP: offer.SDP}})
+}
+
+// setAnswer completes a renegotiation and starts the next one if the room
+// changed in the meantime
+func (v *roomViewer) setAnswer(sdp string) error {
+	v.lock.Lock()
+	if !v.negotiating {
+		v.lock.Unlock()
+		return webrtc.ErrNoRemoteDescription
+	}
+	if err := v.whipConn.SetAnswer(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+		v.lock.Unlock()
+		return err
+	}
+	v.negotiating = false
+	pending := v.pending
+	v.pending = false
+
+	info := tracksEvent{Tracks: []roomTrackInfo{}}
+	tracks := v.src.sourceTracks()
+	for sid := range v.senders {
+		if t, ok := tracks[sid]; ok {
+			info.Tracks = append(info.Tracks, roomTrackInfo{
+				Participant: t.participant,
+				TrackId:     t.local.ID(),
+				StreamId:    t.local.StreamID(),
+				Kind:        t.local.Kind().String(),
+			})
+		}
+	}
+	v.send(roomEvent{Event: roomEventTracks, Data: info})
+	v.lock.Unlock()
+
+	if pending {
+		v.sync(true)
+	}
+	return nil
+}
+
+// send queues ev for the event streams that asked for it, dropping it for
+// those that do not keep up. v.lock must be held.
+func (v *roomViewer) send(ev roomEvent) {
+	if v.closed {
+		return
+	}
+	for _, l := range v.listeners {
+		if !l.types[ev.Event] {
+			continue
+		}
+		select {
+		case l.events <- ev:
+		default:
+			log.Println("room viewer event dropped", ev.Event)
+		}
+	}
+}
+
+// addListener sets up an event stream of types and returns its id
+func (v *roomViewer) addListener(types map[string]bool) (string, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closed {
+		return "", errors.New("session is closed")
+	}
+	id := util.RandomString(12)
+	v.listeners[id] = &roomListener{events: make(chan roomEvent, 16), types: types}
+	return id, nil
+}
+
+// connectListener hands the event stream id to a connecting client with a
+// func that removes it once the client is gone. It returns nil when the
+// stream is unknown or already connected.
+func (v *roomViewer) connectListener(id string) (*roomListener, func()) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	l, ok := v.listeners[id]
+	if !ok || l.connected {
+		return nil, nil
+	}
+	l.connected = true
+	return l, func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		if v.listeners[id] == l {
+			delete(v.listeners, id)
+			close(l.events)
+		}
+	}
+}
+
+func (v *roomViewer) close() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.closed {
+		v.closed = true
+		for id, l := range v.listeners {
+			delete(v.listeners, id)
+			close(l.events)
+		}
+	}
+}
+
+func (s *Server) handleWHEPRoomPost(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	setWHEPHeaders(w)
+	if _, ok := s.authorize(w, r, roomId, "", false); !ok {
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		httpError(w, http.StatusUnsupportedMediaType, "415 - offer must be application/sdp")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		httpError(w, http.StatusBadRequest, "400 - missing sdp offer")
+		return
+	}
+	log.Printf("WHEP Room Post: roomId => %v, body = %v", roomId, string(body))
+
+	s.listLock.RLock()
+	closed := s.closed
+	s.listLock.RUnlock()
+	if closed {
+		httpError(w, http.StatusServiceUnavailable, "503 - whip server is shutting down")
+		return
+	}
+
+	source, err := s.acquireSource(roomId, "")
+	if err != nil {
+		httpError(w, http.StatusBadGateway, fmt.Sprintf("502 - failed to subscribe to livekit room %v: %v", roomId, err))
+		return
+	}
+
+	whep, err := whip.NewWHIPConn()
+	if err != nil {
+		s.releaseSource(source)
+		httpError(w, http.StatusInternalServerError, "500 - failed to create whep conn!")
+		return
+	}
+
+	viewer := newRoomViewer(whep, source)
+	stopListening := source.onChange(func() { viewer.sync(false) })
+
+	var releaseOnce sync.Once
+	release := func() {
+		releaseOnce.Do(func() {
+			stopListening()
+			viewer.close()
+			s.releaseSource(source)
+		})
+	}
+
+	if err = viewer.addTracks(); err != nil {
+		whep.Close()
+		release()
+		httpError(w, http.StatusInternalServerError, fmt.Sprintf("500 - failed to add track: %v", err))
+		return
+	}
+
+	uniqueResourceId := "whep-room-" + util.RandomString(12)
+
+	whep.OnConnectionStateChange = func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed {
+			release()
+		}
+		s.onConnectionStateChange(uniqueResourceId, state)
+	}
+
+	answer, err := whep.Offer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
+	if err != nil {
+		release()
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("400 - failed to answer whep conn: %v", err))
+		return
+	}
+	viewer.start()
+
+	s.listLock.Lock()
+	if s.closed {
+		s.listLock.Unlock()
+		whep.Close()
+		release()
+		httpError(w, http.StatusServiceUnavailable, "503 - whip server is shutting down")
+		return
+	}
+	s.conns[uniqueResourceId] = &whipState{
+		created:   time.Now(),
+		room:      roomId,
+		publish:   false,
+		whipConn:  whep,
+		pubTracks: make(map[string]*webrtc.TrackLocalStaticRTP),
+		viewer:    viewer,
+	}
+	s.sessionStarted(uniqueResourceId, s.conns[uniqueResourceId])
+	s.printWhipState()
+	s.listLock.Unlock()
+
+	go func() {
+		time.Sleep(time.Second * 1)
+		source.pictureLossIndication()
+	}()
+
+	resourceUrl := "/whep/" + roomId + "/" + uniqueResourceId
+	log.Printf("send whep room answer => %v", answer.SDP)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", resourceUrl)
+	w.Header().Set("ETag", iceETag(whep))
+	w.Header().Set("Link", fmt.Sprintf(`<%v/events>; rel="%v"; events="%v,%v"`, resourceUrl, sseExtensionRel, roomEventRenegotiate, roomEventTracks))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer.SDP))
+	s.metrics.offerAnswer.WithLabelValues("whep_room").Observe(time.Since(start).Seconds())
+}
+
+// handleWHEPRoomEventsOptions answers the CORS preflight of the events POST
+func (s *Server) handleWHEPRoomEventsOptions(w http.ResponseWriter, r *http.Request) {
+	setWHEPHeaders(w)
+	w.Header().Set("Accept-Post", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWHEPRoomEventsPost sets up an event stream of a whole-room session as
+// in the WHEP server-sent events extension: the body is a JSON array of the
+// event types, the stream is at the Location of the 201 answer.
+func (s *Server) handleWHEPRoomEventsPost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	resourceId := vars["resource"]
+	setWHEPHeaders(w)
+
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	s.listLock.RLock()
+	state, found := s.conns[resourceId]
+	s.listLock.RUnlock()
+	if !found || state.room != roomId || state.viewer == nil {
+		httpError(w, http.StatusNotFound, "404 - resource "+resourceId+" not found")
+		return
+	}
+	if !allows(w, claims, roomId, "", false) {
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		httpError(w, http.StatusUnsupportedMediaType, "415 - events must be application/json")
+		return
+	}
+	var requested []string
+	if err := json.NewDecoder(r.Body).Decode(&requested); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("400 - events must be a json array of event types: %v", err))
+		return
+	}
+	types := make(map[string]bool)
+	for _, typ := range requested {
+		if typ == roomEventRenegotiate || typ == roomEventTracks {
+			types[typ] = true
+		}
+	}
+	if len(types) == 0 {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("400 - none of the supported events %v,%v requested", roomEventRenegotiate, roomEventTracks))
+		return
+	}
+
+	id, err := state.viewer.addListener(types)
+	if err != nil {
+		httpError(w, http.StatusNotFound, "404 - resource "+resourceId+" not found")
+		return
+	}
+	log.Printf("WHEP room events: roomId => %v, resourceId => %v, events => %v", roomId, resourceId, requested)
+	w.Header().Set("Location", "/whep/"+roomId+"/"+resourceId+"/events/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleWHEPRoomEvents streams the server-sent events of an event stream set
+// up with handleWHEPRoomEventsPost. Connecting a stream of renegotiate events
+// negotiates the tracks that did not fit the first answer.
+func (s *Server) handleWHEPRoomEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	resourceId := vars["resource"]
+	listenerId := vars["listener"]
+	setWHEPHeaders(w)
+
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	s.listLock.RLock()
+	state, found := s.conns[resourceId]
+	s.listLock.RUnlock()
+	if !found || state.room != roomId || state.viewer == nil {
+		httpError(w, http.StatusNotFound, "404 - resource "+resourceId+" not found")
+		return
+	}
+	if !allows(w, claims, roomId, "", false) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "500 - streaming unsupported")
+		return
+	}
+
+	listener, remove := state.viewer.connectListener(listenerId)
+	if listener == nil {
+		httpError(w, http.StatusNotFound, "404 - event stream "+listenerId+" not found or already connected")
+		return
+	}
+	defer remove()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	log.Printf("WHEP room events connected: roomId => %v, resourceId => %v", roomId, resourceId)
+	if listener.types[roomEventRenegotiate] {
+		go state.viewer.sync(true)
+	}
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-listener.events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev.Data)
+			if err != nil {
+				log.Println("failed to encode room event", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %v\ndata: %s\n\n", ev.Event, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/auth"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/rtmp"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/util"
+	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// rtmpTimeout drops a publisher that sends nothing for that long
+	rtmpTimeout = 10 * time.Second
+	// rtmpAudioDrop publishes the video of RTMP streams and drops their
+	// audio, rtmpAudioReject refuses the streams that carry audio
+	rtmpAudioDrop   = "drop"
+	rtmpAudioReject = "reject"
+	// rtmpMTU is the largest RTP payload the H264 pictures are split into
+	rtmpMTU = 1200
+)
+
+var errRTMPAudio = errors.New(`the stream carries audio and rtmp_audio is "reject"`)
+
+// rtmpPublisher is an RTMP encoder publishing a stream. Its H264 video is
+// packetized into RTP and published to LiveKit like a WHIP stream.
+type rtmpPublisher struct {
+	s           *Server
+	conn        *rtmp.Conn
+	room        string
+	stream      string
+	participant participantInfo
+
+	agent   *roomAgent
+	local   *webrtc.TrackLocalStaticRTP
+	metrics *publisherMetrics
+	config  *rtmp.AVCConfig
+
+	payloader codecs.H264Payloader
+	sequence  uint16
+	// timestamp is added to the RTP timestamps, from a random start
+	timestamp    uint32
+	audioDropped bool
+}
+
+// listenRTMP starts accepting RTMP publishers on conf.WHIP.RTMPAddr
+func (s *Server) listenRTMP() error {
+	switch s.conf.WHIP.RTMPAudio {
+	case "", rtmpAudioDrop, rtmpAudioReject:
+	default:
+		return fmt.Errorf("rtmp_audio must be %q or %q, not %q", rtmpAudioDrop, rtmpAudioReject, s.conf.WHIP.RTMPAudio)
+	}
+
+	l, err := net.Listen("tcp", s.conf.WHIP.RTMPAddr)
+	if err != nil {
+		return err
+	}
+	s.rtspLock.Lock()
+	s.rtmpListener = l
+	s.rtspLock.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleRTMP(conn)
+		}
+	}()
+	return nil
+}
+
+// closeRTMP stops accepting RTMP publishers and disconnects the connected ones
+func (s *Server) closeRTMP() {
+	s.rtspLock.Lock()
+	defer s.rtspLock.Unlock()
+	if s.rtmpListener != nil {
+		s.rtmpListener.Close()
+	}
+	for _, p := range s.rtmpPublishers {
+		p.conn.Close()
+	}
+}
+
+// handleRTMP reads the publish command of a connection and, once accepted,
+// forwards its stream until the publisher leaves
+func (s *Server) handleRTMP(nc net.Conn) {
+	defer nc.Close()
+
+	conn, err := rtmp.Accept(nc, rtmpTimeout)
+	if err != nil {
+		log.Printf("rtmp handshake with %v failed: %v", nc.RemoteAddr(), err)
+		return
+	}
+	name, err := conn.ReadPublish()
+	if err != nil {
+		log.Printf("rtmp connection from %v closed before publishing: %v", nc.RemoteAddr(), err)
+		return
+	}
+
+	// rtmp://host/{room}/{stream}, the stream name may carry ?token=
+	room := conn.App()
+	stream, rawQuery, _ := strings.Cut(name, "?")
+	query, _ := url.ParseQuery(rawQuery)
+	if room == "" || stream == "" || strings.Contains(room, "/") || strings.Contains(stream, "/") {
+		log.Printf("rtmp publish of %v/%v from %v rejected: the url must be rtmp://host/{room}/{stream}", room, stream, nc.RemoteAddr())
+		conn.RejectPublish("BadName", "the url must be rtmp://host/{room}/{stream}")
+		return
+	}
+
+	var claims *auth.Claims
+	if s.conf.WHIP.Auth {
+		claims, err = auth.Verify("Bearer "+query.Get("token"), s.conf.LiveKitServer.APIKey, s.conf.LiveKitServer.APISecret)
+		if err == nil && !claims.Allows(room, stream, true) {
+			err = auth.ErrForbidden
+		}
+		if err != nil {
+			log.Printf("rtmp publish of %v/%v from %v rejected: %v", room, stream, nc.RemoteAddr(), err)
+			conn.RejectPublish("Unauthorized", err.Error())
+			return
+		}
+	}
+
+	p := &rtmpPublisher{
+		s:           s,
+		conn:        conn,
+		room:        room,
+		stream:      stream,
+		participant: s.publisherParticipant(query, stream, claims),
+		sequence:    uint16(rand.Uint32()),
+		timestamp:   rand.Uint32(),
+	}
+	if err := s.addRTMPPublisher(p); err != nil {
+		log.Printf("rtmp publish of %v/%v from %v rejected: %v", room, stream, nc.RemoteAddr(), err)
+		conn.RejectPublish("BadName", err.Error())
+		return
+	}
+	defer s.removeRTMPPublisher(p)
+
+	if err := conn.AcceptPublish(); err != nil {
+		return
+	}
+	log.Printf("rtmp publisher %v publishing %v/%v", nc.RemoteAddr(), room, stream)
+	stopped := s.sourceStarted("rtmp-"+stream+"-"+util.RandomString(12), room, stream, p.participant)
+	defer stopped()
+
+	err = p.run()
+	if err == io.EOF {
+		log.Printf("rtmp publisher of %v/%v unpublished", room, stream)
+	} else {
+		log.Printf("rtmp publisher of %v/%v disconnected: %v", room, stream, err)
+	}
+	if err == errRTMPAudio {
+		conn.RejectPublish("Rejected", err.Error())
+	}
+}
+
+// addRTMPPublisher registers p, a stream has one RTMP publisher at a time
+func (s *Server) addRTMPPublisher(p *rtmpPublisher) error {
+	// the listLock orders the publisher against Shutdown
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	if s.closed {
+		return errors.New("server is shutting down")
+	}
+	s.rtspLock.Lock()
+	defer s.rtspLock.Unlock()
+	key := p.room + "/" + p.stream
+	if _, ok := s.rtmpPublishers[key]; ok {
+		return fmt.Errorf("stream %v is already published", key)
+	}
+	s.rtmpPublishers[key] = p
+	s.publishing.Add(1)
+	return nil
+}
+
+func (s *Server) removeRTMPPublisher(p *rtmpPublisher) {
+	s.rtspLock.Lock()
+	delete(s.rtmpPublishers, p.room+"/"+p.stream)
+	s.rtspLock.Unlock()
+	s.publishing.Done()
+}
+
+// run forwards the messages of the publisher until it leaves, it returns
+// io.EOF when it unpublishes
+func (p *rtmpPublisher) run() error {
+	defer func() {
+		if p.agent != nil {
+			p.agent.unpublish(p.stream, p.local)
+			p.s.releaseAgent(p.agent)
+		}
+		p.metrics.close()
+	}()
+
+	for {
+		msg, err := p.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case rtmp.TypeVideo:
+			if err := p.video(msg); err != nil {
+				return err
+			}
+		case rtmp.TypeAudio:
+			if err := p.audio(int(rtmp.AudioCodec(msg.Payload))); err != nil {
+				return err
+			}
+		case rtmp.TypeData:
+			// encoders announce the audio codec before the first tags, a
+			// rejected stream is then never published
+			if codec, ok := rtmp.ParseMetaData(msg.Payload)["audiocodecid"].(float64); ok {
+				if err := p.audio(int(codec)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// audio refuses the stream if rtmp_audio is "reject", and otherwise logs
+// once that its audio is dropped
+func (p *rtmpPublisher) audio(codec int) error {
+	if p.s.conf.WHIP.RTMPAudio == rtmpAudioReject {
+		return errRTMPAudio
+	}
+	if !p.audioDropped {
+		p.audioDropped = true
+		log.Printf("rtmp publisher of %v/%v: dropping audio (codec %d), only video is published", p.room, p.stream, codec)
+	}
+	return nil
+}
+
+// video packetizes an H264 picture and writes it to the LiveKit track, which
+// is published with the first picture. Encoders send their first audio tag
+// before it, so a stream with rejected audio never shows up in the room.
+func (p *rtmpPublisher) video(msg *rtmp.Message) error {
+	tag, err := rtmp.ParseVideo(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if tag.Codec != rtmp.VideoCodecAVC {
+		return fmt.Errorf("unsupported video codec %d, only H264 is supported", tag.Codec)
+	}
+
+	switch tag.PacketType {
+	case rtmp.AVCSequenceHeader:
+		config, err := rtmp.ParseAVCConfig(tag.Data)
+		if err != nil {
+			return err
+		}
+		p.config = config
+		return nil
+	case rtmp.AVCNALU:
+	default:
+		return nil
+	}
+	if p.config == nil {
+		// no sequence header yet
+		return nil
+	}
+	if p.local == nil {
+		if err := p.publish(); err != nil {
+			return err
+		}
+	}
+
+	nalus, err := p.config.NALUs(tag.Data)
+	if err != nil {
+		return err
+	}
+	// encoders send the parameter sets in the sequence header only, a
+	// keyframe gets them in band for the LiveKit subscribers
+	var annexB []byte
+	if tag.Keyframe && !hasNALU(nalus, 7) {
+		nalus = append(append(append([][]byte{}, p.config.SPS...), p.config.PPS...), nalus...)
+	}
+	for _, nalu := range nalus {
+		annexB = append(annexB, 0, 0, 0, 1)
+		annexB = append(annexB, nalu...)
+	}
+
+	payloads := p.payloader.Payload(rtmpMTU, annexB)
+	timestamp := p.timestamp + uint32(int64(msg.Timestamp)+int64(tag.CompositionTime))*90
+	for i, payload := range payloads {
+		p.sequence++
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: p.sequence,
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		}
+		p.metrics.forwarded(pkt)
+		if err := p.local.WriteRTP(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish creates the video track of the stream's SPS and publishes it
+func (p *rtmpPublisher) publish() error {
+	sps := p.config.SPS[0]
+	local, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeH264,
+		ClockRate: 90000,
+		SDPFmtpLine: fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%02x%02x%02x",
+			sps[1], sps[2], sps[3]),
+	}, p.stream+"-video", p.stream)
+	if err != nil {
+		return err
+	}
+	p.local = local
+	p.metrics = p.s.metrics.publisher(p.room, p.stream, webrtc.RTPCodecTypeVideo)
+	p.agent = p.s.acquireAgent(p.room, p.participant)
+	p.agent.publish(local, lksdk.TrackPublicationOptions{Name: p.stream})
+	return nil
+}
+
+// hasNALU reports whether nalus holds a NAL unit of type typ
+func hasNALU(nalus [][]byte, typ byte) bool {
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && nalu[0]&0x1f == typ {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/util"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	"github.com/gorilla/mux"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// rtpIdleTimeout ends the tracks of an RTP ingest that receives nothing
+	// for that long. When the packets resume, the tracks continue like those
+	// of a reconnected WHIP publisher.
+	rtpIdleTimeout = 5 * time.Second
+	// rtpMaxPacketSize is the largest RTP or RTCP packet read
+	rtpMaxPacketSize = 1500
+)
+
+// rtpIngest receives the plain RTP streams described by an SDP on UDP, e.g.
+// from a GStreamer or ffmpeg pipeline, and publishes them like the tracks of
+// a WHIP publisher: to LiveKit, the WHEP viewers and subscribers, and the
+// recordings and HLS. It shows up as a publish session without a whipConn.
+type rtpIngest struct {
+	s      *Server
+	state  *whipState
+	tracks []*rtpTrack
+
+	closeOnce sync.Once
+}
+
+// rtpTrack is a media of an RTP ingest. It is the trackSource of its
+// published track, and sends it the keyframe requests.
+type rtpTrack struct {
+	ingest   *rtpIngest
+	media    whip.RTPMedia
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+	// h264 adds the sprop-parameter-sets of the SDP to the stream, nil for
+	// the other codecs
+	h264 *h264ParameterSets
+
+	ssrc     uint32
+	received uint64
+	// lastPacket is the time of the last packet in unix nanoseconds
+	lastPacket int64
+
+	lock sync.Mutex
+	// rtcpAddr is where the sender's RTCP comes from, the keyframe requests
+	// go there
+	rtcpAddr  *net.UDPAddr
+	published *publishedTrack
+}
+
+// addRTPIngest starts receiving the RTP of desc and publishes it as stream
+// of room. The stream must not be published already.
+func (s *Server) addRTPIngest(room, stream, desc string) (string, error) {
+	medias, err := whip.ParseRTPSession(desc)
+	if err != nil {
+		return "", err
+	}
+
+	ingest := &rtpIngest{s: s}
+	offered := make(map[webrtc.RTPCodecType]webrtc.RTPCodecCapability)
+	for _, m := range medias {
+		if _, ok := offered[m.Kind]; ok {
+			// one track per kind, like a WHIP publisher
+			continue
+		}
+		t, err := newRTPTrack(ingest, m)
+		if err != nil {
+			ingest.close()
+			return "", err
+		}
+		ingest.tracks = append(ingest.tracks, t)
+		offered[m.Kind] = m.Codec.RTPCodecCapability
+	}
+
+	ingest.state = &whipState{
+		created:     time.Now(),
+		stream:      stream,
+		room:        room,
+		publish:     true,
+		pubTracks:   make(map[string]*webrtc.TrackLocalStaticRTP),
+		keyframes:   make(map[string]*keyframeRequester),
+		gops:        make(map[string]*gopCache),
+		participant: s.publisherParticipant(nil, stream, nil),
+		simulcast:   make(map[string]*simulcastGroup),
+		record:      s.conf.WHIP.Record,
+		offered:     offered,
+		ingest:      ingest,
+	}
+
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	id := "rtp-" + stream + "-" + util.RandomString(12)
+	if err := s.addIngestSession(id, ingest.state); err != nil {
+		ingest.close()
+		return "", err
+	}
+	for _, t := range ingest.tracks {
+		s.publishing.Add(1)
+		go t.readRTP()
+		if t.rtcpConn != nil {
+			go t.readRTCP(t.rtcpConn)
+		}
+		log.Printf("rtp ingest %v receives %v on udp port %v for %v/%v", id, t.media.Codec.MimeType, t.media.Port, room, stream)
+	}
+	return id, nil
+}
+
+// newRTPTrack listens on the RTP and RTCP ports of m, joining its multicast
+// group if it has one
+func newRTPTrack(ingest *rtpIngest, m whip.RTPMedia) (*rtpTrack, error) {
+	t := &rtpTrack{ingest: ingest, media: m}
+	if strings.EqualFold(m.Codec.MimeType, webrtc.MimeTypeH264) {
+		t.h264 = newH264ParameterSets(m.Codec.SDPFmtpLine)
+	}
+
+	listen := func(port int) (*net.UDPConn, error) {
+		if ip := net.ParseIP(m.Address); ip != nil && ip.IsMulticast() {
+			return net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
+		}
+		// a unicast address is where the sender sends to, which may not be
+		// local behind NAT
+		return net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	}
+
+	var err error
+	if t.rtpConn, err = listen(m.Port); err != nil {
+		return nil, err
+	}
+	// with rtcp-mux the RTCP arrives on the RTP port
+	if m.RTCPPort != m.Port {
+		if t.rtcpConn, err = listen(m.RTCPPort); err != nil {
+			t.rtpConn.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// close stops receiving, the tracks are then released like those of a WHIP
+// publisher that left
+func (i *rtpIngest) close() {
+	i.closeOnce.Do(func() {
+		for _, t := range i.tracks {
+			t.rtpConn.Close()
+			if t.rtcpConn != nil {
+				t.rtcpConn.Close()
+			}
+		}
+	})
+}
+
+// connectionState is connected while packets arrive
+func (i *rtpIngest) connectionState() webrtc.PeerConnectionState {
+	state := webrtc.PeerConnectionStateNew
+	for _, t := range i.tracks {
+		last := atomic.LoadInt64(&t.lastPacket)
+		if last == 0 {
+			continue
+		}
+		if time.Since(time.Unix(0, last)) < rtpIdleTimeout {
+			return webrtc.PeerConnectionStateConnected
+		}
+		state = webrtc.PeerConnectionStateDisconnected
+	}
+	return state
+}
+
+// codecs lists the codecs of the ingest's tracks
+func (i *rtpIngest) codecs() []string {
+	codecs := make([]string, 0, len(i.tracks))
+	for _, t := range i.tracks {
+		codecs = append(codecs, t.media.Codec.MimeType)
+	}
+	return codecs
+}
+
+func (i *rtpIngest) bytesReceived() uint64 {
+	var bytes uint64
+	for _, t := range i.tracks {
+		bytes += atomic.LoadUint64(&t.received)
+	}
+	return bytes
+}
+
+// ID implements trackSource. It names the stream too, other streams of the
+// room may publish through the same agent.
+func (t *rtpTrack) ID() string {
+	return t.ingest.state.stream + "-" + t.media.Kind.String()
+}
+
+// StreamID implements trackSource
+func (t *rtpTrack) StreamID() string {
+	return t.ingest.state.stream
+}
+
+// Kind implements trackSource
+func (t *rtpTrack) Kind() webrtc.RTPCodecType {
+	return t.media.Kind
+}
+
+// Codec implements trackSource
+func (t *rtpTrack) Codec() webrtc.RTPCodecParameters {
+	return t.media.Codec
+}
+
+// SSRC implements trackSource, it is the SSRC of the last packet
+func (t *rtpTrack) SSRC() webrtc.SSRC {
+	return webrtc.SSRC(atomic.LoadUint32(&t.ssrc))
+}
+
+// WriteRTCP implements rtcpWriter. The packets are sent to where the
+// sender's RTCP comes from, and dropped while none came.
+func (t *rtpTrack) WriteRTCP(pkts []rtcp.Packet) error {
+	t.lock.Lock()
+	addr := t.rtcpAddr
+	t.lock.Unlock()
+	if addr == nil {
+		return nil
+	}
+
+	b, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return err
+	}
+	conn := t.rtcpConn
+	if conn == nil {
+		conn = t.rtpConn
+	}
+	_, err = conn.WriteToUDP(b, addr)
+	return err
+}
+
+// readRTP forwards the packets of the track until the ingest is closed. The
+// track is published with the first packet, and released after
+// rtpIdleTimeout without one.
+func (t *rtpTrack) readRTP() {
+	s := t.ingest.s
+	defer s.publishing.Done()
+
+	var p *publishedTrack
+	release := func() {
+		t.lock.Lock()
+		t.published = nil
+		t.lock.Unlock()
+		s.releaseTrack(p, t)
+		p = nil
+	}
+	defer func() {
+		if p != nil {
+			release()
+		}
+	}()
+
+	for {
+		deadline := time.Time{}
+		if p != nil {
+			deadline = time.Now().Add(rtpIdleTimeout)
+		}
+		t.rtpConn.SetReadDeadline(deadline)
+
+		// the packets are kept by the GOP caches and recorders, each gets a
+		// buffer of its own
+		buf := make([]byte, rtpMaxPacketSize)
+		n, addr, err := t.rtpConn.ReadFromUDP(buf)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			log.Printf("rtp ingest of %v/%v receives no %v", t.ingest.state.room, t.ingest.state.stream, t.media.Kind)
+			release()
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if n >= 2 && buf[1] >= 192 && buf[1] <= 223 {
+			// RTCP multiplexed on the RTP port
+			t.rtcp(buf[:n], addr)
+			continue
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(buf[:n]); err != nil || pkt.PayloadType != uint8(t.media.Codec.PayloadType) {
+			continue
+		}
+		atomic.StoreUint32(&t.ssrc, pkt.SSRC)
+		atomic.AddUint64(&t.received, uint64(n))
+		atomic.StoreInt64(&t.lastPacket, time.Now().UnixNano())
+
+		if p == nil {
+			log.Printf("rtp ingest of %v/%v receives %v from %v", t.ingest.state.room, t.ingest.state.stream, t.media.Kind, addr)
+			p = s.claimTrack(t.ingest.state, t, t)
+			t.lock.Lock()
+			t.published = p
+			t.lock.Unlock()
+		}
+		for _, out := range t.h264.packets(pkt) {
+			if !p.write(t, out) {
+				return
+			}
+		}
+	}
+}
+
+// readRTCP reads the RTCP port of the track until the ingest is closed
+func (t *rtpTrack) readRTCP(conn *net.UDPConn) {
+	buf := make([]byte, rtpMaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		t.rtcp(buf[:n], addr)
+	}
+}
+
+// rtcp passes the sender reports of an RTCP packet to the published track,
+// and remembers where the keyframe requests go
+func (t *rtpTrack) rtcp(b []byte, addr *net.UDPAddr) {
+	pkts, err := rtcp.Unmarshal(b)
+	if err != nil {
+		return
+	}
+	t.lock.Lock()
+	t.rtcpAddr = addr
+	p := t.published
+	t.lock.Unlock()
+
+	if p == nil {
+		return
+	}
+	for _, pkt := range pkts {
+		if sr, ok := pkt.(*rtcp.SenderReport); ok {
+			p.senderReport(t, sr)
+		}
+	}
+}
+
+// handleRTPIngest starts an RTP ingest for the SDP posted to
+// /api/v1/rtp/{room}/{stream}
+func (s *Server) handleRTPIngest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	room, stream := vars["room"], vars["stream"]
+	if !s.authorizeAdmin(w, r, room) {
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		httpError(w, http.StatusUnsupportedMediaType, "415 - the rtp session must be application/sdp")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		httpError(w, http.StatusBadRequest, "400 - missing sdp")
+		return
+	}
+
+	id, err := s.addRTPIngest(room, stream, string(body))
+	if err == errStreamTaken {
+		httpError(w, http.StatusConflict, fmt.Sprintf("409 - %v/%v: %v", room, stream, err))
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("400 - failed to start rtp ingest of %v/%v: %v", room, stream, err))
+		return
+	}
+
+	s.listLock.RLock()
+	info := s.sessionInfo(id, s.conns[id])
+	s.listLock.RUnlock()
+	w.Header().Set("Location", adminAPIPrefix+"/sessions/"+id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
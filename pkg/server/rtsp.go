@@ -0,0 +1,677 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/rtsp"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/util"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	"github.com/gorilla/mux"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// rtspTimeout bounds the requests to a camera, and the wait for its
+	// packets once it plays
+	rtspTimeout             = 10 * time.Second
+	rtspReconnectMinBackoff = time.Second
+	rtspReconnectMaxBackoff = 30 * time.Second
+	// rtspStableAfter is how long a stream must have played for the backoff
+	// to start over
+	rtspStableAfter = 30 * time.Second
+)
+
+var (
+	errRTSPNoMedia     = errors.New("rtsp: no H264, Opus or PCMA media")
+	errRTSPSourceTaken = errors.New("stream already has an rtsp source")
+)
+
+// rtspSource pulls an RTSP stream, e.g. of an IP camera, and publishes its
+// H264, Opus and PCMA tracks to a LiveKit room like a WHIP publisher. It
+// reconnects with backoff until it is closed.
+type rtspSource struct {
+	s           *Server
+	conf        whip.RTSPSourceConfig
+	participant participantInfo
+	done        chan struct{}
+
+	lock   sync.Mutex
+	client *rtsp.Client
+	closed bool
+	state  string
+	err    error
+	since  time.Time
+}
+
+// rtspSourceInfo describes an RTSP source in the admin API
+type rtspSourceInfo struct {
+	URL    string    `json:"url"`
+	Room   string    `json:"room"`
+	Stream string    `json:"stream"`
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// rtspSession is an RTSP source while it plays. It shows up as a publish
+// session without a whipConn, and its tracks are published like those of a
+// WHIP publisher: to LiveKit, the WHEP viewers and subscribers, and the
+// recordings and HLS.
+type rtspSession struct {
+	src      *rtspSource
+	client   *rtsp.Client
+	state    *whipState
+	tracks   map[int]*rtspTrack
+	received uint64
+	// lastPacket is the time of the last packet in unix nanoseconds
+	lastPacket int64
+}
+
+// rtspTrack is a media of an RTSP session. It is the trackSource of its
+// published track, and sends it the keyframe requests.
+type rtspTrack struct {
+	session *rtspSession
+	media   *rtsp.Media
+	kind    webrtc.RTPCodecType
+	codec   webrtc.RTPCodecParameters
+	// h264 adds the parameter sets of the description to the stream, nil
+	// for audio
+	h264 *h264ParameterSets
+
+	ssrc      uint32
+	published *publishedTrack
+}
+
+// rtspSourceKey identifies the source of a stream
+func rtspSourceKey(room, stream string) string {
+	return room + "/" + stream
+}
+
+// addRTSPSource starts pulling the source of conf, it fails when the stream
+// already has one
+func (s *Server) addRTSPSource(conf whip.RTSPSourceConfig) (*rtspSource, error) {
+	if conf.URL == "" || conf.Room == "" || conf.Stream == "" {
+		return nil, errors.New("url, room and stream are required")
+	}
+	if u, err := url.Parse(conf.URL); err != nil || u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("bad rtsp url %q", redactURL(conf.URL))
+	}
+
+	participant := participantInfo{Identity: sharedParticipantIdentity}
+	if s.conf.WHIP.ParticipantPerPublisher {
+		participant = participantInfo{Identity: conf.Stream, Name: conf.Stream}
+	}
+	src := &rtspSource{
+		s:           s,
+		conf:        conf,
+		participant: participant,
+		done:        make(chan struct{}),
+		state:       "connecting",
+		since:       time.Now(),
+	}
+
+	// the listLock orders the source against Shutdown
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	if s.closed {
+		return nil, errors.New("server is shutting down")
+	}
+	s.rtspLock.Lock()
+	defer s.rtspLock.Unlock()
+	key := rtspSourceKey(conf.Room, conf.Stream)
+	if _, ok := s.rtspSources[key]; ok {
+		return nil, errRTSPSourceTaken
+	}
+	s.rtspSources[key] = src
+
+	s.publishing.Add(1)
+	go src.run()
+	log.Printf("rtsp source %v for %v added", redactURL(conf.URL), key)
+	return src, nil
+}
+
+// removeRTSPSource stops the source of room and stream, it returns false when
+// there is none
+func (s *Server) removeRTSPSource(room, stream string) bool {
+	s.rtspLock.Lock()
+	key := rtspSourceKey(room, stream)
+	src, ok := s.rtspSources[key]
+	delete(s.rtspSources, key)
+	s.rtspLock.Unlock()
+
+	if ok {
+		src.close()
+		log.Printf("rtsp source of %v removed", key)
+	}
+	return ok
+}
+
+// closeRTSPSources stops every source
+func (s *Server) closeRTSPSources() {
+	s.rtspLock.Lock()
+	sources := s.rtspSources
+	s.rtspSources = make(map[string]*rtspSource)
+	s.rtspLock.Unlock()
+
+	for _, src := range sources {
+		src.close()
+	}
+}
+
+func (src *rtspSource) close() {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+	if src.closed {
+		return
+	}
+	src.closed = true
+	close(src.done)
+	if src.client != nil {
+		src.client.Close()
+	}
+}
+
+func (src *rtspSource) setState(state string, err error) {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+	src.state = state
+	src.err = err
+	src.since = time.Now()
+}
+
+func (src *rtspSource) info() rtspSourceInfo {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+	info := rtspSourceInfo{
+		URL:    redactURL(src.conf.URL),
+		Room:   src.conf.Room,
+		Stream: src.conf.Stream,
+		State:  src.state,
+		Since:  src.since,
+	}
+	if src.err != nil {
+		info.Error = src.err.Error()
+	}
+	return info
+}
+
+// run plays the stream until the source is closed, reconnecting with backoff
+func (src *rtspSource) run() {
+	defer src.s.publishing.Done()
+
+	backoff := rtspReconnectMinBackoff
+	for {
+		start := time.Now()
+		err := src.play()
+
+		select {
+		case <-src.done:
+			src.setState("closed", nil)
+			return
+		default:
+		}
+		if time.Since(start) > rtspStableAfter {
+			backoff = rtspReconnectMinBackoff
+		}
+		log.Printf("rtsp source %v of %v/%v failed: %v, retry in %v", redactURL(src.conf.URL), src.conf.Room, src.conf.Stream, err, backoff)
+		src.setState("retrying", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-src.done:
+			src.setState("closed", nil)
+			return
+		}
+		if backoff *= 2; backoff > rtspReconnectMaxBackoff {
+			backoff = rtspReconnectMaxBackoff
+		}
+	}
+}
+
+// play connects to the camera and forwards its packets to LiveKit until the
+// stream fails or the source is closed
+func (src *rtspSource) play() error {
+	src.setState("connecting", nil)
+	client, err := rtsp.Dial(src.conf.URL, rtspTimeout)
+	if err != nil {
+		return err
+	}
+	src.lock.Lock()
+	if src.closed {
+		src.lock.Unlock()
+		client.Close()
+		return nil
+	}
+	src.client = client
+	src.lock.Unlock()
+	defer client.Close()
+
+	medias, err := client.Describe()
+	if err != nil {
+		return err
+	}
+	session := &rtspSession{src: src, client: client, tracks: make(map[int]*rtspTrack)}
+	offered := make(map[webrtc.RTPCodecType]webrtc.RTPCodecCapability)
+	for _, m := range medias {
+		codec, ok := rtspCodec(m)
+		kind := webrtc.NewRTPCodecType(m.Type)
+		if _, taken := offered[kind]; !ok || taken {
+			continue
+		}
+		if err := client.Setup(m); err != nil {
+			return err
+		}
+		offered[kind] = codec
+
+		t := &rtspTrack{
+			session: session,
+			media:   m,
+			kind:    kind,
+			codec:   webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: webrtc.PayloadType(m.PayloadType)},
+		}
+		if kind == webrtc.RTPCodecTypeVideo {
+			t.h264 = newH264ParameterSets(m.Fmtp)
+		}
+		session.tracks[m.Channel] = t
+	}
+	if len(session.tracks) == 0 {
+		return errRTSPNoMedia
+	}
+
+	session.state = &whipState{
+		created:     time.Now(),
+		stream:      src.conf.Stream,
+		room:        src.conf.Room,
+		publish:     true,
+		pubTracks:   make(map[string]*webrtc.TrackLocalStaticRTP),
+		keyframes:   make(map[string]*keyframeRequester),
+		gops:        make(map[string]*gopCache),
+		participant: src.participant,
+		simulcast:   make(map[string]*simulcastGroup),
+		record:      src.s.conf.WHIP.Record,
+		offered:     offered,
+		ingest:      session,
+	}
+	id := "rtsp-" + src.conf.Stream + "-" + util.RandomString(12)
+	src.s.listLock.Lock()
+	err = src.s.addIngestSession(id, session.state)
+	src.s.listLock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer src.s.removeIngestSession(id, session.state)
+
+	if err := client.Play(); err != nil {
+		return err
+	}
+	log.Printf("rtsp source %v of %v/%v playing as %v", redactURL(src.conf.URL), src.conf.Room, src.conf.Stream, id)
+	src.setState("playing", nil)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(client.SessionTimeout() / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := client.KeepAlive(); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// the tracks wait for a reconnect like those of a WHIP publisher, so the
+	// viewers keep playing when the camera comes back
+	defer func() {
+		for _, t := range session.tracks {
+			if t.published != nil {
+				src.s.releaseTrack(t.published, t)
+			}
+		}
+	}()
+	for {
+		channel, data, err := client.ReadPacket()
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&session.received, uint64(len(data)))
+		atomic.StoreInt64(&session.lastPacket, time.Now().UnixNano())
+		t, ok := session.tracks[channel]
+		if !ok {
+			// the RTCP of a media is on the channel after it
+			if t, ok := session.tracks[channel-1]; ok {
+				t.rtcp(data)
+			}
+			continue
+		}
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(data); err != nil {
+			continue
+		}
+		atomic.StoreUint32(&t.ssrc, pkt.SSRC)
+		if t.published == nil {
+			t.published = src.s.claimTrack(session.state, t, t)
+		}
+		for _, out := range t.h264.packets(pkt) {
+			if !t.published.write(t, out) {
+				return errStreamTaken
+			}
+		}
+	}
+}
+
+// close removes the source, like DELETE /api/v1/rtsp/{room}/{stream}
+func (session *rtspSession) close() {
+	session.src.s.removeRTSPSource(session.src.conf.Room, session.src.conf.Stream)
+}
+
+// connectionState is connected while packets arrive
+func (session *rtspSession) connectionState() webrtc.PeerConnectionState {
+	last := atomic.LoadInt64(&session.lastPacket)
+	switch {
+	case last == 0:
+		return webrtc.PeerConnectionStateConnecting
+	case time.Since(time.Unix(0, last)) < rtpIdleTimeout:
+		return webrtc.PeerConnectionStateConnected
+	}
+	return webrtc.PeerConnectionStateDisconnected
+}
+
+// codecs lists the codecs of the session's tracks
+func (session *rtspSession) codecs() []string {
+	codecs := make([]string, 0, len(session.tracks))
+	for _, t := range session.tracks {
+		codecs = append(codecs, t.codec.MimeType)
+	}
+	sort.Strings(codecs)
+	return codecs
+}
+
+func (session *rtspSession) bytesReceived() uint64 {
+	return atomic.LoadUint64(&session.received)
+}
+
+// ID implements trackSource. It names the stream too, other streams of the
+// room may publish through the same agent.
+func (t *rtspTrack) ID() string {
+	return t.session.src.conf.Stream + "-" + t.kind.String()
+}
+
+// StreamID implements trackSource
+func (t *rtspTrack) StreamID() string {
+	return t.session.src.conf.Stream
+}
+
+// Kind implements trackSource
+func (t *rtspTrack) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+// Codec implements trackSource
+func (t *rtspTrack) Codec() webrtc.RTPCodecParameters {
+	return t.codec
+}
+
+// SSRC implements trackSource, it is the SSRC of the last packet
+func (t *rtspTrack) SSRC() webrtc.SSRC {
+	return webrtc.SSRC(atomic.LoadUint32(&t.ssrc))
+}
+
+// WriteRTCP implements rtcpWriter, the packets go to the camera on the RTCP
+// channel of the media
+func (t *rtspTrack) WriteRTCP(pkts []rtcp.Packet) error {
+	b, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return err
+	}
+	return t.session.client.WritePacket(t.media.Channel+1, b)
+}
+
+// rtcp passes the sender reports of the camera to the published track
+func (t *rtspTrack) rtcp(data []byte) {
+	if t.published == nil {
+		return
+	}
+	pkts, err := rtcp.Unmarshal(data)
+	if err != nil {
+		return
+	}
+	for _, pkt := range pkts {
+		if sr, ok := pkt.(*rtcp.SenderReport); ok {
+			t.published.senderReport(t, sr)
+		}
+	}
+}
+
+// rtspCodec is the codec a media of a camera is published with, ok is false
+// when it is not supported
+func rtspCodec(m *rtsp.Media) (codec webrtc.RTPCodecCapability, ok bool) {
+	switch {
+	case m.Type == "video" && strings.EqualFold(m.Codec, "H264"):
+		profile := "42e01f"
+		for _, param := range strings.Split(m.Fmtp, ";") {
+			if k, v, _ := strings.Cut(strings.TrimSpace(param), "="); strings.EqualFold(k, "profile-level-id") && len(v) == 6 {
+				profile = strings.ToLower(v)
+			}
+		}
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile}, true
+	case m.Type == "audio" && strings.EqualFold(m.Codec, "opus"):
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, true
+	case m.Type == "audio" && strings.EqualFold(m.Codec, "PCMA") && m.ClockRate == 8000:
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, true
+	}
+	return codec, false
+}
+
+// redactURL hides the password of an rtsp url
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// h264ParameterSets puts the SPS and PPS of the stream description in front
+// of the IDR pictures that come without them, as cameras often send them
+// out of band only. The sequence numbers that follow are shifted to make
+// room. Its methods pass the packets through on nil.
+type h264ParameterSets struct {
+	sps []byte
+	pps []byte
+
+	offset    uint16
+	timestamp uint32
+	// sent is set when the access unit of timestamp has its parameter sets
+	sent bool
+}
+
+// newH264ParameterSets reads the sprop-parameter-sets of fmtp
+func newH264ParameterSets(fmtp string) *h264ParameterSets {
+	h := &h264ParameterSets{}
+	for _, param := range strings.Split(fmtp, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if !strings.EqualFold(k, "sprop-parameter-sets") {
+			continue
+		}
+		for _, set := range strings.Split(v, ",") {
+			nal, err := base64.StdEncoding.DecodeString(set)
+			if err != nil || len(nal) == 0 {
+				continue
+			}
+			switch nal[0] & 0x1f {
+			case 7:
+				h.sps = nal
+			case 8:
+				h.pps = nal
+			}
+		}
+	}
+	return h
+}
+
+// packets returns pkt, preceded by the parameter sets when it starts an IDR
+// picture without them
+func (h *h264ParameterSets) packets(pkt *rtp.Packet) []*rtp.Packet {
+	if h == nil {
+		return []*rtp.Packet{pkt}
+	}
+	if pkt.Timestamp != h.timestamp {
+		h.timestamp = pkt.Timestamp
+		h.sent = false
+	}
+
+	idr := false
+	for _, nal := range h264PacketNALs(pkt.Payload) {
+		switch nal[0] & 0x1f {
+		case 5:
+			idr = true
+		case 7:
+			h.sps = append([]byte(nil), nal...)
+			h.sent = true
+		case 8:
+			h.pps = append([]byte(nil), nal...)
+		}
+	}
+
+	out := make([]*rtp.Packet, 0, 2)
+	if idr && !h.sent && h.sps != nil && h.pps != nil {
+		// a STAP-A with the SPS and PPS
+		payload := []byte{0x78}
+		for _, nal := range [][]byte{h.sps, h.pps} {
+			payload = append(payload, byte(len(nal)>>8), byte(len(nal)))
+			payload = append(payload, nal...)
+		}
+		stap := &rtp.Packet{Header: pkt.Header, Payload: payload}
+		stap.Header.Marker = false
+		stap.Header.SequenceNumber += h.offset
+		h.offset++
+		out = append(out, stap)
+	}
+	if idr {
+		h.sent = true
+	}
+	pkt.SequenceNumber += h.offset
+	return append(out, pkt)
+}
+
+// h264PacketNALs returns the NAL unit headers that start in an H264 RTP
+// payload: single NAL units, the units of a STAP-A and the first fragment of
+// an FU-A
+func h264PacketNALs(payload []byte) [][]byte {
+	if len(payload) < 2 {
+		return nil
+	}
+	switch payload[0] & 0x1f {
+	case 24:
+		var nals [][]byte
+		for rest := payload[1:]; len(rest) > 2; {
+			size := int(rest[0])<<8 | int(rest[1])
+			if size == 0 || size > len(rest)-2 {
+				break
+			}
+			nals = append(nals, rest[2:2+size])
+			rest = rest[2+size:]
+		}
+		return nals
+	case 28:
+		if payload[1]&0x80 == 0 {
+			return nil
+		}
+		// the type of the fragmented unit with the header's NRI
+		return [][]byte{{payload[0]&0xe0 | payload[1]&0x1f}}
+	}
+	return [][]byte{payload}
+}
+
+// handleRTSPSources lists the RTSP sources, of one room with ?room=
+func (s *Server) handleRTSPSources(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	if !s.authorizeAdmin(w, r, room) {
+		return
+	}
+
+	s.rtspLock.Lock()
+	sources := make([]*rtspSource, 0, len(s.rtspSources))
+	for _, src := range s.rtspSources {
+		if room == "" || src.conf.Room == room {
+			sources = append(sources, src)
+		}
+	}
+	s.rtspLock.Unlock()
+
+	list := []rtspSourceInfo{}
+	for _, src := range sources {
+		list = append(list, src.info())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Room != list[j].Room {
+			return list[i].Room < list[j].Room
+		}
+		return list[i].Stream < list[j].Stream
+	})
+	writeJSON(w, list)
+}
+
+// handleRTSPAdd starts pulling the RTSP source posted as JSON
+func (s *Server) handleRTSPAdd(w http.ResponseWriter, r *http.Request) {
+	var conf whip.RTSPSourceConfig
+	if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+		if s.authorizeAdmin(w, r, "") {
+			httpError(w, http.StatusBadRequest, "400 - bad rtsp source: "+err.Error())
+		}
+		return
+	}
+	if !s.authorizeAdmin(w, r, conf.Room) {
+		return
+	}
+
+	src, err := s.addRTSPSource(conf)
+	if err != nil {
+		if err == errRTSPSourceTaken {
+			httpError(w, http.StatusConflict, fmt.Sprintf("409 - %v/%v: %v", conf.Room, conf.Stream, err))
+			return
+		}
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("400 - %v", err))
+		return
+	}
+	w.Header().Set("Location", adminAPIPrefix+"/rtsp/"+url.PathEscape(conf.Room)+"/"+url.PathEscape(conf.Stream))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(src.info())
+}
+
+// handleRTSPRemove stops the RTSP source of a stream
+func (s *Server) handleRTSPRemove(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	room, stream := vars["room"], vars["stream"]
+	if !s.authorizeAdmin(w, r, room) {
+		return
+	}
+	if !s.removeRTSPSource(room, stream) {
+		httpError(w, http.StatusNotFound, "404 - no rtsp source for "+rtspSourceKey(room, stream))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
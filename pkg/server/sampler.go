@@ -0,0 +1,206 @@
+package server
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/fmp4"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// mediaSample is a frame of video or a packet of audio taken out of RTP
+type mediaSample struct {
+	data      []byte
+	timestamp uint32
+	keyframe  bool
+}
+
+// rtpSampler reassembles the frames of a track for the fMP4 muxer. H264
+// frames are length-prefixed NAL units. A frame missing packets is dropped,
+// and so are the frames that follow up to the next keyframe.
+type rtpSampler struct {
+	codec fmp4.Codec
+	h264  *codecs.H264Packet
+
+	frame     []byte
+	timestamp uint32
+	broken    bool
+	skipping  bool
+	started   bool
+	lastSeq   uint16
+
+	// track holds the codec configuration taken from the keyframes
+	track fmp4.Track
+	// configured is set once track can describe the codec
+	configured bool
+}
+
+// fmp4Codec maps a WebRTC codec to the muxer, ok is false when it cannot be
+// muxed
+func fmp4Codec(codec webrtc.RTPCodecCapability) (c fmp4.Codec, ok bool) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return fmp4.CodecH264, true
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return fmp4.CodecVP8, true
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return fmp4.CodecVP9, true
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return fmp4.CodecOpus, true
+	}
+	return 0, false
+}
+
+func newRTPSampler(codec fmp4.Codec, capability webrtc.RTPCodecCapability) *rtpSampler {
+	s := &rtpSampler{
+		codec: codec,
+		track: fmp4.Track{Codec: codec, TimeScale: capability.ClockRate, Channels: capability.Channels},
+	}
+	if codec == fmp4.CodecH264 {
+		s.h264 = &codecs.H264Packet{IsAVC: true}
+	}
+	// Opus needs nothing from the stream
+	s.configured = codec == fmp4.CodecOpus
+	return s
+}
+
+// push adds a packet and returns the frames it completes
+func (s *rtpSampler) push(pkt *rtp.Packet) []*mediaSample {
+	if s.codec == fmp4.CodecOpus {
+		if len(pkt.Payload) == 0 {
+			return nil
+		}
+		return []*mediaSample{{data: append([]byte(nil), pkt.Payload...), timestamp: pkt.Timestamp, keyframe: true}}
+	}
+
+	var done []*mediaSample
+	// a lost packet spoils the frame it belongs to, the previous one when
+	// its marker is missing or the one that begins
+	lost := s.started && pkt.SequenceNumber != s.lastSeq+1
+	if s.started && pkt.Timestamp != s.timestamp {
+		s.broken = s.broken || lost
+		if frame := s.finish(); frame != nil {
+			done = append(done, frame)
+		}
+	}
+	if lost {
+		s.broken = true
+		if s.h264 != nil {
+			s.h264 = &codecs.H264Packet{IsAVC: true}
+		}
+	}
+	s.started = true
+	s.lastSeq = pkt.SequenceNumber
+	s.timestamp = pkt.Timestamp
+
+	if err := s.depacketize(pkt.Payload); err != nil {
+		s.broken = true
+	}
+	if pkt.Marker {
+		if frame := s.finish(); frame != nil {
+			done = append(done, frame)
+		}
+	}
+	return done
+}
+
+func (s *rtpSampler) depacketize(payload []byte) error {
+	switch s.codec {
+	case fmp4.CodecH264:
+		data, err := s.h264.Unmarshal(payload)
+		if err != nil {
+			return err
+		}
+		s.frame = append(s.frame, data...)
+	case fmp4.CodecVP8:
+		vp8 := codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil {
+			return err
+		}
+		if vp8.S == 1 && vp8.PID == 0 {
+			s.frame = s.frame[:0]
+			s.broken = false
+		}
+		s.frame = append(s.frame, vp8.Payload...)
+	case fmp4.CodecVP9:
+		vp9 := codecs.VP9Packet{}
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return err
+		}
+		if vp9.B && len(s.frame) == 0 {
+			s.broken = false
+		}
+		s.frame = append(s.frame, vp9.Payload...)
+	}
+	return nil
+}
+
+// finish ends the current frame
+func (s *rtpSampler) finish() *mediaSample {
+	frame, broken := s.frame, s.broken
+	s.frame = nil
+	s.broken = false
+	if len(frame) == 0 {
+		return nil
+	}
+	if broken {
+		s.skipping = true
+		return nil
+	}
+
+	sample := &mediaSample{data: frame, timestamp: s.timestamp}
+	switch s.codec {
+	case fmp4.CodecH264:
+		sample.keyframe = s.h264Keyframe(frame)
+	case fmp4.CodecVP8:
+		if w, h, ok := fmp4.VP8Keyframe(frame); ok {
+			sample.keyframe = true
+			s.track.Width, s.track.Height = w, h
+			s.configured = true
+		}
+	case fmp4.CodecVP9:
+		if w, h, profile, depth, ok := fmp4.VP9Keyframe(frame); ok {
+			sample.keyframe = true
+			s.track.Width, s.track.Height = w, h
+			s.track.Profile, s.track.BitDepth = profile, depth
+			s.configured = true
+		}
+	}
+	if s.skipping && !sample.keyframe {
+		return nil
+	}
+	s.skipping = false
+	return sample
+}
+
+// h264Keyframe tells whether frame holds an IDR picture and keeps the
+// parameter sets it carries
+func (s *rtpSampler) h264Keyframe(frame []byte) bool {
+	keyframe := false
+	for len(frame) >= 4 {
+		size := int(binary.BigEndian.Uint32(frame))
+		if size == 0 || size > len(frame)-4 {
+			break
+		}
+		nal := frame[4 : 4+size]
+		frame = frame[4+size:]
+
+		switch nal[0] & 0x1f {
+		case 5:
+			keyframe = true
+		case 7:
+			s.track.SPS = append([]byte(nil), nal...)
+			if w, h, err := fmp4.H264Dimensions(nal); err == nil {
+				s.track.Width, s.track.Height = w, h
+			}
+		case 8:
+			s.track.PPS = append([]byte(nil), nal...)
+		}
+	}
+	if keyframe && s.track.SPS != nil && s.track.PPS != nil {
+		s.configured = true
+	}
+	return keyframe
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/fmp4"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// iceRestartTimeout is how long a failed session waits for an ICE restart
+	iceRestartTimeout = 30 * time.Second
+)
+
+// Server is the WHIP/WHEP gateway that forwards published streams to LiveKit
+// and to WHEP subscribers. It can be embedded as an http.Handler or run on its
+// own with Start.
+type Server struct {
+	conf       whip.Config
+	router     *mux.Router
+	httpServer *http.Server
+
+	listLock sync.RWMutex
+	conns    map[string]*whipState
+	// published holds the published tracks by room, stream and kind, kept
+	// for publisherReconnectGrace after their publisher leaves
+	published map[string]*publishedTrack
+
+	agentsLock sync.Mutex
+	rtcAgents  map[string]*roomAgent
+
+	sourcesLock sync.Mutex
+	sources     map[string]*participantSource
+
+	// recordings holds the MP4 recordings by room and stream
+	recordings *mp4Muxers
+	// hls holds the HLS streams by room and stream
+	hls *mp4Muxers
+
+	// rtspLock guards the RTSP sources and the RTMP publishers
+	rtspLock sync.Mutex
+	// rtspSources holds the pulled RTSP streams by room and stream
+	rtspSources map[string]*rtspSource
+	// rtmpPublishers holds the RTMP publishers by room and stream, accepted
+	// on rtmpListener
+	rtmpPublishers map[string]*rtmpPublisher
+	rtmpListener   net.Listener
+
+	// events carries the session and agent events to the event streams
+	events *eventBus
+	// webhooks posts the lifecycle events to conf.Webhook.URLs, nil without
+	webhooks *webhookNotifier
+	// closed is set by Shutdown, new offers are refused from then on
+	closed bool
+	// shutdown is closed by Shutdown to end the long-lived event streams
+	shutdown chan struct{}
+	// publishing tracks the publish loops, so Shutdown can wait for them to
+	// unpublish from LiveKit
+	publishing sync.WaitGroup
+
+	metrics *metrics
+}
+
+// NewServer creates a server for conf. It sets up the shared webrtc settings
+// with whip.Init, so only one server should be created per process.
+func NewServer(conf whip.Config) *Server {
+	whip.Init(conf)
+
+	s := &Server{
+		conf:           conf,
+		router:         mux.NewRouter(),
+		conns:          make(map[string]*whipState),
+		published:      make(map[string]*publishedTrack),
+		rtcAgents:      make(map[string]*roomAgent),
+		sources:        make(map[string]*participantSource),
+		rtspSources:    make(map[string]*rtspSource),
+		rtmpPublishers: make(map[string]*rtmpPublisher),
+		shutdown:       make(chan struct{}),
+		events:         newEventBus(),
+	}
+	s.recordings = newMP4Muxers([]fmp4.Codec{fmp4.CodecH264, fmp4.CodecVP8, fmp4.CodecVP9, fmp4.CodecOpus}, mp4FragmentDuration, s.newMP4Recording)
+	// HLS players decode AAC rather than Opus, which is not transcoded, so
+	// the playlists carry the video only
+	s.hls = newMP4Muxers([]fmp4.Codec{fmp4.CodecH264}, hlsPartDuration, s.newHLSStream)
+	s.metrics = newMetrics(s)
+	s.webhooks = newWebhookNotifier(s)
+	s.routes()
+
+	for _, source := range conf.RTSP {
+		if _, err := s.addRTSPSource(source); err != nil {
+			log.Printf("rtsp source %v: %v", redactURL(source.URL), err)
+		}
+	}
+	for _, ingest := range conf.RTP {
+		desc, err := ioutil.ReadFile(ingest.SDP)
+		if err == nil {
+			_, err = s.addRTPIngest(ingest.Room, ingest.Stream, string(desc))
+		}
+		if err != nil {
+			log.Printf("rtp ingest %v: %v", ingest.SDP, err)
+		}
+	}
+	return s
+}
+
+func (s *Server) routes() {
+	r := s.router
+
+	r.HandleFunc("/whip/{mode}/{room}/{stream}", s.handleWHIPPost).Methods("POST")
+	r.HandleFunc("/whip/{room}/{stream}", s.handleWHIPPatch).Methods("PATCH")
+	r.HandleFunc("/whip/{room}/{stream}", s.handleWHIPDelete).Methods("DELETE")
+	r.HandleFunc("/whip/list", s.handleWHIPList).Methods("GET")
+	r.Handle("/metrics", s.metrics.handler()).Methods("GET")
+
+	r.HandleFunc(adminAPIPrefix+"/sessions", s.handleAdminSessions).Methods("GET")
+	r.HandleFunc(adminAPIPrefix+"/sessions/{id}", s.handleAdminSession).Methods("GET")
+	r.HandleFunc(adminAPIPrefix+"/sessions/{id}", s.handleAdminDisconnect).Methods("DELETE")
+	r.HandleFunc(adminAPIPrefix+"/agents", s.handleAdminAgents).Methods("GET")
+	r.HandleFunc(adminAPIPrefix+"/events", s.handleEvents).Methods("GET")
+	r.HandleFunc(adminAPIPrefix+"/rtsp", s.handleRTSPSources).Methods("GET")
+	r.HandleFunc(adminAPIPrefix+"/rtsp", s.handleRTSPAdd).Methods("POST")
+	r.HandleFunc(adminAPIPrefix+"/rtsp/{room}/{stream}", s.handleRTSPRemove).Methods("DELETE")
+	r.HandleFunc(adminAPIPrefix+"/rtp/{room}/{stream}", s.handleRTPIngest).Methods("POST")
+
+	r.HandleFunc("/whep/{room}", s.handleWHEPOptions).Methods("OPTIONS")
+	r.HandleFunc("/whep/{room}", s.handleWHEPRoomPost).Methods("POST")
+	r.HandleFunc("/whep/{room}/{resource}/events", s.handleWHEPRoomEventsOptions).Methods("OPTIONS")
+	r.HandleFunc("/whep/{room}/{resource}/events", s.handleWHEPRoomEventsPost).Methods("POST")
+	r.HandleFunc("/whep/{room}/{resource}/events/{listener}", s.handleWHEPRoomEvents).Methods("GET")
+	r.HandleFunc("/whep/{room}/{stream}", s.handleWHEPOptions).Methods("OPTIONS")
+	r.HandleFunc("/whep/{room}/{stream}", s.handleWHEPPost).Methods("POST")
+	r.HandleFunc("/whep/{room}/{resource}", s.handleWHEPPatch).Methods("PATCH")
+	r.HandleFunc("/whep/{room}/{resource}", s.handleWHEPDelete).Methods("DELETE")
+
+	r.HandleFunc("/hls/{room}/{stream}/{file}", s.handleHLS).Methods("GET")
+
+	if s.conf.WHIP.HtmlRoot != "" {
+		r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(s.conf.WHIP.HtmlRoot))))
+	}
+	r.Headers("Access-Control-Allow-Origin", "*")
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Start listens on conf.WHIP.Addr and serves until Shutdown is called
+func (s *Server) Start() error {
+	s.httpServer = &http.Server{Addr: s.conf.WHIP.Addr, Handler: s}
+
+	log.Print("Listen whip server on: ", s.conf.WHIP.Addr, " web root: ", s.conf.WHIP.HtmlRoot)
+	log.Print("LiveKit server: ", s.conf.LiveKitServer.Server, " api key: ", s.conf.LiveKitServer.APIKey)
+
+	log.Printf("Whip publish url prefix: /whip/publish/{room}/{stream}, e.g. http://%v/whip/publish/live/stream1", s.conf.WHIP.Addr)
+	log.Printf("Whip subscribe url prefix: /whip/subscribe/{room}/{stream}, e.g. http://%v/whip/subscribe/live/stream1", s.conf.WHIP.Addr)
+	log.Printf("Whep playback url prefix: /whep/{room}/{stream or participant}, e.g. http://%v/whep/live/stream1", s.conf.WHIP.Addr)
+	log.Printf("Whep room playback url prefix: /whep/{room}, e.g. http://%v/whep/live", s.conf.WHIP.Addr)
+	if s.conf.WHIP.HLS {
+		log.Printf("HLS playback url prefix: /hls/{room}/{stream}/index.m3u8, e.g. http://%v/hls/live/stream1/index.m3u8", s.conf.WHIP.Addr)
+	}
+	log.Printf("Prometheus metrics: http://%v/metrics", s.conf.WHIP.Addr)
+	log.Printf("Admin API: http://%v%v/sessions, %v/agents, %v/events, %v/rtsp", s.conf.WHIP.Addr, adminAPIPrefix, adminAPIPrefix, adminAPIPrefix, adminAPIPrefix)
+	for _, source := range s.conf.RTSP {
+		log.Printf("RTSP source: %v published as %v/%v", redactURL(source.URL), source.Room, source.Stream)
+	}
+	for _, ingest := range s.conf.RTP {
+		log.Printf("RTP ingest: %v published as %v/%v", ingest.SDP, ingest.Room, ingest.Stream)
+	}
+	if s.conf.WHIP.RTMPAddr != "" {
+		if err := s.listenRTMP(); err != nil {
+			return err
+		}
+		log.Printf("RTMP publish url: rtmp://%v/{room}/{stream}, e.g. rtmp://%v/live/stream1", s.conf.WHIP.RTMPAddr, s.conf.WHIP.RTMPAddr)
+	}
+
+	if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting new WHIP/WHEP offers and waits for the pending
+// requests, then closes every session. Once the publish loops have unpublished
+// their LiveKit tracks, or ctx is done, the LiveKit agents are disconnected and
+// the pending webhooks delivered.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.listLock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.shutdown)
+	}
+	s.listLock.Unlock()
+
+	var err error
+	if s.httpServer != nil {
+		err = s.httpServer.Shutdown(ctx)
+	}
+
+	s.listLock.Lock()
+	for key, state := range s.conns {
+		state.close()
+		delete(s.conns, key)
+		s.sessionRemoved(key, state)
+	}
+	published := s.published
+	s.published = make(map[string]*publishedTrack)
+	s.listLock.Unlock()
+
+	// tracks waiting for their publisher to reconnect are unpublished now
+	for _, p := range published {
+		p.finish()
+	}
+	s.closeRTSPSources()
+	s.closeRTMP()
+
+	done := make(chan struct{})
+	go func() {
+		s.publishing.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Print("all rtc tracks unpublished")
+	case <-ctx.Done():
+		log.Print("shutdown deadline reached before all rtc tracks were unpublished")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	s.closeAgents()
+	s.closeSources()
+
+	// the webhooks of the sessions removed above are still delivered
+	s.webhooks.close(ctx)
+
+	return err
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	lkauth "github.com/livekit/protocol/auth"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	testKey    = "k"
+	testSecret = "s"
+)
+
+var (
+	testOnce   sync.Once
+	testHTTP   *httptest.Server
+	testServer *Server
+)
+
+// newTestHTTP serves the server shared by the tests, NewServer sets up the
+// webrtc settings of the process. LiveKit is unreachable, streams are only
+// forwarded to the local subscribers.
+func newTestHTTP(t *testing.T) (*Server, string) {
+	testOnce.Do(func() {
+		conf := whip.Config{LiveKitServer: whip.LiveKitServerConfig{Server: "http://127.0.0.1:1", APIKey: testKey, APISecret: testSecret}}
+		conf.WHIP.Auth = true
+		testServer = NewServer(conf)
+		testHTTP = httptest.NewServer(testServer)
+	})
+	return testServer, testHTTP.URL
+}
+
+// token signs a LiveKit access token for room
+func token(t *testing.T, grant *lkauth.VideoGrant) string {
+	jwt, err := lkauth.NewAccessToken(testKey, testSecret).AddGrant(grant).SetIdentity("tester").ToJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwt
+}
+
+func roomToken(t *testing.T, room string) string {
+	return token(t, &lkauth.VideoGrant{RoomJoin: true, Room: room})
+}
+
+func do(t *testing.T, method, url, token, contentType, body string, header ...string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+// offer gathers a complete offer of pc
+func offer(t *testing.T, pc *webrtc.PeerConnection) string {
+	o, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(o); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+// publisher is a WHIP client sending a VP8 track
+type publisher struct {
+	pc       *webrtc.PeerConnection
+	track    *webrtc.TrackLocalStaticRTP
+	location string
+	etag     string
+	done     chan struct{}
+}
+
+func publish(t *testing.T, url, room, stream string) *publisher {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, answer := do(t, http.MethodPost, url+"/whip/publish/"+room+"/"+stream, roomToken(t, room), "application/sdp", offer(t, pc))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish status %v: %v", resp.StatusCode, answer)
+	}
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &publisher{pc: pc, track: track, location: resp.Header.Get("Location"), etag: resp.Header.Get("ETag"), done: make(chan struct{})}
+	go p.send()
+	// the shared server keeps the stream until it is deleted
+	t.Cleanup(func() {
+		p.close()
+		do(t, http.MethodDelete, url+p.location, roomToken(t, room), "", "")
+	})
+	return p
+}
+
+// send writes a VP8 frame every 20ms, a keyframe every 50
+func (p *publisher) send() {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for seq := uint16(1); ; seq++ {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		payload := []byte{0x10, 0, 0x9d, 0x01, 0x2a, 1, 2, 3}
+		if seq%50 != 1 {
+			payload[1] = 1
+		}
+		p.track.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 1800, Marker: true}, Payload: payload})
+	}
+}
+
+func (p *publisher) close() {
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+		p.pc.Close()
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	_, url := newTestHTTP(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+	}{
+		{name: "unknown path", method: http.MethodGet, path: "/nothing/here", code: http.StatusNotFound},
+		{name: "whip with an extra segment", method: http.MethodPost, path: "/whip/publish/live/cam/1", code: http.StatusNotFound},
+		{name: "post of a whip resource", method: http.MethodPost, path: "/whip/live/cam", code: http.StatusMethodNotAllowed},
+		{name: "get of a whip resource", method: http.MethodGet, path: "/whip/live/cam", code: http.StatusMethodNotAllowed},
+		{name: "put of a whep resource", method: http.MethodPut, path: "/whep/live/cam", code: http.StatusMethodNotAllowed},
+		{name: "metrics", method: http.MethodGet, path: "/metrics", code: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := do(t, test.method, url+test.path, "", "", "")
+			if resp.StatusCode != test.code {
+				t.Fatalf("status %v, want %v: %v", resp.StatusCode, test.code, body)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	_, url := newTestHTTP(t)
+
+	deny := false
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{name: "publish without a token", method: http.MethodPost, path: "/whip/publish/live/cam", code: http.StatusUnauthorized},
+		{name: "publish with a bad token", method: http.MethodPost, path: "/whip/publish/live/cam", token: "abc", code: http.StatusUnauthorized},
+		{name: "publish to another room", method: http.MethodPost, path: "/whip/publish/live/cam", token: roomToken(t, "other"), code: http.StatusForbidden},
+		{name: "publish without canPublish", method: http.MethodPost, path: "/whip/publish/live/cam",
+			token: token(t, &lkauth.VideoGrant{RoomJoin: true, Room: "live", CanPublish: &deny}), code: http.StatusForbidden},
+		{name: "whep without a token", method: http.MethodPost, path: "/whep/live/cam", code: http.StatusUnauthorized},
+		{name: "whep of another room", method: http.MethodPost, path: "/whep/live/cam", token: roomToken(t, "other"), code: http.StatusForbidden},
+		{name: "patch without a token", method: http.MethodPatch, path: "/whip/live/cam", code: http.StatusUnauthorized},
+		{name: "delete without a token", method: http.MethodDelete, path: "/whip/live/cam", code: http.StatusUnauthorized},
+		{name: "admin without a token", method: http.MethodGet, path: adminAPIPrefix + "/sessions", code: http.StatusUnauthorized},
+		{name: "admin without roomAdmin", method: http.MethodGet, path: adminAPIPrefix + "/sessions", token: roomToken(t, "live"), code: http.StatusForbidden},
+		{name: "admin", method: http.MethodGet, path: adminAPIPrefix + "/sessions", token: token(t, &lkauth.VideoGrant{RoomAdmin: true}), code: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := do(t, test.method, url+test.path, test.token, "application/sdp", "v=0")
+			if resp.StatusCode != test.code {
+				t.Fatalf("status %v, want %v: %v", resp.StatusCode, test.code, body)
+			}
+			if test.code == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestWHIPResource(t *testing.T) {
+	_, url := newTestHTTP(t)
+	p := publish(t, url, "live", "resource")
+
+	if !strings.HasPrefix(p.location, "/whip/live/publish-resource-") {
+		t.Fatalf("location %v", p.location)
+	}
+	if p.etag == "" {
+		t.Fatal("no etag")
+	}
+
+	resp, body := do(t, http.MethodPost, url+"/whip/publish/live/resource", roomToken(t, "live"), "application/sdp", offer(t, p.pc))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("second publisher of a connected stream: status %v: %v", resp.StatusCode, body)
+	}
+
+	ufrag, pwd := "", ""
+	for _, line := range strings.Split(p.pc.LocalDescription().SDP, "\r\n") {
+		if v := strings.TrimPrefix(line, "a=ice-ufrag:"); v != line {
+			ufrag = v
+		}
+		if v := strings.TrimPrefix(line, "a=ice-pwd:"); v != line {
+			pwd = v
+		}
+	}
+	frag := "a=ice-ufrag:" + ufrag + "\r\na=ice-pwd:" + pwd + "\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n" +
+		"a=candidate:1 1 udp 2130706431 127.0.0.1 9 typ host\r\n"
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		token       string
+		contentType string
+		body        string
+		ifMatch     string
+		code        int
+	}{
+		{name: "trickle", method: http.MethodPatch, path: p.location, contentType: whip.MimeTypeSDPFragment, body: frag, code: http.StatusNoContent},
+		{name: "trickle of the current etag", method: http.MethodPatch, path: p.location, contentType: whip.MimeTypeSDPFragment, body: frag, ifMatch: p.etag, code: http.StatusNoContent},
+		{name: "trickle of another etag", method: http.MethodPatch, path: p.location, contentType: whip.MimeTypeSDPFragment, body: frag, ifMatch: `"other"`, code: http.StatusPreconditionFailed},
+		{name: "patch that is not a sdpfrag", method: http.MethodPatch, path: p.location, contentType: "application/sdp", body: frag, code: http.StatusUnsupportedMediaType},
+		{name: "patch of an unknown resource", method: http.MethodPatch, path: "/whip/live/publish-nothing", contentType: whip.MimeTypeSDPFragment, body: frag, code: http.StatusNotFound},
+		{name: "patch from another room", method: http.MethodPatch, path: strings.Replace(p.location, "/live/", "/other/", 1), token: roomToken(t, "other"),
+			contentType: whip.MimeTypeSDPFragment, body: frag, code: http.StatusNotFound},
+		{name: "delete of an unknown resource", method: http.MethodDelete, path: "/whip/live/publish-nothing", code: http.StatusNotFound},
+		{name: "delete from another room", method: http.MethodDelete, path: strings.Replace(p.location, "/live/", "/other/", 1), token: roomToken(t, "other"), code: http.StatusNotFound},
+		{name: "delete", method: http.MethodDelete, path: p.location, code: http.StatusOK},
+		{name: "delete twice", method: http.MethodDelete, path: p.location, code: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tok := test.token
+			if tok == "" {
+				tok = roomToken(t, "live")
+			}
+			var header []string
+			if test.ifMatch != "" {
+				header = []string{"If-Match", test.ifMatch}
+			}
+			resp, body := do(t, test.method, url+test.path, tok, test.contentType, test.body, header...)
+			if resp.StatusCode != test.code {
+				t.Fatalf("status %v, want %v: %v", resp.StatusCode, test.code, body)
+			}
+		})
+	}
+}
+
+func TestWHEP(t *testing.T) {
+	s, url := newTestHTTP(t)
+
+	viewer := func() (*webrtc.PeerConnection, string) {
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+		return pc, offer(t, pc)
+	}
+
+	// unknown streams are looked up on LiveKit, which is not reachable
+	_, sdp := viewer()
+	if resp, body := do(t, http.MethodPost, url+"/whep/live/nobody", roomToken(t, "live"), "application/sdp", sdp); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("whep of a missing stream: status %v: %v", resp.StatusCode, body)
+	}
+	if resp, body := do(t, http.MethodPost, url+"/whep/live/nobody", roomToken(t, "live"), "text/plain", sdp); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("whep of a text offer: status %v: %v", resp.StatusCode, body)
+	}
+
+	publish(t, url, "live", "whep")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.listLock.RLock()
+		tracks := 0
+		for _, state := range s.conns {
+			if state.publish && state.room == "live" && state.stream == "whep" {
+				tracks = len(state.pubTracks)
+			}
+		}
+		s.listLock.RUnlock()
+		if tracks > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("publisher track not forwarded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	pc, sdp := viewer()
+	received := make(chan *rtp.Packet, 1)
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case received <- pkt:
+			default:
+			}
+		}
+	})
+	resp, answer := do(t, http.MethodPost, url+"/whep/live/whep", roomToken(t, "live"), "application/sdp", sdp)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("whep status %v: %v", resp.StatusCode, answer)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/whep/live/whep-whep-") || resp.Header.Get("ETag") == "" {
+		t.Fatalf("location %v, etag %v", location, resp.Header.Get("ETag"))
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-received:
+		// viewers start from the cached keyframe
+		if pkt.Payload[1]&1 != 0 {
+			t.Fatalf("first packet is not a keyframe: %x", pkt.Payload)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no packet received over whep")
+	}
+
+	if resp, body := do(t, http.MethodDelete, url+location, roomToken(t, "live"), "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("whep delete status %v: %v", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+const (
+	// simulcastLayerWait is how long the layers of a simulcast track are
+	// collected before it is published with the layers that have arrived
+	simulcastLayerWait = 2 * time.Second
+	// simulcastMaxLate is the reorder window of the sample builders in packets
+	simulcastMaxLate = 256
+)
+
+// ridRanks orders the rids of the common naming schemes from the lowest to the
+// highest quality. Other rids keep the order of the offer, lowest first.
+var ridRanks = []map[string]int{
+	{"q": 0, "h": 1, "f": 2},
+	{"l": 0, "m": 1, "h": 2},
+	{"low": 0, "mid": 1, "high": 2},
+}
+
+// simulcastLayerSizes are nominal layer dimensions for LiveKit's layer
+// selection, WHIP does not signal the encoded resolution
+var simulcastLayerSizes = map[livekit.VideoQuality][2]uint32{
+	livekit.VideoQuality_HIGH:   {1280, 720},
+	livekit.VideoQuality_MEDIUM: {640, 360},
+	livekit.VideoQuality_LOW:    {320, 180},
+}
+
+// orderRIDs sorts rids from the lowest to the highest quality
+func orderRIDs(rids []string) []string {
+	for _, ranks := range ridRanks {
+		ordered := make([]string, len(ranks))
+		known := true
+		for _, rid := range rids {
+			rank, ok := ranks[strings.ToLower(rid)]
+			if !ok || ordered[rank] != "" {
+				known = false
+				break
+			}
+			ordered[rank] = rid
+		}
+		if !known {
+			continue
+		}
+		var out []string
+		for _, rid := range ordered {
+			if rid != "" {
+				out = append(out, rid)
+			}
+		}
+		return out
+	}
+	return append([]string(nil), rids...)
+}
+
+// simulcastGroup collects the rid layers of one simulcast video m-line and
+// publishes them to LiveKit as a single simulcast track
+type simulcastGroup struct {
+	s     *Server
+	state *whipState
+	id    string
+
+	lock      sync.Mutex
+	rids      []string
+	layers    map[string]*lksdk.LocalSampleTrack
+	published []*lksdk.LocalSampleTrack
+	agent     *roomAgent
+	timer     *time.Timer
+	active    int
+}
+
+// simulcastGroup returns the group of the m-line mid of state
+func (s *Server) simulcastGroup(state *whipState, mid string, rids []string) *simulcastGroup {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	g, ok := state.simulcast[mid]
+	if !ok {
+		g = &simulcastGroup{
+			s:      s,
+			state:  state,
+			id:     state.stream + "-" + mid,
+			rids:   orderRIDs(rids),
+			layers: make(map[string]*lksdk.LocalSampleTrack),
+		}
+		state.simulcast[mid] = g
+	}
+	return g
+}
+
+// quality maps rid to a LiveKit layer by its position in the group, false
+// for a rid the offer did not announce
+func (g *simulcastGroup) quality(rid string) (livekit.VideoQuality, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	index := -1
+	for i, r := range g.rids {
+		if r == rid {
+			index = i
+		}
+	}
+
+	switch {
+	case index < 0:
+		return 0, false
+	case index == len(g.rids)-1:
+		return livekit.VideoQuality_HIGH, true
+	case index == 0:
+		return livekit.VideoQuality_LOW, true
+	default:
+		return livekit.VideoQuality_MEDIUM, true
+	}
+}
+
+// add registers a layer, the group is published once every rid of the offer
+// has arrived or simulcastLayerWait after the first one
+func (g *simulcastGroup) add(rid string, layer *lksdk.LocalSampleTrack) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.active++
+	if g.published != nil {
+		log.Printf("simulcast layer %v of %v arrived after publishing, not sent to livekit", rid, g.id)
+		return
+	}
+	g.layers[rid] = layer
+	if len(g.layers) >= len(g.rids) {
+		g.publish()
+		return
+	}
+	if g.timer == nil {
+		g.timer = time.AfterFunc(simulcastLayerWait, func() {
+			g.lock.Lock()
+			defer g.lock.Unlock()
+			if g.published == nil && g.active > 0 {
+				log.Printf("publishing %v of %v simulcast layers of %v", len(g.layers), len(g.rids), g.id)
+				g.publish()
+			}
+		})
+	}
+}
+
+// publish sends the collected layers to LiveKit, g.lock must be held
+func (g *simulcastGroup) publish() {
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	for _, rid := range g.rids {
+		if layer, ok := g.layers[rid]; ok {
+			g.published = append(g.published, layer)
+		}
+	}
+	g.agent = g.s.acquireAgent(g.state.room, g.state.participant)
+	g.agent.publishSimulcast(g.published, lksdk.TrackPublicationOptions{Name: g.state.stream})
+}
+
+// done drops a layer, the track is unpublished with the last one
+func (g *simulcastGroup) done() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.active--; g.active > 0 {
+		return
+	}
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	if g.agent != nil {
+		g.agent.unpublish(g.state.stream, g.published[0])
+		g.s.releaseAgent(g.agent)
+		g.agent = nil
+	}
+	g.published = nil
+	g.layers = make(map[string]*lksdk.LocalSampleTrack)
+}
+
+func depacketizerFor(codec webrtc.RTPCodecCapability) rtp.Depacketizer {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return &codecs.VP8Packet{}
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return &codecs.VP9Packet{}
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return &codecs.H264Packet{}
+	}
+	return nil
+}
+
+// publishSimulcastLayer forwards one rid of a simulcast WHIP track to its
+// LiveKit layer until the track ends. The highest layer also feeds the local
+// subscribers.
+func (s *Server) publishSimulcastLayer(state *whipState, pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	rid := track.RID()
+	mid := state.whipConn.Mid(receiver)
+	rids := state.whipConn.SimulcastRIDs(mid)
+	if len(rids) == 0 {
+		// without a=rid or a=simulcast there are no layers to group
+		log.Printf("no simulcast offered for rid %v of %v, published as a single track", rid, state.stream)
+		s.publishTrack(state, pc, track, receiver)
+		return
+	}
+	group := s.simulcastGroup(state, mid, rids)
+
+	depacketizer := depacketizerFor(track.Codec().RTPCodecCapability)
+	if depacketizer == nil {
+		log.Printf("simulcast is not supported for %v, layer %v of %v dropped", track.Codec().MimeType, rid, group.id)
+		return
+	}
+
+	metrics := s.metrics.publisher(state.room, state.stream, track.Kind())
+	defer metrics.close()
+	lkMetrics := s.metrics.subscriber(state.room, state.stream, track.Kind(), "livekit", track.Codec().ClockRate)
+	defer lkMetrics.close()
+	keyframes := s.pliRequester(pc, track, metrics)
+	defer keyframes.close()
+
+	quality, ok := group.quality(rid)
+	if !ok {
+		log.Printf("simulcast layer %v of %v was not offered, dropped", rid, group.id)
+		return
+	}
+	size := simulcastLayerSizes[quality]
+	layer, err := lksdk.NewLocalSampleTrack(track.Codec().RTPCodecCapability,
+		lksdk.WithSimulcast(group.id, &livekit.VideoLayer{Quality: quality, Width: size[0], Height: size[1]}),
+		lksdk.WithRTCPHandler(func(pkt rtcp.Packet) {
+			lkMetrics.observeRTCP([]rtcp.Packet{pkt})
+			if isKeyframeRequest([]rtcp.Packet{pkt}) {
+				keyframes.request()
+			}
+		}))
+	if err != nil {
+		log.Printf("failed to create simulcast layer %v of %v: %v", rid, group.id, err)
+		return
+	}
+	log.Printf("simulcast layer %v of %v as %v", rid, group.id, quality)
+
+	var pubTrack *webrtc.TrackLocalStaticRTP
+	var gop *gopCache
+	var recorder *trackRecorder
+	var hls *mp4Track
+	if quality == livekit.VideoQuality_HIGH {
+		pubTrack, gop = s.addTrack(state, track, keyframes)
+		defer s.removeTrack(state, pubTrack)
+		// the highest layer is the one recorded and served over HLS
+		if state.record {
+			recorder = s.newTrackRecorder(state, track.Codec())
+			defer recorder.close()
+		}
+		if hls = s.newHLSTrack(state, track.Codec()); hls != nil {
+			defer hls.Close()
+		}
+	}
+
+	group.add(rid, layer)
+	defer group.done()
+
+	builder := samplebuilder.New(simulcastMaxLate, depacketizer, track.Codec().ClockRate)
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		metrics.forwarded(pkt)
+
+		if pubTrack != nil {
+			// the publisher's mid and rid extensions mean nothing to the subscribers
+			local := *pkt
+			local.Header.Extension = false
+			local.Header.Extensions = nil
+			if err = pubTrack.WriteRTP(&local); err != nil {
+				return
+			}
+			recorder.write(&local)
+			if hls != nil {
+				hls.WriteRTP(&local)
+			}
+			if gop != nil {
+				gop.write(&local)
+			}
+		}
+
+		builder.Push(pkt)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			if err = layer.WriteSample(*sample, nil); err != nil {
+				log.Printf("failed to write simulcast layer %v of %v: %v", rid, group.id, err)
+			}
+		}
+	}
+}
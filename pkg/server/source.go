@@ -0,0 +1,351 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/util"
+	lkauth "github.com/livekit/protocol/auth"
+	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// sourceSubscribeTimeout bounds how long a WHEP offer waits for the tracks
+	// of a LiveKit participant to be subscribed
+	sourceSubscribeTimeout = 5 * time.Second
+)
+
+var (
+	errParticipantNotFound = errors.New("participant not found")
+	errNoParticipantTracks = errors.New("participant has no subscribable tracks")
+)
+
+// sourceTrack is a subscribed LiveKit track and its copy for WHEP viewers
+type sourceTrack struct {
+	participant string
+	remote      *webrtc.TrackRemote
+	local       *webrtc.TrackLocalStaticRTP
+	// keyframes forwards the viewers' keyframe requests, nil for audio
+	keyframes *keyframeRequester
+}
+
+// participantSource subscribes to the tracks of a native LiveKit participant,
+// or of the whole room when identity is empty, through a hidden participant
+// and forwards them to WHEP viewers. It is shared and reference counted by the
+// viewers of the same participant or room.
+type participantSource struct {
+	s        *Server
+	room     string
+	identity string
+
+	start sync.Once
+	err   error
+
+	lock       sync.Mutex
+	conn       *lksdk.Room
+	rp         *lksdk.RemoteParticipant
+	refs       int
+	tracks     map[string]*sourceTrack
+	subscribed chan struct{}
+	// listeners are called whenever a track is added or removed
+	listeners  map[int]func()
+	listenerId int
+}
+
+// acquireSource returns the connected source of participant identity in room,
+// or of the whole room for an empty identity, creating it if needed. Every
+// successful call must be paired with releaseSource.
+func (s *Server) acquireSource(room, identity string) (*participantSource, error) {
+	key := room + "/" + identity
+
+	s.sourcesLock.Lock()
+	src, ok := s.sources[key]
+	if !ok {
+		src = &participantSource{
+			s:          s,
+			room:       room,
+			identity:   identity,
+			tracks:     make(map[string]*sourceTrack),
+			subscribed: make(chan struct{}, 1),
+			listeners:  make(map[int]func()),
+		}
+		s.sources[key] = src
+	}
+	src.refs++
+	s.sourcesLock.Unlock()
+
+	src.start.Do(src.connect)
+	if src.err != nil {
+		s.releaseSource(src)
+		return nil, src.err
+	}
+	return src, nil
+}
+
+// releaseSource drops a reference, the source leaves the room with the last one
+func (s *Server) releaseSource(src *participantSource) {
+	key := src.room + "/" + src.identity
+
+	s.sourcesLock.Lock()
+	src.refs--
+	last := src.refs <= 0
+	if last && s.sources[key] == src {
+		delete(s.sources, key)
+	}
+	s.sourcesLock.Unlock()
+
+	if last {
+		src.close()
+	}
+}
+
+// closeSources disconnects every source regardless of its references
+func (s *Server) closeSources() {
+	s.sourcesLock.Lock()
+	sources := s.sources
+	s.sources = make(map[string]*participantSource)
+	s.sourcesLock.Unlock()
+
+	for _, src := range sources {
+		src.close()
+	}
+}
+
+// connect joins the room and subscribes to every track of the participant,
+// waiting up to sourceSubscribeTimeout for them to arrive. A whole-room source
+// subscribes to every track as it is published and does not wait.
+func (src *participantSource) connect() {
+	at := lkauth.NewAccessToken(src.s.conf.LiveKitServer.APIKey, src.s.conf.LiveKitServer.APISecret)
+	canPublish := false
+	at.AddGrant(&lkauth.VideoGrant{
+		RoomJoin:   true,
+		Room:       src.room,
+		Hidden:     true,
+		CanPublish: &canPublish,
+	}).SetIdentity("whep-" + util.RandomString(12))
+	token, err := at.ToJWT()
+	if err != nil {
+		src.err = err
+		return
+	}
+
+	cb := lksdk.NewRoomCallback()
+	cb.OnTrackSubscribed = func(track *webrtc.TrackRemote, pub *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+		if src.identity == "" || rp.Identity() == src.identity {
+			src.addTrack(pub.SID(), rp, track)
+		}
+	}
+	cb.OnTrackUnsubscribed = func(track *webrtc.TrackRemote, pub *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+		if src.identity == "" || rp.Identity() == src.identity {
+			src.removeTrack(pub.SID())
+		}
+	}
+
+	conn, err := lksdk.ConnectToRoomWithToken(src.s.conf.LiveKitServer.Server, token, cb, lksdk.WithAutoSubscribe(src.identity == ""))
+	if err != nil {
+		src.err = err
+		return
+	}
+
+	if src.identity == "" {
+		src.lock.Lock()
+		src.conn = conn
+		src.lock.Unlock()
+		log.Printf("subscribed to room %v", src.room)
+		return
+	}
+
+	var rp *lksdk.RemoteParticipant
+	for _, p := range conn.GetParticipants() {
+		if p.Identity() == src.identity {
+			rp = p
+			break
+		}
+	}
+	if rp == nil {
+		conn.Disconnect()
+		src.err = errParticipantNotFound
+		return
+	}
+
+	src.lock.Lock()
+	src.conn = conn
+	src.rp = rp
+	src.lock.Unlock()
+
+	expected := 0
+	for _, pub := range rp.Tracks() {
+		if rpub, ok := pub.(*lksdk.RemoteTrackPublication); ok {
+			if err := rpub.SetSubscribed(true); err != nil {
+				log.Println("failed to subscribe to", src.identity, rpub.SID(), err)
+				continue
+			}
+			expected++
+		}
+	}
+	if expected == 0 {
+		src.err = errNoParticipantTracks
+		return
+	}
+
+	timeout := time.After(sourceSubscribeTimeout)
+wait:
+	for len(src.localTracks()) < expected {
+		select {
+		case <-src.subscribed:
+		case <-timeout:
+			break wait
+		}
+	}
+
+	n := len(src.localTracks())
+	if n == 0 {
+		src.err = errNoParticipantTracks
+		return
+	}
+	if n < expected {
+		log.Printf("subscribed to %v of %v tracks of %v within %v", n, expected, src.identity, sourceSubscribeTimeout)
+	}
+	log.Printf("subscribed to participant %v in room %v", src.identity, src.room)
+}
+
+func (src *participantSource) addTrack(sid string, rp *lksdk.RemoteParticipant, remote *webrtc.TrackRemote) {
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), rp.Identity())
+	if err != nil {
+		log.Println("failed to create local track for", sid, err)
+		return
+	}
+
+	var keyframes *keyframeRequester
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		keyframes = newKeyframeRequester(func() { rp.WritePLI(remote.SSRC()) }, 0)
+	}
+
+	src.lock.Lock()
+	if old, ok := src.tracks[sid]; ok {
+		old.keyframes.close()
+	}
+	src.tracks[sid] = &sourceTrack{participant: rp.Identity(), remote: remote, local: local, keyframes: keyframes}
+	src.lock.Unlock()
+
+	select {
+	case src.subscribed <- struct{}{}:
+	default:
+	}
+	src.notify()
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			i, _, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+
+			if _, err = local.Write(buf[:i]); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (src *participantSource) removeTrack(sid string) {
+	src.lock.Lock()
+	if t, ok := src.tracks[sid]; ok {
+		t.keyframes.close()
+		delete(src.tracks, sid)
+	}
+	src.lock.Unlock()
+
+	src.notify()
+}
+
+// onChange registers fn to be called whenever a track is added or removed
+// and returns a function that unregisters it
+func (src *participantSource) onChange(fn func()) func() {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+
+	src.listenerId++
+	id := src.listenerId
+	src.listeners[id] = fn
+	return func() {
+		src.lock.Lock()
+		delete(src.listeners, id)
+		src.lock.Unlock()
+	}
+}
+
+func (src *participantSource) notify() {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+
+	for _, fn := range src.listeners {
+		go fn()
+	}
+}
+
+// sourceTracks returns the subscribed tracks by publication sid
+func (src *participantSource) sourceTracks() map[string]*sourceTrack {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+
+	tracks := make(map[string]*sourceTrack, len(src.tracks))
+	for sid, t := range src.tracks {
+		tracks[sid] = t
+	}
+	return tracks
+}
+
+// localTracks returns the tracks to add to a WHEP viewer
+func (src *participantSource) localTracks() []webrtc.TrackLocal {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+
+	var tracks []webrtc.TrackLocal
+	for _, t := range src.tracks {
+		tracks = append(tracks, t.local)
+	}
+	return tracks
+}
+
+// keyframeRequesters returns the keyframe requesters of the video tracks by
+// local track id
+func (src *participantSource) keyframeRequesters() map[string]*keyframeRequester {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+
+	requesters := make(map[string]*keyframeRequester)
+	for _, t := range src.tracks {
+		if t.keyframes != nil {
+			requesters[t.local.ID()] = t.keyframes
+		}
+	}
+	return requesters
+}
+
+// pictureLossIndication asks for a keyframe on every video track
+func (src *participantSource) pictureLossIndication() {
+	for _, k := range src.keyframeRequesters() {
+		k.request()
+	}
+}
+
+func (src *participantSource) close() {
+	src.lock.Lock()
+	conn := src.conn
+	src.conn = nil
+	src.rp = nil
+	for _, t := range src.tracks {
+		t.keyframes.close()
+	}
+	src.lock.Unlock()
+
+	if conn != nil {
+		conn.Disconnect()
+		log.Printf("unsubscribed from participant %v in room %v", src.identity, src.room)
+	}
+}
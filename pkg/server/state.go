@@ -0,0 +1,228 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/pion/webrtc/v3"
+)
+
+var errStreamTaken = errors.New("stream is already published")
+
+type whipState struct {
+	created   time.Time
+	stream    string
+	room      string
+	publish   bool
+	whipConn  *whip.WHIPConn
+	pubTracks map[string]*webrtc.TrackLocalStaticRTP
+	// keyframes holds the keyframe requesters of the video pubTracks by track id
+	keyframes map[string]*keyframeRequester
+	// gops holds the GOP caches of the VP8 and H264 pubTracks by track id
+	gops map[string]*gopCache
+	// participant is the LiveKit participant that publishes the tracks
+	participant participantInfo
+	// viewer is set for whole-room WHEP sessions
+	viewer *roomViewer
+	// simulcast holds the simulcast video m-lines of a publisher by mid
+	simulcast map[string]*simulcastGroup
+	// slots holds the senders of a /whip/subscribe session by media kind
+	slots map[webrtc.RTPCodecType]*subscriberSlot
+	// record is set when a publisher's tracks are recorded to files
+	record bool
+	// offered holds the codecs of the publisher's offer by media kind
+	offered map[webrtc.RTPCodecType]webrtc.RTPCodecCapability
+	// ingest is set for a publisher without a whipConn, plain RTP over UDP
+	// or a pulled RTSP stream
+	ingest ingestSession
+}
+
+// ingestSession is the publisher of a session without a whipConn
+type ingestSession interface {
+	close()
+	connectionState() webrtc.PeerConnectionState
+	codecs() []string
+	bytesReceived() uint64
+}
+
+// addIngestSession adds the publish session of an ingest, the stream must
+// not be published already. s.listLock must be held.
+func (s *Server) addIngestSession(id string, state *whipState) error {
+	if s.closed {
+		return errors.New("server is shutting down")
+	}
+	for _, wc := range s.conns {
+		if wc.publish && wc.room == state.room && wc.stream == state.stream {
+			return errStreamTaken
+		}
+	}
+	s.conns[id] = state
+	s.sessionStarted(id, state)
+	return nil
+}
+
+// removeIngestSession takes the session of an ingest that stopped out of
+// s.conns, unless it was removed already
+func (s *Server) removeIngestSession(id string, state *whipState) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	if s.conns[id] == state {
+		delete(s.conns, id)
+		s.sessionRemoved(id, state)
+	}
+}
+
+// addTrack creates the local copy of a published track for the subscribers,
+// and the GOP cache of a video track when its codec is supported
+func (s *Server) addTrack(w *whipState, t *webrtc.TrackRemote, keyframes *keyframeRequester) (*webrtc.TrackLocalStaticRTP, *gopCache) {
+	s.listLock.Lock()
+	defer func() {
+		s.listLock.Unlock()
+	}()
+
+	trackLocal, gop := s.newLocalTrack(t)
+	s.attachTrack(w, trackLocal, keyframes, gop)
+	return trackLocal, gop
+}
+
+func (s *Server) newLocalTrack(t trackSource) (*webrtc.TrackLocalStaticRTP, *gopCache) {
+	// Create a new TrackLocal with the same codec as our incoming
+	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
+	if err != nil {
+		panic(err)
+	}
+
+	var gop *gopCache
+	if t.Kind() == webrtc.RTPCodecTypeVideo {
+		gop = newGOPCache(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
+	}
+	return trackLocal, gop
+}
+
+// attachTrack makes a local track available to the subscribers of w,
+// s.listLock must be held
+func (s *Server) attachTrack(w *whipState, t *webrtc.TrackLocalStaticRTP, keyframes *keyframeRequester, gop *gopCache) {
+	w.pubTracks[t.ID()] = t
+	if keyframes != nil {
+		w.keyframes[t.ID()] = keyframes
+	}
+	if gop != nil {
+		w.gops[t.ID()] = gop
+	}
+	s.attachSubscribers(w, t, keyframes)
+}
+
+func (s *Server) removeTrack(w *whipState, t *webrtc.TrackLocalStaticRTP) {
+	s.listLock.Lock()
+	defer func() {
+		s.listLock.Unlock()
+	}()
+
+	delete(w.pubTracks, t.ID())
+	delete(w.keyframes, t.ID())
+	delete(w.gops, t.ID())
+}
+
+// close ends the session's peer connection, or its ingest
+func (w *whipState) close() {
+	if w.ingest != nil {
+		w.ingest.close()
+		return
+	}
+	w.whipConn.Close()
+}
+
+// connectionState is the state of the session's peer connection. An ingest
+// is connected while it receives.
+func (w *whipState) connectionState() webrtc.PeerConnectionState {
+	if w.ingest != nil {
+		return w.ingest.connectionState()
+	}
+	return w.whipConn.ConnectionState()
+}
+
+// sessionType names the kind of session for the metrics and the admin API
+func (w *whipState) sessionType() string {
+	switch {
+	case w.publish:
+		return "publish"
+	case w.viewer != nil:
+		return "whep_room"
+	case w.slots != nil:
+		return "subscribe"
+	}
+	return "whep"
+}
+
+func (s *Server) printWhipState() {
+	log.Printf("State for whip:")
+	for key, conn := range s.conns {
+		streamType := "\tpublisher"
+		if !conn.publish {
+			streamType = "\tsubscriber"
+		}
+		log.Printf("%v: room: %v, stream: %v, resourceId: [%v]", streamType, conn.room, conn.stream, key)
+	}
+}
+
+// onConnectionStateChange removes the resource once its peer connection is
+// closed. A disconnected or failed connection is kept for iceRestartTimeout so
+// that the client can restart ICE without losing its tracks and LiveKit
+// publications.
+func (s *Server) onConnectionStateChange(resourceId string, state webrtc.PeerConnectionState) {
+	s.listLock.RLock()
+	if conn, found := s.conns[resourceId]; found {
+		ev := sessionEvent(eventConnectionState, resourceId, conn)
+		ev.State = state.String()
+		s.events.emit(ev)
+	}
+	s.listLock.RUnlock()
+
+	switch state {
+	case webrtc.PeerConnectionStateClosed:
+		s.removeConn(resourceId)
+	case webrtc.PeerConnectionStateFailed:
+		time.AfterFunc(iceRestartTimeout, func() {
+			s.listLock.RLock()
+			conn, found := s.conns[resourceId]
+			s.listLock.RUnlock()
+			if found && conn.connectionState() != webrtc.PeerConnectionStateConnected {
+				log.Printf("no ice restart for %v within %v", resourceId, iceRestartTimeout)
+				s.removeConn(resourceId)
+			}
+		})
+	}
+}
+
+func (s *Server) removeConn(resourceId string) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	if state, found := s.conns[resourceId]; found {
+		state.close()
+		delete(s.conns, resourceId)
+		s.sessionRemoved(resourceId, state)
+		streamType := "publish"
+		if !state.publish {
+			streamType = "subscribe"
+		}
+		log.Printf("%v stream conn removed  %v", streamType, resourceId)
+	}
+}
+
+func (s *Server) createAgent(roomName string, callback *lksdk.RoomCallback, participant participantInfo) (*lksdk.Room, error) {
+	room, err := lksdk.ConnectToRoom(s.conf.LiveKitServer.Server, lksdk.ConnectInfo{
+		APIKey:              s.conf.LiveKitServer.APIKey,
+		APISecret:           s.conf.LiveKitServer.APISecret,
+		RoomName:            roomName,
+		ParticipantIdentity: participant.Identity,
+		ParticipantName:     participant.Name,
+		ParticipantMetadata: participant.Metadata,
+	}, callback)
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
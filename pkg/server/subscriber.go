@@ -0,0 +1,132 @@
+package server
+
+import (
+	"log"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	"github.com/pion/webrtc/v3"
+)
+
+// subscriberSlot is the sender of one media kind of a /whip/subscribe
+// session. It carries the publisher's track of that kind, or a placeholder
+// while the stream is not live.
+type subscriberSlot struct {
+	sender  *webrtc.RTPSender
+	metrics *subscriberMetrics
+	// keyframes is the requester of the current track, guarded by s.listLock
+	keyframes *keyframeRequester
+}
+
+// addSubscriberSlots adds a sender for every media kind of a subscriber's
+// offer. Kinds the publisher already sends get its tracks right away, the
+// others are attached by attachSubscribers once the publisher arrives.
+// s.listLock must be held.
+func (s *Server) addSubscriberSlots(sub *whipState, offer webrtc.SessionDescription, publisher *whipState) error {
+	live := make(map[webrtc.RTPCodecType]string)
+	if publisher != nil {
+		for id, track := range publisher.pubTracks {
+			if _, ok := live[track.Kind()]; !ok {
+				live[track.Kind()] = id
+			}
+		}
+	}
+
+	for kind, codec := range whip.OfferedCodecs(offer) {
+		var track webrtc.TrackLocal
+		var keyframes *keyframeRequester
+		if id, ok := live[kind]; ok {
+			track = publisher.pubTracks[id]
+			keyframes = publisher.keyframes[id]
+		} else {
+			// a track replaces the placeholder only with the codec negotiated
+			// for it, the publisher's is taken when the subscriber offers it
+			if known, ok := s.publisherCodec(sub, publisher, kind); ok && whip.OffersCodec(offer, kind, known) {
+				codec = known
+			}
+			placeholder, err := webrtc.NewTrackLocalStaticRTP(codec, kind.String(), sub.stream)
+			if err != nil {
+				return err
+			}
+			track = placeholder
+		}
+
+		sender, err := sub.whipConn.AddTrack(track)
+		if err != nil {
+			return err
+		}
+		slot := &subscriberSlot{sender: sender, metrics: s.localTrackMetrics(sub.room, sub.stream, "subscribe", track), keyframes: keyframes}
+		sub.slots[kind] = slot
+		go s.readSlotRTCP(slot)
+	}
+	return nil
+}
+
+// publisherCodec returns the codec of kind the publisher of sub's stream
+// sends, or sent before it lost its connection. s.listLock must be held.
+func (s *Server) publisherCodec(sub, publisher *whipState, kind webrtc.RTPCodecType) (webrtc.RTPCodecCapability, bool) {
+	if publisher != nil {
+		if codec, ok := publisher.offered[kind]; ok {
+			return codec, true
+		}
+	}
+	if p, ok := s.published[publishedTrackKey(sub, kind)]; ok {
+		return p.local.Codec(), true
+	}
+	return webrtc.RTPCodecCapability{}, false
+}
+
+// attachSubscribers switches the waiting subscribers of the publisher's
+// stream to a newly published track. A subscriber that did not negotiate the
+// track's codec cannot receive it, it is closed so that its client offers
+// again. s.listLock must be held.
+func (s *Server) attachSubscribers(publisher *whipState, track *webrtc.TrackLocalStaticRTP, keyframes *keyframeRequester) {
+	for id, sub := range s.conns {
+		if sub.publish || sub.room != publisher.room || sub.stream != publisher.stream {
+			continue
+		}
+		slot, ok := sub.slots[track.Kind()]
+		if !ok || slot.sender.Track() == track {
+			continue
+		}
+		if err := sub.whipConn.ReplaceTrack(slot.sender, track); err != nil {
+			log.Printf("failed to attach %v %v track of %v to subscriber %v, closing it: %v",
+				track.Codec().MimeType, track.Kind(), publisher.stream, id, err)
+			go sub.whipConn.Close()
+			continue
+		}
+		slot.keyframes = keyframes
+		keyframes.request()
+		log.Printf("subscriber %v attached to %v track of %v", id, track.Kind(), publisher.stream)
+	}
+}
+
+// readSlotRTCP forwards the subscriber's keyframe requests to the publisher
+// of the slot's current track
+func (s *Server) readSlotRTCP(slot *subscriberSlot) {
+	defer slot.metrics.close()
+	for {
+		pkts, _, err := slot.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		slot.metrics.observeRTCP(pkts)
+		if isKeyframeRequest(pkts) {
+			s.listLock.RLock()
+			keyframes := slot.keyframes
+			s.listLock.RUnlock()
+			keyframes.request()
+		}
+	}
+}
+
+// slotKeyframes returns the requesters of the tracks sub currently receives.
+// s.listLock must be held.
+func slotKeyframes(sub *whipState) []*keyframeRequester {
+	var keyframes []*keyframeRequester
+	for _, slot := range sub.slots {
+		if slot.keyframes != nil {
+			keyframes = append(keyframes, slot.keyframes)
+		}
+	}
+	return keyframes
+}
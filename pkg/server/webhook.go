@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookQueueSize is how many events may wait for delivery to one url
+	// before new ones are dropped
+	webhookQueueSize = 256
+	// webhookMaxAttempts bounds the deliveries of an event to one url
+	webhookMaxAttempts = 5
+	// webhookMinBackoff is the wait before the first retry, doubled after
+	// every failed attempt
+	webhookMinBackoff = time.Second
+	// webhookTimeout bounds one delivery attempt
+	webhookTimeout = 10 * time.Second
+
+	webhookSignatureHeader = "X-Whip-Signature"
+	webhookKeyHeader       = "X-Whip-Key"
+)
+
+// webhookEvents are the event types delivered to the webhooks. The end of a
+// publish or subscribe session is a session_removed event, its sessionType
+// tells which.
+var webhookEvents = map[string]bool{
+	eventPublishStarted:     true,
+	eventSubscriberJoined:   true,
+	eventSessionRemoved:     true,
+	eventTrackPublishFailed: true,
+	eventAgentConnectFailed: true,
+}
+
+// webhookNotifier posts the lifecycle events to the configured urls. Each url
+// has a queue of its own, delivered in order in the background so that the
+// WHIP requests never wait for a webhook.
+type webhookNotifier struct {
+	key    string
+	secret string
+	client *http.Client
+
+	stop      func()
+	endpoints []*webhookEndpoint
+	// abort ends the pending retries once the shutdown deadline is reached
+	abort chan struct{}
+	done  sync.WaitGroup
+}
+
+type webhookEndpoint struct {
+	url   string
+	queue chan []byte
+}
+
+// newWebhookNotifier starts delivering the events of s to s.conf.Webhook.URLs,
+// it returns nil when none is configured
+func newWebhookNotifier(s *Server) *webhookNotifier {
+	if len(s.conf.Webhook.URLs) == 0 {
+		return nil
+	}
+
+	n := &webhookNotifier{
+		key:    s.conf.LiveKitServer.APIKey,
+		secret: s.conf.LiveKitServer.APISecret,
+		client: &http.Client{Timeout: webhookTimeout},
+		abort:  make(chan struct{}),
+	}
+	for _, url := range s.conf.Webhook.URLs {
+		e := &webhookEndpoint{url: url, queue: make(chan []byte, webhookQueueSize)}
+		n.endpoints = append(n.endpoints, e)
+		n.done.Add(1)
+		go n.deliverLoop(e)
+	}
+
+	events, stop := s.events.listen()
+	n.stop = stop
+	go n.dispatch(events)
+	return n
+}
+
+// dispatch queues the webhook events for every url until events is closed
+func (n *webhookNotifier) dispatch(events <-chan serverEvent) {
+	defer func() {
+		for _, e := range n.endpoints {
+			close(e.queue)
+		}
+	}()
+
+	for ev := range events {
+		if !webhookEvents[ev.Type] {
+			continue
+		}
+		body, err := json.Marshal(ev)
+		if err != nil {
+			log.Println("failed to encode webhook event", err)
+			continue
+		}
+		for _, e := range n.endpoints {
+			select {
+			case e.queue <- body:
+			default:
+				log.Printf("webhook queue of %v is full, %v event dropped", e.url, ev.Type)
+			}
+		}
+	}
+}
+
+func (n *webhookNotifier) deliverLoop(e *webhookEndpoint) {
+	defer n.done.Done()
+	for body := range e.queue {
+		select {
+		case <-n.abort:
+			// drain the queue without delivering
+		default:
+			n.deliver(e.url, body)
+		}
+	}
+}
+
+// deliver posts body to url, retrying with backoff on network errors, 429 and
+// 5xx answers
+func (n *webhookNotifier) deliver(url string, body []byte) {
+	backoff := webhookMinBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(url, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookMaxAttempts {
+			log.Printf("webhook %v failed after %v attempts: %v", url, attempt, err)
+			return
+		}
+		log.Printf("webhook %v failed: %v, retry in %v", url, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-n.abort:
+			log.Printf("webhook %v abandoned on shutdown", url)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post makes one delivery attempt. retry tells whether a failure may succeed
+// on a later attempt.
+func (n *webhookNotifier) post(url string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookKeyHeader, n.key)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(n.secret, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %v", resp.Status)
+}
+
+// signWebhook is the hex HMAC-SHA256 of body keyed with secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// close stops listening for events and waits for the queued ones to be
+// delivered, abandoning the retries once ctx is done
+func (n *webhookNotifier) close(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	n.stop()
+
+	done := make(chan struct{})
+	go func() {
+		n.done.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		close(n.abort)
+		<-done
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/util"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+func (s *Server) handleWHEPOptions(w http.ResponseWriter, r *http.Request) {
+	setWHEPHeaders(w)
+	w.Header().Set("Accept-Post", "application/sdp")
+	w.Header().Set("Accept-Patch", whip.MimeTypeSDPFragment)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleWHEPPost(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	streamId := vars["stream"]
+	setWHEPHeaders(w)
+	if _, ok := s.authorize(w, r, roomId, streamId, false); !ok {
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		httpError(w, http.StatusUnsupportedMediaType, "415 - offer must be application/sdp")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		httpError(w, http.StatusBadRequest, "400 - missing sdp offer")
+		return
+	}
+	log.Printf("WHEP Post: roomId => %v, streamId => %v, body = %v", roomId, streamId, string(body))
+
+	s.listLock.Lock()
+	if s.closed {
+		s.listLock.Unlock()
+		httpError(w, http.StatusServiceUnavailable, "503 - whip server is shutting down")
+		return
+	}
+
+	var publisher *whipState
+	var tracks []webrtc.TrackLocal
+	var keyframes map[string]*keyframeRequester
+	var gops map[string]*gopCache
+	for _, wc := range s.conns {
+		if wc.publish && wc.room == roomId && wc.stream == streamId {
+			publisher = wc
+			break
+		}
+	}
+	if publisher != nil {
+		// cached video tracks start each viewer from the last keyframe
+		gops = make(map[string]*gopCache, len(publisher.gops))
+		for id, track := range publisher.pubTracks {
+			if gop, ok := publisher.gops[id]; ok {
+				gops[id] = gop
+				tracks = append(tracks, gop.newTrack())
+			} else {
+				tracks = append(tracks, track)
+			}
+		}
+		keyframes = make(map[string]*keyframeRequester, len(publisher.keyframes))
+		for id, k := range publisher.keyframes {
+			keyframes[id] = k
+		}
+	}
+	s.listLock.Unlock()
+
+	// streams not published over WHIP are looked up as LiveKit participants
+	var source *participantSource
+	if publisher == nil {
+		source, err = s.acquireSource(roomId, streamId)
+		if err == errParticipantNotFound || err == errNoParticipantTracks {
+			httpError(w, http.StatusNotFound, fmt.Sprintf("404 - no publisher or participant for room: %v, stream: %v", roomId, streamId))
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusBadGateway, fmt.Sprintf("502 - failed to subscribe to livekit participant %v: %v", streamId, err))
+			return
+		}
+		tracks = source.localTracks()
+		keyframes = source.keyframeRequesters()
+	}
+
+	whep, err := whip.NewWHIPConn()
+	if err != nil {
+		if source != nil {
+			s.releaseSource(source)
+		}
+		httpError(w, http.StatusInternalServerError, "500 - failed to create whep conn!")
+		return
+	}
+
+	// the source is released once the viewer's peer connection is closed
+	var releaseOnce sync.Once
+	release := func() {
+		if source != nil {
+			releaseOnce.Do(func() { s.releaseSource(source) })
+		}
+	}
+
+	for _, track := range tracks {
+		sender, err := whep.AddTrack(track)
+		if err != nil {
+			whep.Close()
+			release()
+			httpError(w, http.StatusInternalServerError, fmt.Sprintf("500 - failed to add track: %v", err))
+			return
+		}
+		go readRTCP(sender, keyframes[track.ID()], s.localTrackMetrics(roomId, streamId, "whep", track))
+	}
+
+	uniqueResourceId := "whep-" + streamId + "-" + util.RandomString(12)
+
+	whep.OnConnectionStateChange = func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed {
+			release()
+		}
+		s.onConnectionStateChange(uniqueResourceId, state)
+	}
+
+	answer, err := whep.Offer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
+	if err != nil {
+		release()
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("400 - failed to answer whep conn: %v", err))
+		return
+	}
+
+	s.listLock.Lock()
+	if s.closed {
+		s.listLock.Unlock()
+		whep.Close()
+		release()
+		httpError(w, http.StatusServiceUnavailable, "503 - whip server is shutting down")
+		return
+	}
+	s.conns[uniqueResourceId] = &whipState{
+		created:   time.Now(),
+		stream:    streamId,
+		room:      roomId,
+		publish:   false,
+		whipConn:  whep,
+		pubTracks: make(map[string]*webrtc.TrackLocalStaticRTP),
+	}
+	s.sessionStarted(uniqueResourceId, s.conns[uniqueResourceId])
+	s.printWhipState()
+	s.listLock.Unlock()
+
+	// cached tracks wait for the next keyframe when the cache has none, other
+	// tracks need one once the viewer is connected
+	for id, k := range keyframes {
+		if gop, ok := gops[id]; ok {
+			if !gop.hasKeyframe() {
+				k.request()
+			}
+			continue
+		}
+		go func(k *keyframeRequester) {
+			time.Sleep(time.Second * 1)
+			k.request()
+		}(k)
+	}
+
+	log.Printf("send whep answer => %v", answer.SDP)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+roomId+"/"+uniqueResourceId)
+	w.Header().Set("ETag", iceETag(whep))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer.SDP))
+	s.metrics.offerAnswer.WithLabelValues("whep").Observe(time.Since(start).Seconds())
+}
+
+func (s *Server) handleWHEPPatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	resourceId := vars["resource"]
+	setWHEPHeaders(w)
+
+	log.Printf("WHEP Patch: roomId => %v, resourceId => %v", roomId, resourceId)
+
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// an ICE restart blocks on gathering, the session is patched unlocked
+	s.listLock.RLock()
+	state, found := s.conns[resourceId]
+	s.listLock.RUnlock()
+	if !found || state.room != roomId || state.publish {
+		httpError(w, http.StatusNotFound, "404 - resource "+resourceId+" not found")
+		return
+	}
+	if !allows(w, claims, state.room, state.stream, false) {
+		return
+	}
+
+	// whole-room sessions answer server offers with an application/sdp PATCH
+	if state.viewer != nil && strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(body) == 0 {
+			httpError(w, http.StatusBadRequest, "400 - missing sdp answer")
+			return
+		}
+		if err = state.viewer.setAnswer(string(body)); err != nil {
+			httpError(w, http.StatusConflict, fmt.Sprintf("409 - failed to apply answer: %v", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	handlePatch(w, r, state)
+}
+
+func (s *Server) handleWHEPDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	resourceId := vars["resource"]
+	setWHEPHeaders(w)
+
+	log.Printf("WHEP Delete: roomId => %v, resourceId => %v", roomId, resourceId)
+
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	state, found := s.conns[resourceId]
+	if !found || state.room != roomId || state.publish {
+		httpError(w, http.StatusNotFound, "404 - resource "+resourceId+" not found")
+		return
+	}
+	if !allows(w, claims, state.room, state.stream, false) {
+		return
+	}
+	state.whipConn.Close()
+	delete(s.conns, resourceId)
+	s.sessionRemoved(resourceId, state)
+	log.Printf("whep stream conn removed  %v", resourceId)
+	s.printWhipState()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/util"
+	"github.com/cloudwebrtc/livekit-whip-go/pkg/whip"
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+func (s *Server) handleWHIPPost(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	streamId := vars["stream"]
+	mode := vars["mode"]
+	claims, ok := s.authorize(w, r, roomId, streamId, mode == "publish")
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "400 - failed to read sdp offer")
+		return
+	}
+	log.Printf("Post: roomId => %v, streamId => %v, body = %v", roomId, streamId, string(body))
+
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	if s.closed {
+		httpError(w, http.StatusServiceUnavailable, "503 - whip server is shutting down")
+		return
+	}
+
+	if mode == "publish" {
+		for key, wc := range s.conns {
+			if wc.publish && wc.room == roomId && wc.stream == streamId {
+				// a reconnecting publisher replaces the session it lost, which
+				// waits for an ice restart. one that is still connecting or
+				// connected keeps the stream, and so does an rtp or rtsp ingest.
+				state := wc.connectionState()
+				lost := state == webrtc.PeerConnectionStateDisconnected || state == webrtc.PeerConnectionStateFailed
+				if !lost || wc.ingest != nil {
+					httpError(w, http.StatusInternalServerError, "500 - publish conn ["+streamId+"] already exist!")
+					return
+				}
+				log.Printf("publish conn %v replaced by a new connection", key)
+				wc.close()
+				delete(s.conns, key)
+				s.sessionRemoved(key, wc)
+			}
+		}
+	}
+
+	whipConn, err := whip.NewWHIPConn()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "500 - failed to create whip conn!")
+		return
+	}
+
+	state := &whipState{
+		created:     time.Now(),
+		stream:      streamId,
+		room:        roomId,
+		publish:     mode == "publish",
+		whipConn:    whipConn,
+		pubTracks:   make(map[string]*webrtc.TrackLocalStaticRTP),
+		keyframes:   make(map[string]*keyframeRequester),
+		gops:        make(map[string]*gopCache),
+		participant: s.publisherParticipant(r.URL.Query(), streamId, claims),
+		simulcast:   make(map[string]*simulcastGroup),
+		record:      mode == "publish" && s.recordRequested(r),
+		offered:     whip.OfferedCodecs(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}),
+	}
+
+	if mode == "publish" {
+		whipConn.OnTrack = func(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			s.publishing.Add(1)
+			defer s.publishing.Done()
+			if track.RID() != "" {
+				s.publishSimulcastLayer(state, pc, track, receiver)
+				return
+			}
+			s.publishTrack(state, pc, track, receiver)
+		}
+	}
+
+	// subscribers may arrive before the publisher, their tracks are attached
+	// whenever the stream goes live and survive the publisher reconnecting
+	if mode == "subscribe" {
+		var publisher *whipState
+		for _, wc := range s.conns {
+			if wc.publish && wc.room == roomId && wc.stream == streamId {
+				publisher = wc
+				break
+			}
+		}
+		state.slots = make(map[webrtc.RTPCodecType]*subscriberSlot)
+		if err := s.addSubscriberSlots(state, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}, publisher); err != nil {
+			whipConn.Close()
+			httpError(w, http.StatusInternalServerError, fmt.Sprintf("500 - failed to add track: %v", err))
+			return
+		}
+		if publisher != nil {
+			go func(keyframes []*keyframeRequester) {
+				time.Sleep(time.Second * 1)
+				for _, k := range keyframes {
+					k.request()
+				}
+			}(slotKeyframes(state))
+		} else {
+			log.Printf("subscriber of %v waits for its publisher", streamId)
+		}
+	}
+
+	uniqueResourceId := mode + "-" + streamId + "-" + util.RandomString(12)
+
+	whipConn.OnConnectionStateChange = func(state webrtc.PeerConnectionState) {
+		s.onConnectionStateChange(uniqueResourceId, state)
+	}
+
+	log.Printf("got offer => %v", string(body))
+	answer, err := whipConn.Offer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, fmt.Sprintf("failed to answer whip conn: %v", err))
+		return
+	}
+
+	s.conns[uniqueResourceId] = state
+	s.sessionStarted(uniqueResourceId, state)
+
+	log.Printf("send answer => %v", answer.SDP)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+roomId+"/"+uniqueResourceId)
+	w.Header().Set("ETag", iceETag(whipConn))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer.SDP))
+	s.metrics.offerAnswer.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+
+	s.printWhipState()
+}
+
+// publishTrack forwards a track published over WHIP to the LiveKit room and to
+// the local subscribers until the track ends
+func (s *Server) publishTrack(state *whipState, pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	p := s.claimTrack(state, pc, track)
+	defer s.releaseTrack(p, track)
+	if p.recorder != nil || p.hls != nil {
+		go p.readSenderReports(track, receiver)
+	}
+
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		if !p.write(track, pkt) {
+			return
+		}
+	}
+}
+
+func (s *Server) handleWHIPPatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	streamId := vars["stream"]
+	log.Printf("Patch: roomId => %v, streamId => %v", roomId, streamId)
+
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// an ICE restart blocks on gathering, the session is patched unlocked
+	s.listLock.RLock()
+	state, found := s.conns[streamId]
+	s.listLock.RUnlock()
+	if !found || state.room != roomId {
+		httpError(w, http.StatusNotFound, "404 - stream "+streamId+" not found")
+		return
+	}
+	if !allows(w, claims, state.room, state.stream, state.publish) {
+		return
+	}
+	handlePatch(w, r, state)
+}
+
+func (s *Server) handleWHIPDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomId := vars["room"]
+	streamId := vars["stream"]
+
+	log.Printf("Delete: roomId => %v, streamId => %v", roomId, streamId)
+
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	state, found := s.conns[streamId]
+	if !found || state.room != roomId {
+		httpError(w, http.StatusNotFound, "404 - stream "+streamId+" not found")
+		return
+	}
+	if !allows(w, claims, state.room, state.stream, state.publish) {
+		return
+	}
+	state.close()
+	delete(s.conns, streamId)
+	s.sessionRemoved(streamId, state)
+	streamType := "publish"
+	if !state.publish {
+		streamType = "subscribe"
+	}
+	log.Printf("%v stream conn removed  %v", streamType, streamId)
+	s.printWhipState()
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(streamId + " deleted"))
+}
+
+func (s *Server) handleWHIPList(w http.ResponseWriter, r *http.Request) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	var list []map[string]interface{}
+	for key, item := range s.conns {
+		details := make(map[string]interface{})
+
+		connType := "publish"
+		if !item.publish {
+			connType = "subscribe"
+		}
+		details["path"] = item.room + "/" + item.stream
+		details["type"] = connType
+		details["uniqueID"] = key
+		details["room"] = item.room
+		details["stream"] = item.stream
+		list = append(list, details)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,119 @@
+package whip
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// RTPMedia is a media of a plain RTP session description, as written by
+// ffmpeg or GStreamer for their RTP/UDP output
+type RTPMedia struct {
+	Kind  webrtc.RTPCodecType
+	Codec webrtc.RTPCodecParameters
+	// Address is the connection address, a multicast group or the local
+	// address to receive on. Empty means any local address.
+	Address  string
+	Port     int
+	RTCPPort int
+}
+
+// ParseRTPSession returns the media of a plain RTP session description that
+// carry a codec the WHIP conn supports, with the first such codec of each.
+// Payload types are resolved per media, as these descriptions often reuse
+// one dynamic payload type for audio and video.
+func ParseRTPSession(desc string) ([]RTPMedia, error) {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc)); err != nil {
+		return nil, err
+	}
+
+	var medias []RTPMedia
+	for _, m := range parsed.MediaDescriptions {
+		kind := webrtc.NewRTPCodecType(m.MediaName.Media)
+		if kind == 0 || m.MediaName.Port.Value == 0 {
+			continue
+		}
+		media := RTPMedia{Kind: kind, Port: m.MediaName.Port.Value, RTCPPort: m.MediaName.Port.Value + 1}
+
+		conn := parsed.ConnectionInformation
+		if m.ConnectionInformation != nil {
+			conn = m.ConnectionInformation
+		}
+		if conn != nil && conn.Address != nil {
+			// an IPv4 multicast address carries a TTL: 239.1.1.1/32
+			media.Address = strings.Split(conn.Address.Address, "/")[0]
+		}
+		if media.Address == "0.0.0.0" || media.Address == "::" {
+			media.Address = ""
+		}
+		if value, ok := m.Attribute("rtcp"); ok {
+			port, err := strconv.Atoi(strings.Fields(value + " ")[0])
+			if err == nil {
+				media.RTCPPort = port
+			}
+		}
+
+		for _, format := range m.MediaName.Formats {
+			pt, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+			codec, ok := rtpMediaCodec(m, uint8(pt))
+			if ok {
+				media.Codec = codec
+				break
+			}
+		}
+		if media.Codec.MimeType != "" {
+			medias = append(medias, media)
+		}
+	}
+	if len(medias) == 0 {
+		return nil, errors.New("no media with a supported codec")
+	}
+	return medias, nil
+}
+
+// rtpMediaCodec reads the rtpmap and fmtp of payload type pt of m
+func rtpMediaCodec(m *sdp.MediaDescription, pt uint8) (webrtc.RTPCodecParameters, bool) {
+	codec := webrtc.RTPCodecParameters{PayloadType: webrtc.PayloadType(pt)}
+	if pt == 8 {
+		// the static PCMA payload type needs no rtpmap
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: mineTypePCMA, ClockRate: 8000}
+	}
+	prefix := strconv.Itoa(int(pt)) + " "
+	for _, a := range m.Attributes {
+		if !strings.HasPrefix(a.Value, prefix) {
+			continue
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(a.Value, prefix))
+		switch a.Key {
+		case "rtpmap":
+			// name/clock rate[/channels]
+			parts := strings.Split(value, "/")
+			if len(parts) < 2 {
+				return codec, false
+			}
+			clockRate, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				return codec, false
+			}
+			codec.MimeType = m.MediaName.Media + "/" + parts[0]
+			codec.ClockRate = uint32(clockRate)
+			if len(parts) > 2 {
+				channels, _ := strconv.ParseUint(parts[2], 10, 16)
+				codec.Channels = uint16(channels)
+			}
+		case "fmtp":
+			codec.SDPFmtpLine = value
+		}
+	}
+	if codec.MimeType == "" || !isSupportedMimeType(codec.MimeType) {
+		return codec, false
+	}
+	return codec, true
+}
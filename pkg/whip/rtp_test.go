@@ -0,0 +1,91 @@
+package whip
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseRTPSession(t *testing.T) {
+	tests := []struct {
+		name string
+		desc string
+		want []RTPMedia
+		err  bool
+	}{
+		{
+			name: "ffmpeg video and audio",
+			desc: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=No Name\r\nc=IN IP4 192.168.1.141\r\nt=0 0\r\n" +
+				"m=video 5004 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\na=fmtp:96 packetization-mode=1; sprop-parameter-sets=Z0LAHtkA,aMuDyyA=\r\n" +
+				"m=audio 5006 RTP/AVP 96\r\na=rtpmap:96 opus/48000/2\r\n",
+			want: []RTPMedia{
+				{
+					Kind: webrtc.RTPCodecTypeVideo,
+					Codec: webrtc.RTPCodecParameters{
+						RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/H264", ClockRate: 90000, SDPFmtpLine: "packetization-mode=1; sprop-parameter-sets=Z0LAHtkA,aMuDyyA="},
+						PayloadType:        96,
+					},
+					Address: "192.168.1.141", Port: 5004, RTCPPort: 5005,
+				},
+				{
+					Kind: webrtc.RTPCodecTypeAudio,
+					Codec: webrtc.RTPCodecParameters{
+						RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/opus", ClockRate: 48000, Channels: 2},
+						PayloadType:        96,
+					},
+					Address: "192.168.1.141", Port: 5006, RTCPPort: 5007,
+				},
+			},
+		},
+		{
+			name: "static pcma, rtcp port and media address",
+			desc: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\n" +
+				"m=audio 6000 RTP/AVP 8\r\nc=IN IP4 239.1.1.1/32\r\na=rtcp:6010\r\n",
+			want: []RTPMedia{{
+				Kind: webrtc.RTPCodecTypeAudio,
+				Codec: webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mineTypePCMA, ClockRate: 8000},
+					PayloadType:        8,
+				},
+				Address: "239.1.1.1", Port: 6000, RTCPPort: 6010,
+			}},
+		},
+		{
+			name: "first supported format",
+			desc: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\n" +
+				"m=video 7000 RTP/AVP 97 98\r\na=rtpmap:97 H265/90000\r\na=rtpmap:98 VP8/90000\r\na=rtcp-mux\r\n",
+			want: []RTPMedia{{
+				Kind: webrtc.RTPCodecTypeVideo,
+				Codec: webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000},
+					PayloadType:        98,
+				},
+				Port: 7000, RTCPPort: 7001,
+			}},
+		},
+		{
+			name: "no supported codec",
+			desc: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=video 7000 RTP/AVP 97\r\na=rtpmap:97 H265/90000\r\n",
+			err:  true,
+		},
+		{
+			name: "disabled media",
+			desc: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=audio 0 RTP/AVP 8\r\n",
+			err:  true,
+		},
+		{name: "not an sdp", desc: "v=0\r\nbogus", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			medias, err := ParseRTPSession(test.desc)
+			if (err != nil) != test.err {
+				t.Fatalf("error %v, want an error: %v", err, test.err)
+			}
+			if !reflect.DeepEqual(medias, test.want) {
+				t.Fatalf("medias %+v, want %+v", medias, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package whip
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// MimeTypeSDPFragment is the content type used by WHIP/WHEP PATCH requests
+	MimeTypeSDPFragment = "application/trickle-ice-sdpfrag"
+)
+
+var (
+	errEmptySDPFragment   = errors.New("sdpfrag is empty")
+	errInvalidSDPFragment = errors.New("invalid sdpfrag line")
+	errUnknownMid         = errors.New("sdpfrag mid does not match any m-line")
+
+	// ErrICECredentialsMismatch is returned when a trickled fragment belongs to another ICE session
+	ErrICECredentialsMismatch = errors.New("sdpfrag ice credentials do not match the session")
+)
+
+// SDPFragmentMedia holds the candidates of one m-line of an sdpfrag
+type SDPFragmentMedia struct {
+	Media           string
+	Mid             string
+	Candidates      []string
+	EndOfCandidates bool
+}
+
+// SDPFragment is a parsed application/trickle-ice-sdpfrag body (RFC 8840)
+type SDPFragment struct {
+	ICEUfrag        string
+	ICEPwd          string
+	Media           []SDPFragmentMedia
+	EndOfCandidates bool
+}
+
+// HasEndOfCandidates reports whether the fragment signals end-of-candidates
+func (f *SDPFragment) HasEndOfCandidates() bool {
+	if f.EndOfCandidates {
+		return true
+	}
+	for _, m := range f.Media {
+		if m.EndOfCandidates {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSDPFragment parses the body of a trickle/restart PATCH request
+func ParseSDPFragment(body string) (*SDPFragment, error) {
+	frag := &SDPFragment{}
+	var media *SDPFragmentMedia
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return nil, errInvalidSDPFragment
+		}
+
+		switch line[0] {
+		case 'm':
+			frag.Media = append(frag.Media, SDPFragmentMedia{Media: line[2:]})
+			media = &frag.Media[len(frag.Media)-1]
+		case 'a':
+			key, value := line[2:], ""
+			if i := strings.Index(key, ":"); i >= 0 {
+				key, value = key[:i], key[i+1:]
+			}
+			switch key {
+			case "ice-ufrag":
+				frag.ICEUfrag = value
+			case "ice-pwd":
+				frag.ICEPwd = value
+			case "mid":
+				if media != nil {
+					media.Mid = value
+				}
+			case "candidate":
+				if media == nil {
+					return nil, errInvalidSDPFragment
+				}
+				media.Candidates = append(media.Candidates, value)
+			case "end-of-candidates":
+				if media != nil {
+					media.EndOfCandidates = true
+				} else {
+					frag.EndOfCandidates = true
+				}
+			}
+		}
+	}
+
+	if frag.ICEUfrag == "" && frag.ICEPwd == "" && len(frag.Media) == 0 && !frag.EndOfCandidates {
+		return nil, errEmptySDPFragment
+	}
+	return frag, nil
+}
+
+// Marshal encodes the fragment as an application/trickle-ice-sdpfrag body
+func (f *SDPFragment) Marshal() string {
+	var b strings.Builder
+	if f.ICEUfrag != "" {
+		b.WriteString("a=ice-ufrag:" + f.ICEUfrag + "\r\n")
+	}
+	if f.ICEPwd != "" {
+		b.WriteString("a=ice-pwd:" + f.ICEPwd + "\r\n")
+	}
+	if f.EndOfCandidates {
+		b.WriteString("a=end-of-candidates\r\n")
+	}
+	for _, m := range f.Media {
+		b.WriteString("m=" + m.Media + "\r\n")
+		if m.Mid != "" {
+			b.WriteString("a=mid:" + m.Mid + "\r\n")
+		}
+		for _, c := range m.Candidates {
+			b.WriteString("a=candidate:" + c + "\r\n")
+		}
+		if m.EndOfCandidates {
+			b.WriteString("a=end-of-candidates\r\n")
+		}
+	}
+	return b.String()
+}
+
+// SDPFragmentFromDescription builds the sdpfrag of the bundled transport of desc
+func SDPFragmentFromDescription(desc *webrtc.SessionDescription) (*SDPFragment, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	frag := &SDPFragment{}
+	frag.ICEUfrag, _ = parsed.Attribute("ice-ufrag")
+	frag.ICEPwd, _ = parsed.Attribute("ice-pwd")
+
+	if len(parsed.MediaDescriptions) == 0 {
+		return frag, nil
+	}
+
+	m := parsed.MediaDescriptions[0]
+	if ufrag, ok := m.Attribute("ice-ufrag"); ok {
+		frag.ICEUfrag = ufrag
+	}
+	if pwd, ok := m.Attribute("ice-pwd"); ok {
+		frag.ICEPwd = pwd
+	}
+
+	media := SDPFragmentMedia{
+		Media: m.MediaName.Media + " 9 " + strings.Join(m.MediaName.Protos, "/") + " " + strings.Join(m.MediaName.Formats, " "),
+	}
+	_, media.EndOfCandidates = m.Attribute("end-of-candidates")
+	media.Mid, _ = m.Attribute("mid")
+	for _, a := range m.Attributes {
+		if a.IsICECandidate() {
+			media.Candidates = append(media.Candidates, a.Value)
+		}
+	}
+	frag.Media = append(frag.Media, media)
+	return frag, nil
+}
+
+// mLineIndex returns the m-line index of mid in desc
+func mLineIndex(desc *webrtc.SessionDescription, mid string) (uint16, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return 0, err
+	}
+	for i, m := range parsed.MediaDescriptions {
+		if v, ok := m.Attribute("mid"); ok && v == mid {
+			return uint16(i), nil
+		}
+	}
+	return 0, errUnknownMid
+}
+
+// ReplaceICECredentials returns a copy of desc with the new ufrag/pwd and
+// without the candidates of the previous ICE session
+func ReplaceICECredentials(desc *webrtc.SessionDescription, ufrag, pwd string) (*webrtc.SessionDescription, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	rewrite := func(attrs []sdp.Attribute) []sdp.Attribute {
+		var out []sdp.Attribute
+		for _, a := range attrs {
+			switch {
+			case a.Key == "ice-ufrag":
+				a.Value = ufrag
+			case a.Key == "ice-pwd":
+				a.Value = pwd
+			case a.IsICECandidate(), a.Key == "end-of-candidates":
+				continue
+			}
+			out = append(out, a)
+		}
+		return out
+	}
+
+	parsed.Attributes = rewrite(parsed.Attributes)
+	for _, m := range parsed.MediaDescriptions {
+		m.Attributes = rewrite(m.Attributes)
+	}
+
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return &webrtc.SessionDescription{Type: desc.Type, SDP: string(raw)}, nil
+}
@@ -0,0 +1,95 @@
+package whip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSDPFragment(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want *SDPFragment
+		err  error
+	}{
+		{
+			name: "trickled candidates",
+			body: "a=ice-ufrag:EsAw\r\na=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\n" +
+				"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0 ufrag EsAw network-id 1\r\n" +
+				"a=candidate:3471623853 1 udp 2122194687 198.51.100.2 61765 typ host generation 0 ufrag EsAw network-id 2\r\n",
+			want: &SDPFragment{
+				ICEUfrag: "EsAw",
+				ICEPwd:   "P2uYro0UCOQ4zxjKXaWCBui1",
+				Media: []SDPFragmentMedia{{
+					Media: "audio 9 RTP/AVP 0",
+					Mid:   "0",
+					Candidates: []string{
+						"1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0 ufrag EsAw network-id 1",
+						"3471623853 1 udp 2122194687 198.51.100.2 61765 typ host generation 0 ufrag EsAw network-id 2",
+					},
+				}},
+			},
+		},
+		{
+			name: "end of candidates of a media",
+			body: "m=audio 9 RTP/AVP 0\na=mid:0\na=end-of-candidates\n",
+			want: &SDPFragment{Media: []SDPFragmentMedia{{Media: "audio 9 RTP/AVP 0", Mid: "0", EndOfCandidates: true}}},
+		},
+		{
+			name: "end of candidates of the session",
+			body: "a=end-of-candidates\r\n",
+			want: &SDPFragment{EndOfCandidates: true},
+		},
+		{
+			name: "ice restart",
+			body: "a=ice-ufrag:ZZZZ\r\na=ice-pwd:AskQ7+y3FNLW5Zq0BQ2ZjpZw\r\na=group:BUNDLE 0\r\n",
+			want: &SDPFragment{ICEUfrag: "ZZZZ", ICEPwd: "AskQ7+y3FNLW5Zq0BQ2ZjpZw"},
+		},
+		{name: "empty", body: "\r\n", err: errEmptySDPFragment},
+		{name: "unknown attributes only", body: "a=group:BUNDLE 0\r\n", err: errEmptySDPFragment},
+		{name: "not an sdp line", body: "candidate:1 1 udp 1 192.0.2.1 1 typ host\r\n", err: errInvalidSDPFragment},
+		{name: "candidate without media", body: "a=candidate:1 1 udp 1 192.0.2.1 1 typ host\r\n", err: errInvalidSDPFragment},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frag, err := ParseSDPFragment(test.body)
+			if err != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(frag, test.want) {
+				t.Fatalf("fragment %+v, want %+v", frag, test.want)
+			}
+		})
+	}
+}
+
+func TestSDPFragmentMarshal(t *testing.T) {
+	frag := &SDPFragment{
+		ICEUfrag: "EsAw",
+		ICEPwd:   "P2uYro0UCOQ4zxjKXaWCBui1",
+		Media: []SDPFragmentMedia{{
+			Media:           "audio 9 RTP/AVP 0",
+			Mid:             "0",
+			Candidates:      []string{"1387637174 1 udp 2122260223 192.0.2.1 61764 typ host"},
+			EndOfCandidates: true,
+		}},
+	}
+	want := "a=ice-ufrag:EsAw\r\na=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\nm=audio 9 RTP/AVP 0\r\na=mid:0\r\n" +
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host\r\na=end-of-candidates\r\n"
+
+	body := frag.Marshal()
+	if body != want {
+		t.Fatalf("body %q, want %q", body, want)
+	}
+	parsed, err := ParseSDPFragment(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, frag) {
+		t.Fatalf("round trip %+v, want %+v", parsed, frag)
+	}
+	if !parsed.HasEndOfCandidates() {
+		t.Fatal("end of candidates lost")
+	}
+}
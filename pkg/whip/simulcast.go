@@ -0,0 +1,69 @@
+package whip
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// SimulcastRIDs returns the rids the remote side sends on the m-line of mid,
+// in the order of its a=simulcast attribute. It is empty without simulcast.
+func SimulcastRIDs(desc *webrtc.SessionDescription, mid string) []string {
+	if desc == nil {
+		return nil
+	}
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return nil
+	}
+
+	for _, m := range parsed.MediaDescriptions {
+		if v, ok := m.Attribute("mid"); !ok || v != mid {
+			continue
+		}
+
+		var rids []string
+		if v, ok := m.Attribute("simulcast"); ok {
+			// a=simulcast:send f;h;q or a=simulcast:send f,~h;q
+			fields := strings.Fields(v)
+			if len(fields) >= 2 && fields[0] == "send" {
+				for _, alt := range strings.Split(fields[1], ";") {
+					rid := strings.TrimPrefix(strings.Split(alt, ",")[0], "~")
+					if rid != "" {
+						rids = append(rids, rid)
+					}
+				}
+			}
+		}
+		if len(rids) > 0 {
+			return rids
+		}
+
+		for _, a := range m.Attributes {
+			if a.Key != "rid" {
+				continue
+			}
+			fields := strings.Fields(a.Value)
+			if len(fields) >= 2 && fields[1] == "send" {
+				rids = append(rids, fields[0])
+			}
+		}
+		return rids
+	}
+	return nil
+}
+
+// Mid returns the mid of the transceiver that receives on receiver
+func (w *WHIPConn) Mid(receiver *webrtc.RTPReceiver) string {
+	for _, t := range w.pc.GetTransceivers() {
+		if t.Receiver() == receiver {
+			return t.Mid()
+		}
+	}
+	return ""
+}
+
+// SimulcastRIDs returns the rids the publisher sends on the m-line of mid
+func (w *WHIPConn) SimulcastRIDs(mid string) []string {
+	return SimulcastRIDs(w.pc.RemoteDescription(), mid)
+}
@@ -0,0 +1,57 @@
+package whip
+
+import (
+	"github.com/pion/webrtc/v3"
+)
+
+// Codecs returns the mime types of the tracks received and sent
+func (w *WHIPConn) Codecs() []string {
+	var codecs []string
+	for _, t := range w.pc.GetTransceivers() {
+		if receiver := t.Receiver(); receiver != nil {
+			for _, track := range receiver.Tracks() {
+				if track.Codec().MimeType != "" {
+					codecs = append(codecs, track.Codec().MimeType)
+				}
+			}
+		}
+		if sender := t.Sender(); sender != nil && sender.Track() != nil {
+			if params := sender.GetParameters(); len(params.Codecs) > 0 {
+				codecs = append(codecs, params.Codecs[0].MimeType)
+			}
+		}
+	}
+	return codecs
+}
+
+// SelectedCandidatePair returns the ICE candidate pair in use, nil before the
+// connection is established
+func (w *WHIPConn) SelectedCandidatePair() *webrtc.ICECandidatePair {
+	for _, t := range w.pc.GetTransceivers() {
+		var transport *webrtc.DTLSTransport
+		if t.Sender() != nil {
+			transport = t.Sender().Transport()
+		}
+		if transport == nil && t.Receiver() != nil {
+			transport = t.Receiver().Transport()
+		}
+		if transport == nil {
+			continue
+		}
+		if pair, err := transport.ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+			return pair
+		}
+	}
+	return nil
+}
+
+// BytesTransferred returns the bytes sent and received over the transport
+func (w *WHIPConn) BytesTransferred() (sent, received uint64) {
+	for _, stats := range w.pc.GetStats() {
+		if transport, ok := stats.(webrtc.TransportStats); ok {
+			sent += transport.BytesSent
+			received += transport.BytesReceived
+		}
+	}
+	return sent, received
+}
@@ -3,15 +3,49 @@ package whip
 import (
 	"log"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 )
 
 type WHIPConfig struct {
 	HtmlRoot string `mapstructure:"html_root"`
 	Addr     string `mapstructure:"addr"`
+	// Auth requires a LiveKit bearer token on WHIP/WHEP requests
+	Auth bool `mapstructure:"auth"`
+	// ShutdownTimeout is the graceful shutdown deadline in seconds
+	ShutdownTimeout int `mapstructure:"shutdown_timeout"`
+	// ParticipantPerPublisher gives each WHIP publisher its own LiveKit
+	// participant instead of a shared "whip-bot" per room
+	ParticipantPerPublisher bool `mapstructure:"participant_per_publisher"`
+	// PLIInterval additionally asks publishers for a keyframe every that many
+	// seconds, 0 only forwards the requests of LiveKit and WHEP viewers
+	PLIInterval int `mapstructure:"pli_interval"`
+	// Record writes the published tracks to files under RecordDir, a publish
+	// url can override it with ?record=
+	Record    bool   `mapstructure:"record"`
+	RecordDir string `mapstructure:"record_dir"`
+	// RecordFormat "mp4" muxes the tracks of a stream into fragmented MP4
+	// files, which roll over after RecordMaxSize megabytes or
+	// RecordMaxDuration seconds. Otherwise every track has a file of its own.
+	RecordFormat      string `mapstructure:"record_format"`
+	RecordMaxSize     int    `mapstructure:"record_max_size"`
+	RecordMaxDuration int    `mapstructure:"record_max_duration"`
+	// HLS serves the published streams as HLS under /hls/{room}/{stream}/,
+	// with segments of about HLSSegmentDuration seconds and, with
+	// HLSLowLatency, partial segments and blocking playlist reloads
+	HLS                bool `mapstructure:"hls"`
+	HLSSegmentDuration int  `mapstructure:"hls_segment_duration"`
+	HLSLowLatency      bool `mapstructure:"hls_low_latency"`
+	// RTMPAddr accepts RTMP publishers when set, their H264 video is
+	// published to LiveKit. RTMPAudio "reject" refuses the streams with
+	// audio, otherwise the audio is dropped.
+	RTMPAddr  string `mapstructure:"rtmp_addr"`
+	RTMPAudio string `mapstructure:"rtmp_audio"`
 }
 
 type LiveKitServerConfig struct {
@@ -40,6 +74,27 @@ type WebRTCConfig struct {
 	Candidates    Candidates        `mapstructure:"candidates"`
 }
 
+// WebhookConfig lists the endpoints that receive the lifecycle events
+type WebhookConfig struct {
+	URLs []string `mapstructure:"urls"`
+}
+
+// RTSPSourceConfig is an RTSP stream, e.g. of an IP camera, that is pulled
+// and published to a LiveKit room like a WHIP stream
+type RTSPSourceConfig struct {
+	URL    string `mapstructure:"url" json:"url"`
+	Room   string `mapstructure:"room" json:"room"`
+	Stream string `mapstructure:"stream" json:"stream"`
+}
+
+// RTPIngestConfig is a plain RTP stream on UDP, described by the SDP file of
+// its sender, that is published to a LiveKit room like a WHIP stream
+type RTPIngestConfig struct {
+	SDP    string `mapstructure:"sdp"`
+	Room   string `mapstructure:"room"`
+	Stream string `mapstructure:"stream"`
+}
+
 type LogConfig struct {
 	Level int `mapstructure:"level"`
 }
@@ -49,6 +104,9 @@ type Config struct {
 	WebRTC        WebRTCConfig        `mapstructure:"webrtc"`
 	WHIP          WHIPConfig          `mapstructure:"whip"`
 	LiveKitServer LiveKitServerConfig `mapstructure:"livekit"`
+	Webhook       WebhookConfig       `mapstructure:"webhook"`
+	RTSP          []RTSPSourceConfig  `mapstructure:"rtsp"`
+	RTP           []RTPIngestConfig   `mapstructure:"rtp"`
 	Log           LogConfig           `mapstructure:"log"`
 }
 
@@ -148,12 +206,23 @@ func NewWHIPConn() (*WHIPConn, error) {
 			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: videoRTCPFeedback},
 			PayloadType:        102,
 		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        98,
+		},
 	} {
 		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
 			return nil, err
 		}
 	}
 
+	// mid and rid header extensions are needed to demux simulcast encodings
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create a InterceptorRegistry. This is the user configurable RTP/RTCP Pipeline.
 	// This provides NACKs, RTCP Reports and other features. If you use `webrtc.NewPeerConnection`
 	// this is enabled by default. If you are manually managing You MUST create a InterceptorRegistry
@@ -253,6 +322,226 @@ func (w *WHIPConn) AddICECandidate(candidate webrtc.ICECandidateInit) error {
 	return w.pc.AddICECandidate(candidate)
 }
 
+// RemoteICECredentials returns the ice-ufrag and ice-pwd of the remote description
+func (w *WHIPConn) RemoteICECredentials() (string, string) {
+	remote := w.pc.RemoteDescription()
+	if remote == nil {
+		return "", ""
+	}
+	frag, err := SDPFragmentFromDescription(remote)
+	if err != nil {
+		return "", ""
+	}
+	return frag.ICEUfrag, frag.ICEPwd
+}
+
+// LocalICECredentials returns the ice-ufrag and ice-pwd of the local description
+func (w *WHIPConn) LocalICECredentials() (string, string) {
+	local := w.pc.LocalDescription()
+	if local == nil {
+		return "", ""
+	}
+	frag, err := SDPFragmentFromDescription(local)
+	if err != nil {
+		return "", ""
+	}
+	return frag.ICEUfrag, frag.ICEPwd
+}
+
+// AddSDPFragment adds the trickled candidates of frag to the remote description.
+// Candidates are mapped to their m-line by mid, falling back to the m-line order
+// of the fragment when the mid is missing.
+func (w *WHIPConn) AddSDPFragment(frag *SDPFragment) error {
+	remote := w.pc.RemoteDescription()
+	if remote == nil {
+		return webrtc.ErrNoRemoteDescription
+	}
+
+	ufrag, pwd := w.RemoteICECredentials()
+	if (frag.ICEUfrag != "" && frag.ICEUfrag != ufrag) || (frag.ICEPwd != "" && frag.ICEPwd != pwd) {
+		return ErrICECredentialsMismatch
+	}
+
+	for i, m := range frag.Media {
+		mid := m.Mid
+		index := uint16(i)
+		if mid != "" {
+			var err error
+			if index, err = mLineIndex(remote, mid); err != nil {
+				return err
+			}
+		}
+		for _, c := range m.Candidates {
+			if err := w.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: c, SDPMid: &mid, SDPMLineIndex: &index}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if frag.HasEndOfCandidates() {
+		return w.pc.AddICECandidate(webrtc.ICECandidateInit{})
+	}
+	return nil
+}
+
+// RestartICE applies new remote ICE credentials and returns the sdpfrag with
+// the new local credentials and candidates
+func (w *WHIPConn) RestartICE(ufrag, pwd string) (*SDPFragment, error) {
+	remote := w.pc.RemoteDescription()
+	if remote == nil {
+		return nil, webrtc.ErrNoRemoteDescription
+	}
+
+	offer, err := ReplaceICECredentials(remote, ufrag, pwd)
+	if err != nil {
+		return nil, err
+	}
+
+	// An offer with new credentials makes the ICE agent restart and gather again
+	offer.Type = webrtc.SDPTypeOffer
+	if err = w.pc.SetRemoteDescription(*offer); err != nil {
+		log.Printf("SetRemoteDescription err %v ", err)
+		return nil, err
+	}
+
+	answer, err := w.pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("CreateAnswer err %v ", err)
+		return nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(w.pc)
+
+	if err = w.pc.SetLocalDescription(answer); err != nil {
+		log.Printf("SetLocalDescription err %v ", err)
+		return nil, err
+	}
+
+	<-gatherComplete
+
+	return SDPFragmentFromDescription(w.pc.LocalDescription())
+}
+
+// RemoveTrack stops sending the track of sender, the change takes effect with
+// the next renegotiation
+func (w *WHIPConn) RemoveTrack(sender *webrtc.RTPSender) error {
+	return w.pc.RemoveTrack(sender)
+}
+
+// ReplaceTrack sends track on sender from now on without renegotiation, nil
+// stops sending
+func (w *WHIPConn) ReplaceTrack(sender *webrtc.RTPSender, track webrtc.TrackLocal) error {
+	return sender.ReplaceTrack(track)
+}
+
+// OfferedCodecs returns, per media kind of the offer, the first offered codec
+// the WHIP conn supports
+func OfferedCodecs(offer webrtc.SessionDescription) map[webrtc.RTPCodecType]webrtc.RTPCodecCapability {
+	codecs := make(map[webrtc.RTPCodecType]webrtc.RTPCodecCapability)
+	for kind, offered := range offeredCodecs(offer) {
+		codecs[kind] = offered[0]
+	}
+	return codecs
+}
+
+// OffersCodec reports whether the offer has codec among the supported codecs
+// of its kind
+func OffersCodec(offer webrtc.SessionDescription, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability) bool {
+	for _, offered := range offeredCodecs(offer)[kind] {
+		if strings.EqualFold(offered.MimeType, codec.MimeType) && offered.ClockRate == codec.ClockRate {
+			return true
+		}
+	}
+	return false
+}
+
+// offeredCodecs returns the supported codecs of the first m-line of each media
+// kind of the offer, in offer order
+func offeredCodecs(offer webrtc.SessionDescription) map[webrtc.RTPCodecType][]webrtc.RTPCodecCapability {
+	codecs := make(map[webrtc.RTPCodecType][]webrtc.RTPCodecCapability)
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return codecs
+	}
+
+	for _, m := range parsed.MediaDescriptions {
+		kind := webrtc.NewRTPCodecType(m.MediaName.Media)
+		if _, ok := codecs[kind]; ok || kind == 0 {
+			continue
+		}
+		var offered []webrtc.RTPCodecCapability
+		for _, format := range m.MediaName.Formats {
+			pt, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(uint8(pt))
+			if err != nil {
+				continue
+			}
+			mimeType := m.MediaName.Media + "/" + codec.Name
+			if !isSupportedMimeType(mimeType) {
+				continue
+			}
+			channels, _ := strconv.ParseUint(codec.EncodingParameters, 10, 16)
+			offered = append(offered, webrtc.RTPCodecCapability{
+				MimeType:    mimeType,
+				ClockRate:   codec.ClockRate,
+				Channels:    uint16(channels),
+				SDPFmtpLine: codec.Fmtp,
+			})
+		}
+		if len(offered) > 0 {
+			codecs[kind] = offered
+		}
+	}
+	return codecs
+}
+
+func isSupportedMimeType(mimeType string) bool {
+	for _, supported := range []string{mineTypePCMA, mimeTypeOpus, mimeTypeVP8, mimeTypeH264, mimeTypeVP9} {
+		if strings.EqualFold(mimeType, supported) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateOffer starts a server-initiated renegotiation and returns the offer
+// with the gathered candidates
+func (w *WHIPConn) CreateOffer() (*webrtc.SessionDescription, error) {
+	offer, err := w.pc.CreateOffer(nil)
+	if err != nil {
+		log.Printf("CreateOffer err %v ", err)
+		return nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(w.pc)
+
+	if err = w.pc.SetLocalDescription(offer); err != nil {
+		log.Printf("SetLocalDescription err %v ", err)
+		return nil, err
+	}
+
+	<-gatherComplete
+
+	return w.pc.LocalDescription(), nil
+}
+
+// SetAnswer completes a renegotiation started with CreateOffer
+func (w *WHIPConn) SetAnswer(answer webrtc.SessionDescription) error {
+	if err := w.pc.SetRemoteDescription(answer); err != nil {
+		log.Printf("SetRemoteDescription err %v ", err)
+		return err
+	}
+	return nil
+}
+
+// ConnectionState returns the connection state of the underlying peer connection
+func (w *WHIPConn) ConnectionState() webrtc.PeerConnectionState {
+	return w.pc.ConnectionState()
+}
+
 func (w *WHIPConn) PictureLossIndication() {
 	for _, track := range w.tracks {
 		if track.Kind() == webrtc.RTPCodecTypeVideo {